@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gracenoah/tezos-hsm-signer/signer"
+)
+
+// parseCommand splits a leading subcommand such as "keys discover" from the
+// flags that follow it.  Without a subcommand the signer is served.
+func parseCommand(args []string) (string, []string) {
+	command := []string{}
+	for len(args) > 0 && len(command) < 2 && !strings.HasPrefix(args[0], "-") {
+		command = append(command, args[0])
+		args = args[1:]
+	}
+	return strings.Join(command, " "), args
+}
+
+func runCommand(command string) {
+	switch command {
+	case "keys discover":
+		discoverKeys()
+	case "keys generate":
+		generateKey()
+	default:
+		log.Fatalf("Unknown command %q.  Commands are: keys discover, keys generate, config validate\n", command)
+	}
+}
+
+// discoverKeys prints every key in the HSM in the --keyfile format
+func discoverKeys() {
+	hsm := getPKCS11Signer()
+	defer hsm.Close()
+
+	keys, err := hsm.Discover(context.Background())
+	if err != nil {
+		log.Fatalln("Unable to discover keys:", err)
+	}
+	contents, err := signer.MarshalKeys(keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(contents)
+}
+
+// generateKey creates a key in the HSM and appends it to --keyfile
+func generateKey() {
+	// Check the key file before creating a key that can't be added to it
+	if _, err := os.Stat(*keyfile); err == nil {
+		keys, err := signer.LoadKeyFile(*keyfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range keys {
+			if key.Name == *generateLabel {
+				log.Fatalf("Key %v is already in %v\n", key.Name, *keyfile)
+			}
+		}
+	}
+
+	hsm := getPKCS11Signer()
+	defer hsm.Close()
+	key, err := hsm.Generate(context.Background(), *generateSlot, *generateLabel, *generateCurve)
+	if err != nil {
+		log.Fatalln("Unable to generate a key:", err)
+	}
+	if err = signer.AppendKeyFile(*keyfile, *key); err != nil {
+		log.Fatalf("Generated %v but could not add it to %v: %v\n", key.PublicKeyHash, *keyfile, err)
+	}
+	log.Printf("Generated %v (%v) and added it to %v\n", key.PublicKeyHash, key.PublicKey, *keyfile)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gracenoah/tezos-hsm-signer/signer"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Environment variables named after a flag override the config file, such as
+// TEZOS_HSM_SIGNER_BIND for --bind
+const envPrefix = "TEZOS_HSM_SIGNER_"
+
+// Flags that already default to a standard environment variable
+var flagEnv = map[string]string{
+	"vault-addr":  "VAULT_ADDR",
+	"vault-token": "VAULT_TOKEN",
+}
+
+// Settings applied from the config file at startup, by flag name
+var configSettings = map[string]configSetting{}
+
+// Flags set on the command line, which override the config file
+var explicitFlags = map[string]bool{}
+
+// configError is a problem at a line of the config file
+type configError struct {
+	line int
+	err  string
+}
+
+func (err configError) String() string {
+	if err.line == 0 {
+		return fmt.Sprintf("%v: %v", *configFile, err.err)
+	}
+	return fmt.Sprintf("%v:%v: %v", *configFile, err.line, err.err)
+}
+
+// config is a parsed --config file.  Each setting is named after its flag, and
+// keys may be listed under keys instead of in --keyfile.
+type config struct {
+	settings []configSetting
+	keys     []signer.Key
+	hasKeys  bool
+	errors   []configError
+}
+
+type configSetting struct {
+	name  string
+	value string
+	line  int
+}
+
+// line of a setting, or 0 if it isn't in the file
+func (cfg *config) line(name string) int {
+	for _, setting := range cfg.settings {
+		if setting.name == name {
+			return setting.line
+		}
+	}
+	return 0
+}
+
+// parseConfigFile reads the settings and keys of a config file, collecting
+// every error rather than stopping at the first
+func parseConfigFile(file string) *config {
+	cfg := &config{}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		cfg.fail(0, "unable to read file: %v", err)
+		return cfg
+	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(contents, &root); err != nil {
+		cfg.fail(0, "%v", err)
+		return cfg
+	}
+	if len(root.Content) == 0 {
+		return cfg
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		cfg.fail(mapping.Line, "expected a mapping of settings")
+		return cfg
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		name, value := mapping.Content[i], mapping.Content[i+1]
+		switch {
+		case name.Value == "keys":
+			cfg.parseKeys(value)
+		case name.Value == "config" || flag.Lookup(name.Value) == nil:
+			cfg.fail(name.Line, "unknown setting %q", name.Value)
+		case value.Kind == yaml.ScalarNode:
+			cfg.settings = append(cfg.settings, configSetting{name: name.Value, value: value.Value, line: value.Line})
+		case value.Kind == yaml.SequenceNode:
+			// Lists are comma delimited, as on the command line
+			values := []string{}
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					cfg.fail(item.Line, "%v must be a list of values", name.Value)
+				}
+				values = append(values, item.Value)
+			}
+			cfg.settings = append(cfg.settings, configSetting{name: name.Value, value: strings.Join(values, ","), line: value.Line})
+		default:
+			cfg.fail(value.Line, "%v must be a value or a list of values", name.Value)
+		}
+	}
+	if line := cfg.line("keyfile"); line > 0 && cfg.hasKeys {
+		cfg.fail(line, "only one of keyfile and keys can be set")
+	}
+	return cfg
+}
+
+// parseKeys decodes and validates the keys section
+func (cfg *config) parseKeys(node *yaml.Node) {
+	cfg.hasKeys = true
+	if node.Kind != yaml.SequenceNode {
+		cfg.fail(node.Line, "keys must be a list of keys")
+		return
+	}
+	for _, item := range node.Content {
+		key := signer.Key{}
+		if err := item.Decode(&key); err != nil {
+			cfg.fail(item.Line, "invalid key: %v", err)
+			continue
+		}
+		if err := key.Validate(); err != nil {
+			cfg.fail(item.Line, "invalid key %v: %v", key.Name, err)
+			continue
+		}
+		cfg.keys = append(cfg.keys, key)
+	}
+}
+
+func (cfg *config) fail(line int, format string, v ...interface{}) {
+	cfg.errors = append(cfg.errors, configError{line: line, err: fmt.Sprintf(format, v...)})
+}
+
+// loadConfig sets flags from --config and then the environment, unless they
+// were set on the command line.  Flags override environment variables, which
+// override the config file.
+func loadConfig() []configError {
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	errors := []configError{}
+	if len(*configFile) > 0 {
+		cfg := parseConfigFile(*configFile)
+		errors = append(errors, cfg.errors...)
+		for _, setting := range cfg.settings {
+			if isOverridden(setting.name) {
+				continue
+			}
+			if err := flag.Set(setting.name, setting.value); err != nil {
+				errors = append(errors, configError{line: setting.line, err: fmt.Sprintf("invalid %v: %v", setting.name, err)})
+			}
+			configSettings[setting.name] = setting
+		}
+		keysFromConfig = cfg.hasKeys && !isOverridden("keyfile")
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if value := os.Getenv(envName(f.Name)); len(value) > 0 && !explicitFlags[f.Name] {
+			if err := flag.Set(f.Name, value); err != nil {
+				errors = append(errors, configError{err: fmt.Sprintf("invalid $%v: %v", envName(f.Name), err)})
+			}
+		}
+	})
+	sortConfigErrors(errors)
+	return errors
+}
+
+// isOverridden returns true if a flag is set on the command line or in the
+// environment, so the config file doesn't apply to it
+func isOverridden(name string) bool {
+	return explicitFlags[name] || len(envValue(name)) > 0
+}
+
+// reloadConfigFile parses --config again for a reload.  It returns the value of
+// each flag as the reloaded file sets it, which falls back to the default for
+// settings removed from the file, and logs changed settings that only apply
+// after a restart.
+func reloadConfigFile(reloadable []string) (func(name string) string, error) {
+	cfg := parseConfigFile(*configFile)
+	if len(cfg.errors) > 0 {
+		return nil, fmt.Errorf("invalid config file %v", cfg.errors[0])
+	}
+	settings := map[string]string{}
+	for _, setting := range cfg.settings {
+		settings[setting.name] = setting.value
+	}
+
+	value := func(name string) string {
+		if isOverridden(name) {
+			return flag.Lookup(name).Value.String()
+		}
+		if value, ok := settings[name]; ok {
+			return value
+		}
+		return flag.Lookup(name).DefValue
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		for _, name := range reloadable {
+			if f.Name == name {
+				return
+			}
+		}
+		if isOverridden(f.Name) {
+			return
+		}
+		if settings[f.Name] != configSettings[f.Name].value {
+			log.Printf("WARNING: %v changed in %v, restart the signer to apply it\n", f.Name, *configFile)
+		}
+	})
+	return value, nil
+}
+
+// sortConfigErrors by line
+func sortConfigErrors(errors []configError) {
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].line < errors[j].line
+	})
+}
+
+// envName of the environment variable that overrides a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// envValue of a flag, from its own environment variable or a standard one
+func envValue(name string) string {
+	if value := os.Getenv(envName(name)); len(value) > 0 {
+		return value
+	}
+	if env, ok := flagEnv[name]; ok {
+		return os.Getenv(env)
+	}
+	return ""
+}
+
+// loadKeys from the config file's keys, or else --keyfile
+func loadKeys() ([]signer.Key, error) {
+	if !keysFromConfig {
+		return signer.LoadKeyFile(*keyfile)
+	}
+	cfg := parseConfigFile(*configFile)
+	if len(cfg.errors) > 0 {
+		return nil, fmt.Errorf("invalid config file %v", cfg.errors[0])
+	}
+	return cfg.keys, nil
+}
+
+// keysFile is the file keys are loaded from
+func keysFile() string {
+	if keysFromConfig {
+		return *configFile
+	}
+	return *keyfile
+}
+
+// reloadFiles are watched for changes to the keys and the operation filter
+func reloadFiles() []string {
+	files := []string{keysFile()}
+	if len(*configFile) > 0 && !keysFromConfig {
+		files = append(files, *configFile)
+	}
+	return files
+}
+
+// validateConfig reports every error in --config and the settings it leads to,
+// with the line of the setting at fault
+func validateConfig(errors []configError) {
+	if len(*configFile) == 0 {
+		log.Fatal("config validate requires --config")
+	}
+	errors = checkConfig(errors)
+	for _, err := range errors {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errors) > 0 {
+		os.Exit(1)
+	}
+	log.Printf("%v is valid\n", *configFile)
+}
+
+// checkConfig adds the errors in the settings that were loaded to the errors
+// loading them, sorted by line
+func checkConfig(errors []configError) []configError {
+	check := func(name string, err error) {
+		if err != nil {
+			errors = append(errors, configError{line: configSettings[name].line, err: fmt.Sprintf("invalid %v: %v", name, err)})
+		}
+	}
+	oneOf := func(name string, value string, values ...string) {
+		for _, v := range values {
+			if value == v {
+				return
+			}
+		}
+		check(name, fmt.Errorf("%q must be one of %v", value, strings.Join(values, ", ")))
+	}
+
+	for _, name := range strings.Split(*backend, ",") {
+		oneOf("backend", name, signer.Backends...)
+	}
+	oneOf("watermark-type", *watermarkType, "ignore", "session", "file", "dynamodb")
+	oneOf("spending-type", *spendingType, "session", "file")
+	if len(*txDailyMax) > 0 {
+		_, err := signer.ParseTez(*txDailyMax)
+		check("tx-daily-max", err)
+	}
+	_, err := strconv.ParseUint(*socketMode, 8, 32)
+	check("socket-mode", err)
+	_, _, err = signer.ParseSocketOwner(*socketOwner)
+	check("socket-owner", err)
+	_, err = signer.ParseIDs(*socketAllowedUIDs)
+	check("socket-allowed-uids", err)
+	_, err = signer.ParseIDs(*socketAllowedGIDs)
+	check("socket-allowed-gids", err)
+	if len(*hsmPinFile) > 0 && len(*hsmPin) > 0 {
+		check("hsm-pin-file", fmt.Errorf("only one of hsm-pin and hsm-pin-file can be set"))
+	}
+	if !keysFromConfig {
+		_, err = signer.LoadKeyFile(*keyfile)
+		check("keyfile", err)
+	}
+
+	sortConfigErrors(errors)
+	return errors
+}
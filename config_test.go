@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testPublicKey = "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S"
+
+// resetFlags to their defaults and parse args, as if the signer just started
+func resetFlags(t *testing.T, args ...string) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		// Keep the settings of the test binary itself
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = flags
+	explicitFlags = map[string]bool{}
+	configSettings = map[string]configSetting{}
+	keysFromConfig = false
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeConfig to a temporary file, returning its path
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// compareConfigErrors by their output, ignoring the file name
+func compareConfigErrors(t *testing.T, name string, errors []configError, expected []string) {
+	actual := []string{}
+	for _, err := range errors {
+		actual = append(actual, strings.TrimPrefix(err.String(), *configFile))
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		log.Printf("[%v] Expected errors:\n%v\nReceived:\n%v\n", name, strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+		t.Fail()
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	file := writeConfig(t, `bind: localhost:6733
+watermark-type: sessions
+backend: pkcs11,hsm
+socket-mode: "0999"
+keys:
+  - Name: baker
+    PublicKey: `+testPublicKey+`
+`)
+	defer os.RemoveAll(path.Dir(file))
+	resetFlags(t, "--config", file)
+
+	// Errors in the values of settings are reported at their lines
+	compareConfigErrors(t, "Validate", checkConfig(loadConfig()), []string{
+		":2: invalid watermark-type: \"sessions\" must be one of ignore, session, file, dynamodb",
+		":3: invalid backend: \"hsm\" must be one of pkcs11, gcpkms, awskms, vault, file, proxy",
+		":4: invalid socket-mode: strconv.ParseUint: parsing \"0999\": invalid syntax",
+	})
+}
+
+func TestConfigInvalidFields(t *testing.T) {
+	file := writeConfig(t, `bind: localhost:6733
+bogus: 1
+enable-tx: maybe
+hsm-max-sessions: lots
+metrics-bind:
+  host: localhost
+config: other.yaml
+keys:
+  - Name: baker
+    PublicKey: `+testPublicKey+`
+    HsmSlot: first
+  - Name: broken
+    PublicKey: sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8X
+`)
+	defer os.RemoveAll(path.Dir(file))
+	resetFlags(t, "--config", file)
+
+	// Unknown settings and badly typed values are rejected at their lines
+	errors := loadConfig()
+	compareConfigErrors(t, "Invalid Fields", errors, []string{
+		":2: unknown setting \"bogus\"",
+		":3: invalid enable-tx: parse error",
+		":4: invalid hsm-max-sessions: parse error",
+		":6: metrics-bind must be a value or a list of values",
+		":7: unknown setting \"config\"",
+		":9: invalid key: yaml: unmarshal errors:\n  line 11: cannot unmarshal !!str `first` into uint",
+		":12: invalid key broken: invalid public key sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8X: invalid b58 checksum",
+	})
+	if *bind != "localhost:6733" {
+		log.Println("Expected valid settings to apply despite other errors, received", *bind)
+		t.Fail()
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, `bind: file:6732
+metrics-bind: file:9000
+watermark-table: file
+tx-whitelist-addresses: [tz1abc, tz2def]
+`)
+	defer os.RemoveAll(path.Dir(file))
+	os.Setenv("TEZOS_HSM_SIGNER_BIND", "env:6732")
+	os.Setenv("TEZOS_HSM_SIGNER_METRICS_BIND", "env:9000")
+	defer os.Unsetenv("TEZOS_HSM_SIGNER_BIND")
+	defer os.Unsetenv("TEZOS_HSM_SIGNER_METRICS_BIND")
+	resetFlags(t, "--config", file, "--bind", "flag:6732")
+
+	// Flags override the environment, which overrides the config file
+	if errors := loadConfig(); len(errors) > 0 {
+		log.Println("Unexpected config errors:", errors)
+		t.Fail()
+	}
+	for name, expected := range map[string]string{
+		"bind":                   "flag:6732",
+		"metrics-bind":           "env:9000",
+		"watermark-table":        "file",
+		"tx-whitelist-addresses": "tz1abc,tz2def",
+		"watermark-type":         "file",
+	} {
+		if flagValue(name) != expected {
+			log.Printf("Expected --%v to be %v but received %v\n", name, expected, flagValue(name))
+			t.Fail()
+		}
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	file := writeConfig(t, `keys:
+  - Name: baker
+    PublicKey: `+testPublicKey+`
+    Policy:
+      EnableTx: true
+`)
+	defer os.RemoveAll(path.Dir(file))
+	resetFlags(t, "--config", file)
+
+	// Keys listed in the config file replace --keyfile
+	if errors := checkConfig(loadConfig()); len(errors) > 0 {
+		log.Println("Unexpected config errors:", errors)
+		t.Fail()
+	}
+	keys, err := loadKeys()
+	if err != nil || len(keys) != 1 || keys[0].Name != "baker" || !keys[0].Policy.EnableTx {
+		log.Println("Unexpected keys from the config file:", keys, err)
+		t.Fail()
+	} else if keys[0].PublicKeyHash != "tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg" {
+		log.Println("Expected the public key hash to be derived, received", keys[0].PublicKeyHash)
+		t.Fail()
+	}
+	if keysFile() != file {
+		log.Println("Expected keys to be reloaded from the config file, received", keysFile())
+		t.Fail()
+	}
+
+	// --keyfile on the command line overrides them
+	resetFlags(t, "--config", file, "--keyfile", "other.yaml")
+	loadConfig()
+	if keysFromConfig || keysFile() != "other.yaml" {
+		log.Println("Expected --keyfile to override keys in the config file")
+		t.Fail()
+	}
+
+	// Only one of keyfile and keys can be set in the file
+	both := writeConfig(t, "keyfile: keys.yaml\nkeys: []\n")
+	defer os.RemoveAll(path.Dir(both))
+	resetFlags(t, "--config", both)
+	compareConfigErrors(t, "Keyfile And Keys", loadConfig(), []string{
+		":1: only one of keyfile and keys can be set",
+	})
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	file := writeConfig(t, "enable-tx: true\ntx-daily-max: \"10\"\n")
+	defer os.RemoveAll(path.Dir(file))
+	resetFlags(t, "--config", file, "--enable-voting")
+	loadConfig()
+
+	// Filter settings follow the file, and removed settings return to defaults
+	ioutil.WriteFile(file, []byte("enable-generic: true\nenable-voting: false\nbind: localhost:6733\n"), 0600)
+	value, err := reloadConfigFile(filterFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := getOperationFilter(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.EnableGeneric || filter.EnableTx || filter.TxDailyMax != nil {
+		log.Printf("Unexpected reloaded filter: %+v\n", filter)
+		t.Fail()
+	}
+	// Flags still override the file
+	if !filter.EnableVoting {
+		log.Println("Expected --enable-voting to override the config file")
+		t.Fail()
+	}
+
+	// Invalid files are not reloaded
+	ioutil.WriteFile(file, []byte("enable-tx: [\n"), 0600)
+	if _, err := reloadConfigFile(filterFlags); err == nil {
+		log.Println("Expected an error reloading an invalid config file")
+		t.Fail()
+	}
+}
@@ -1,31 +1,87 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"math/big"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	cloudkms "cloud.google.com/go/kms/apiv1"
 	"github.com/gracenoah/tezos-hsm-signer/signer"
+	"github.com/gracenoah/tezos-hsm-signer/signer/spending"
 	"github.com/gracenoah/tezos-hsm-signer/signer/watermark"
 )
 
+// Whether keys are listed in --config rather than --keyfile
+var keysFromConfig bool
+
 var (
+	// Config File Flags
+	configFile = flag.String("config", "", "Yaml file of settings named after these flags, and optionally keys.  Flags and ${TEZOS_HSM_SIGNER_<FLAG>} environment variables override it")
 	// Server Flags
-	bind    = flag.String("bind", "localhost:6732", "Host:Port for the signer to bind to")
-	keyfile = flag.String("keyfile", "./keys.yaml", "Yaml file that identifies keys preloaded in your HSM")
-	debug   = flag.Bool("debug", false, "Enable debug mode")
+	bind         = flag.String("bind", "localhost:6732", "Host:Port or unix:/path/to/socket for the signer to bind to")
+	keyfile      = flag.String("keyfile", "./keys.yaml", "Yaml file that identifies keys preloaded in your HSM.  Reloaded on SIGHUP")
+	keyfileWatch = flag.Duration("keyfile-watch-interval", 0, "How often to check --keyfile for changes and reload it.  Disabled if 0")
+	debug        = flag.Bool("debug", false, "Enable debug mode")
+	// Unix Socket Flags
+	socketMode        = flag.String("socket-mode", "0660", "If --bind is a unix socket, its octal file mode")
+	socketOwner       = flag.String("socket-owner", "", "If --bind is a unix socket, its user:group owner")
+	socketAllowedUIDs = flag.String("socket-allowed-uids", "", "Comma delimited list of uids allowed to request signatures over the unix socket")
+	socketAllowedGIDs = flag.String("socket-allowed-gids", "", "Comma delimited list of gids allowed to request signatures over the unix socket")
+	// TLS Flags
+	tlsCert     = flag.String("tls-cert", "", "PEM certificate to serve the signer over TLS.  Reloaded on SIGHUP")
+	tlsKey      = flag.String("tls-key", "", "PEM private key for --tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "PEM CA bundle used to verify client certificates.  Enables mutual TLS")
+	// Metrics Flags
+	metricsBind = flag.String("metrics-bind", "", "Host:Port to serve prometheus metrics on at /metrics.  Metrics are disabled if unset")
+	// Authentication Flags
+	authorizedKeys = flag.String("authorized-keys", "", "Yaml file listing public keys of clients allowed to request signatures.  Authentication is disabled if unset")
 	// Operation Filter Flags
 	enableGeneric        = flag.Bool("enable-generic", false, "Enable all generic operations including transfer, voting and reveals")
 	enableTx             = flag.Bool("enable-tx", false, "Enable transferring funds")
 	enableVoting         = flag.Bool("enable-voting", false, "Enable voting proposals and ballots")
 	txWhitelistAddresses = flag.String("tx-whitelist-addresses", "", "Comma delimited list of tz addresses that transfers are enabled to")
-	txDailyMax           = flag.String("tx-daily-max", "", "Max amount of XTZ that can be transferred in a 24 hour period")
+	txDailyMax           = flag.String("tx-daily-max", "", "Max amount of XTZ that can be spent in a rolling 24 hour period.  Transferred amounts, fees, balances and storage burns of every manager operation count towards it")
+	// Spending Flags
+	spendingType = flag.String("spending-type", "file", "Location to store amounts spent towards limits.  One of \"session\" or \"file\"")
+	spendingFile = flag.String("spending-file", "", "If --spending-type is \"file\", the file to store spends in.  Default is ${HOME}/.hsm-signer-spending")
+	// Backend Flags
+	backend = flag.String("backend", "pkcs11", "Where keys are held, unless a key sets its own Backend.  A comma delimited list of backends fails over between them in order.  One of \"pkcs11\", \"gcpkms\", \"awskms\", \"vault\", \"file\" or \"proxy\".  With \"gcpkms\", each key's Name is its KMS key version resource.  With \"awskms\", each key's Name is its KMS key id, ARN or alias.  With \"vault\", each key's Name is its transit key.  With \"file\", keys are read from --secret-keys.  With \"proxy\", operations are forwarded to --proxy-url")
+	// Vault Flags
+	vaultAddr         = flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "Address of the Vault server.  Default is ${VAULT_ADDR}")
+	vaultToken        = flag.String("vault-token", os.Getenv("VAULT_TOKEN"), "Vault token to sign with.  Default is ${VAULT_TOKEN}")
+	vaultTokenFile    = flag.String("vault-token-file", "", "Text file containing the Vault token to sign with")
+	vaultRoleID       = flag.String("vault-role-id", "", "AppRole role id to log into Vault with.  Takes precedence over --vault-token")
+	vaultSecretIDFile = flag.String("vault-secret-id-file", "", "Text file containing the AppRole secret id for --vault-role-id")
+	vaultAppRoleMount = flag.String("vault-approle-mount", "approle", "Mount path of Vault's AppRole auth method")
+	vaultTransitMount = flag.String("vault-transit-mount", "transit", "Mount path of Vault's transit secrets engine")
+	// Failover Flags
+	failoverThreshold = flag.Int("failover-threshold", 3, "Consecutive failures after which a failover backend is skipped")
+	failoverCooldown  = flag.Duration("failover-cooldown", 30*time.Second, "Time a failed failover backend is skipped for before it is tried again")
+	// Secret Key File Flags
+	secretKeys               = flag.String("secret-keys", "", "If --backend is \"file\", an octez client secret_keys file of edesk, spesk or p2esk encrypted keys")
+	secretKeysPassphraseFile = flag.String("secret-keys-passphrase-file", "", "Text file containing the passphrase for --secret-keys.  Default is ${TEZOS_SIGNER_PASSPHRASE}")
+	// Proxy Flags
+	proxyURL               = flag.String("proxy-url", "", "If --backend is \"proxy\", the URL of the upstream tezos remote signer to forward operations to")
+	proxyAuthenticationKey = flag.String("proxy-authentication-key-file", "", "Text file containing an unencrypted edsk, spsk or p2sk secret key to authenticate with the upstream signer")
+	proxyTLSCert           = flag.String("proxy-tls-cert", "", "PEM client certificate for upstream signers that require mutual TLS")
+	proxyTLSKey            = flag.String("proxy-tls-key", "", "PEM private key for --proxy-tls-cert")
+	proxyTLSCA             = flag.String("proxy-tls-ca", "", "PEM CA bundle used to verify the upstream signer.  Default is the system roots")
 	// HSM Flags
-	hsmPin     = flag.String("hsm-pin", "", "User PIN to log into the HSM")
-	hsmPinFile = flag.String("hsm-pin-file", "", "Text file containing the user PIN to log into the HSM")
-	hsmSO      = flag.String("hsm-so", "", "Shared object used to access the HSM")
+	hsmPin        = flag.String("hsm-pin", "", "User PIN to log into the HSM")
+	hsmPinFile    = flag.String("hsm-pin-file", "", "Text file containing the user PIN to log into the HSM")
+	hsmSO         = flag.String("hsm-so", "", "Shared object used to access the HSM")
+	hsmFailoverSO = flag.String("hsm-failover-so", "", "Comma delimited list of shared objects of HSMs holding the same keys, which are used in order when --hsm-so fails")
+	hsmSessions   = flag.Int("hsm-max-sessions", 4, "Maximum number of HSM sessions open on each slot")
+	// Key Generation Flags
+	generateCurve = flag.String("curve", "secp256k1", "For keys generate, the curve of the new key.  One of \"ed25519\", \"secp256k1\" or \"p256\"")
+	generateSlot  = flag.Uint("slot", 0, "For keys generate, the HSM slot to create the key in")
+	generateLabel = flag.String("label", "", "For keys generate, the label of the new key.  Also used as its name in --keyfile")
 	// Watermark Flags
 	watermarkType  = flag.String("watermark-type", "file", "Location to store high-watermark.  One of \"ignore\", \"session\", \"file\" or \"dynamodb\"")
 	watermarkTable = flag.String("watermark-table", "tezos-hsm-signer", "If --watermark-type is \"dynamodb\", the DynamoDB table to store high-watermarks in")
@@ -41,8 +97,241 @@ func getPinFromHsmFile(file string) *string {
 	return &pin
 }
 
+func getSocketConfig() signer.SocketConfig {
+	config := signer.DefaultSocketConfig
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalln("Invalid --socket-mode:", err)
+	}
+	config.Mode = os.FileMode(mode)
+	if config.UID, config.GID, err = signer.ParseSocketOwner(*socketOwner); err != nil {
+		log.Fatalln("Invalid --socket-owner:", err)
+	}
+	if config.AllowedUIDs, err = signer.ParseIDs(*socketAllowedUIDs); err != nil {
+		log.Fatalln("Invalid --socket-allowed-uids:", err)
+	}
+	if config.AllowedGIDs, err = signer.ParseIDs(*socketAllowedGIDs); err != nil {
+		log.Fatalln("Invalid --socket-allowed-gids:", err)
+	}
+	return config
+}
+
+func getPKCS11Signer() *signer.PKCS11Signer {
+	return &signer.PKCS11Signer{
+		UserPin:            *hsmPin,
+		LibPath:            *hsmSO,
+		MaxSessionsPerSlot: *hsmSessions,
+	}
+}
+
+func getVaultSigner() *signer.VaultSigner {
+	vault := &signer.VaultSigner{
+		Address:      *vaultAddr,
+		TransitMount: *vaultTransitMount,
+		Token:        *vaultToken,
+		RoleID:       *vaultRoleID,
+		AppRoleMount: *vaultAppRoleMount,
+	}
+	if len(*vaultTokenFile) > 0 {
+		vault.Token = *getPinFromHsmFile(*vaultTokenFile)
+	}
+	if len(*vaultSecretIDFile) > 0 {
+		vault.SecretID = *getPinFromHsmFile(*vaultSecretIDFile)
+	}
+	if len(vault.Address) == 0 {
+		log.Fatal("--vault-addr is required to sign with vault")
+	}
+	return vault
+}
+
+func getSecretKeySigner() signer.Signer {
+	if len(*secretKeys) == 0 {
+		log.Fatal("--secret-keys is required to sign with file")
+	}
+	passphrase := os.Getenv("TEZOS_SIGNER_PASSPHRASE")
+	if len(*secretKeysPassphraseFile) > 0 {
+		passphrase = *getPinFromHsmFile(*secretKeysPassphraseFile)
+	}
+	fileSigner, err := signer.LoadSecretKeyFile(*secretKeys, []byte(passphrase))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fileSigner
+}
+
+func getProxySigner() signer.Signer {
+	config := signer.ProxyConfig{
+		URL:      *proxyURL,
+		CertFile: *proxyTLSCert,
+		KeyFile:  *proxyTLSKey,
+		CAFile:   *proxyTLSCA,
+	}
+	if len(*proxyAuthenticationKey) > 0 {
+		config.AuthenticationKey = *getPinFromHsmFile(*proxyAuthenticationKey)
+	}
+	proxy, err := signer.NewProxySigner(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return proxy
+}
+
+// Flags of the global operation filter, which are reloaded from --config
+var filterFlags = []string{"enable-generic", "enable-tx", "enable-voting", "tx-whitelist-addresses", "tx-daily-max"}
+
+// flagValue of a flag as it was set at startup
+func flagValue(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+// getOperationFilter from the values of the operation filter flags
+func getOperationFilter(value func(name string) string) (signer.OperationFilter, error) {
+	filter := signer.OperationFilter{}
+	var err error
+	for name, enabled := range map[string]*bool{
+		"enable-generic": &filter.EnableGeneric,
+		"enable-tx":      &filter.EnableTx,
+		"enable-voting":  &filter.EnableVoting,
+	} {
+		if *enabled, err = strconv.ParseBool(value(name)); err != nil {
+			return filter, fmt.Errorf("invalid --%v: %v", name, err)
+		}
+	}
+	if len(value("tx-daily-max")) > 0 {
+		if filter.TxDailyMax, err = signer.ParseTez(value("tx-daily-max")); err != nil {
+			return filter, fmt.Errorf("invalid --tx-daily-max: %v", err)
+		}
+	}
+	if len(value("tx-whitelist-addresses")) > 0 {
+		filter.TxWhitelistAddresses = strings.Split(value("tx-whitelist-addresses"), ",")
+	}
+	return filter, nil
+}
+
+// backendNames returns the --backend and every backend named by a key
+func backendNames(keys []signer.Key) []string {
+	names := []string{*backend}
+	for _, key := range keys {
+		if len(key.Backend) > 0 {
+			names = append(names, key.Backend)
+		}
+	}
+	return names
+}
+
+// getSigners for the --backend and every backend named by a key.  Each backend
+// is only created once, and comma delimited backends fail over in order.
+func getSigners(keys []signer.Key) signer.Signer {
+	names := backendNames(keys)
+	backends := map[string]signer.Signer{}
+	getBackend := func(name string) signer.Signer {
+		if _, ok := backends[name]; !ok {
+			backends[name] = getSigner(name)
+		}
+		return backends[name]
+	}
+	signers := map[string]signer.Signer{}
+	for _, name := range names {
+		if _, ok := signers[name]; ok {
+			continue
+		}
+		parts := strings.Split(name, ",")
+		if len(parts) == 1 {
+			signers[name] = getBackend(name)
+			continue
+		}
+		failover := []signer.FailoverBackend{}
+		for _, part := range parts {
+			failover = append(failover, signer.FailoverBackend{Name: part, Signer: getBackend(part)})
+		}
+		signers[name] = getFailoverSigner(failover)
+	}
+	return signer.NewRoutingSigner(signers, *backend)
+}
+
+// checkBackends ensures reloaded keys only use backends created at startup
+func checkBackends(keys []signer.Key, reloaded []signer.Key) error {
+	configured := map[string]bool{}
+	for _, name := range backendNames(keys) {
+		configured[name] = true
+	}
+	for _, key := range reloaded {
+		if len(key.Backend) > 0 && !configured[key.Backend] {
+			return fmt.Errorf("key %v uses backend %v, which requires a restart to add", key.Name, key.Backend)
+		}
+	}
+	return nil
+}
+
+func getFailoverSigner(backends []signer.FailoverBackend) signer.Signer {
+	failover, err := signer.NewFailoverSigner(backends, signer.FailoverConfig{
+		Threshold: *failoverThreshold,
+		Cooldown:  *failoverCooldown,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return failover
+}
+
+// getPKCS11Signers for --hsm-so, failing over to each --hsm-failover-so
+func getPKCS11Signers() signer.Signer {
+	if len(*hsmFailoverSO) == 0 {
+		return getPKCS11Signer()
+	}
+	backends := []signer.FailoverBackend{{Name: *hsmSO, Signer: getPKCS11Signer()}}
+	for _, libPath := range strings.Split(*hsmFailoverSO, ",") {
+		hsm := getPKCS11Signer()
+		hsm.LibPath = libPath
+		backends = append(backends, signer.FailoverBackend{Name: libPath, Signer: hsm})
+	}
+	return getFailoverSigner(backends)
+}
+
+// getSigner for a backend
+func getSigner(name string) signer.Signer {
+	switch name {
+	case signer.BackendPKCS11:
+		return getPKCS11Signers()
+	case signer.BackendGCPKMS:
+		client, err := cloudkms.NewKeyManagementClient(context.Background())
+		if err != nil {
+			log.Fatalln("Unable to create a Google Cloud KMS client:", err)
+		}
+		return signer.NewGoogleCloudKMSSigner(client)
+	case signer.BackendAWSKMS:
+		kmsSigner, err := signer.GetAWSKMSSigner()
+		if err != nil {
+			log.Fatalln("Unable to create an AWS KMS client:", err)
+		}
+		return kmsSigner
+	case signer.BackendVault:
+		return getVaultSigner()
+	case signer.BackendFile:
+		return getSecretKeySigner()
+	case signer.BackendProxy:
+		return getProxySigner()
+	}
+	log.Fatalf("Invalid backend %v\n", name)
+	return nil
+}
+
 func main() {
-	flag.Parse()
+	command, args := parseCommand(os.Args[1:])
+	flag.CommandLine.Parse(args)
+
+	// Process Config Flags
+	configErrors := loadConfig()
+	if command == "config validate" {
+		validateConfig(configErrors)
+		return
+	}
+	for _, err := range configErrors {
+		log.Println(err)
+	}
+	if len(configErrors) > 0 {
+		log.Fatal("Invalid config file")
+	}
 
 	// Process HSM flags
 	if len(*hsmPinFile) > 0 && len(*hsmPin) > 0 {
@@ -52,6 +341,11 @@ func main() {
 		hsmPin = getPinFromHsmFile(*hsmPinFile)
 	}
 
+	if len(command) > 0 {
+		runCommand(command)
+		return
+	}
+
 	// Process Watermark Flags
 	var wm watermark.Watermark
 	if *watermarkType == "ignore" {
@@ -66,30 +360,75 @@ func main() {
 		panic("Invalid --watermark-type provided")
 	}
 
-	// Process Operation Flags
-	opFilter := signer.OperationFilter{
-		EnableGeneric: *enableGeneric,
-		EnableTx:      *enableTx,
-		EnableVoting:  *enableVoting,
-	}
-	if len(*txDailyMax) > 0 {
-		opFilter.TxDailyMax, _ = new(big.Int).SetString(*txDailyMax, 10)
-		// Convert from XTZ to uXTZ
-		opFilter.TxDailyMax.Mul(opFilter.TxDailyMax, new(big.Int).SetInt64(1000000))
-	}
-	if len(*txWhitelistAddresses) > 0 {
-		opFilter.TxWhitelistAddresses = strings.Split(*txWhitelistAddresses, ",")
+	// Process Spending Flags
+	var ledger spending.Ledger
+	if *spendingType == "session" {
+		ledger = spending.GetSessionLedger()
+	} else if *spendingType == "file" {
+		ledger = spending.GetFileLedger(*spendingFile)
+	} else {
+		panic("Invalid --spending-type provided")
 	}
 
+	// Process Operation Flags
+	opFilter, err := getOperationFilter(flagValue)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if opFilter.EnableGeneric || opFilter.EnableTx {
 		log.Println("WARNING: Transaction signing is enabled.  Use with caution.")
 	}
 
-	keys := signer.LoadKeyFile(*keyfile)
-	pkcs11Signer := &signer.PKCS11Signer{
-		UserPin: *hsmPin,
-		LibPath: *hsmSO,
+	keys, err := loadKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	signingServer := signer.NewServer(getSigners(keys), keys, *bind, opFilter, wm, ledger)
+	signingServer.SetReload(func() ([]signer.Key, signer.OperationFilter, error) {
+		reloaded, err := loadKeys()
+		if err != nil {
+			return nil, signer.OperationFilter{}, err
+		}
+		if err = checkBackends(keys, reloaded); err != nil {
+			return nil, signer.OperationFilter{}, err
+		}
+		// Filter settings in --config apply on reload, other settings need a restart
+		value := flagValue
+		if len(*configFile) > 0 {
+			if value, err = reloadConfigFile(filterFlags); err != nil {
+				return nil, signer.OperationFilter{}, err
+			}
+		}
+		reloadedFilter, err := getOperationFilter(value)
+		if err == nil && (reloadedFilter.EnableGeneric || reloadedFilter.EnableTx) {
+			log.Println("WARNING: Transaction signing is enabled.  Use with caution.")
+		}
+		return reloaded, reloadedFilter, err
+	}, reloadFiles(), *keyfileWatch)
+	if len(*authorizedKeys) > 0 {
+		clients, err := signer.LoadAuthorizedKeyFile(*authorizedKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		signingServer.SetAuthorizedKeys(clients)
+	} else {
+		log.Println("WARNING: Authentication is disabled.  Any client that can reach the signer may request signatures.")
+	}
+	signingServer.SetSocketConfig(getSocketConfig())
+	if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+		err := signingServer.SetTLS(signer.TLSConfig{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if len(*tlsClientCA) > 0 {
+		log.Fatal("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+	if len(*metricsBind) > 0 {
+		signingServer.ServeMetrics(*metricsBind)
 	}
-	signingServer := signer.NewServer(pkcs11Signer, keys, *bind, opFilter, wm)
 	signingServer.Serve()
 }
@@ -0,0 +1,76 @@
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/blake2b"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Magic byte prepended by tezos-client to authentication requests
+// According to: https://gitlab.com/tezos/tezos/blob/master/src/lib_signer_services/signer_messages.ml
+const authMagicByte = 0x04
+
+// An AuthorizedKey identifies a client allowed to request signatures
+type AuthorizedKey struct {
+	Name          string `yaml:"Name"`
+	PublicKey     string `yaml:"PublicKey"`
+	publicKeyHash string
+}
+
+// LoadAuthorizedKeyFile loads the public keys of clients allowed to request
+// signatures from a file
+func LoadAuthorizedKeyFile(file string) ([]AuthorizedKey, error) {
+	keys := []AuthorizedKey{}
+
+	yamlFile, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %v: %v", file, err)
+	}
+	err = yaml.Unmarshal(yamlFile, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse yaml file %v: %v", file, err)
+	}
+	for i := range keys {
+		keys[i].publicKeyHash, err = publicKeyHash(keys[i].PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for authorized key %v: %v", keys[i].Name, err)
+		}
+	}
+	return keys, nil
+}
+
+// PublicKeyHash of this authorized key, as advertised by /authorized_keys
+func (key *AuthorizedKey) PublicKeyHash() string {
+	return key.publicKeyHash
+}
+
+// authenticate verifies that the b58 encoded authentication signature was made by
+// one of the authorized keys over the request for this signing key and data
+func authenticate(authorizedKeys []AuthorizedKey, key *Key, data []byte, authentication string) (*AuthorizedKey, error) {
+	if len(authentication) == 0 {
+		return nil, errors.New("missing authentication signature")
+	}
+	sig, err := decodeSignature(authentication)
+	if err != nil {
+		return nil, err
+	}
+	pkh, err := publicKeyHashBytes(key.PublicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients sign 0x04 || pkh || data
+	msg := append([]byte{authMagicByte}, pkh...)
+	msg = append(msg, data...)
+	digest := blake2b.Sum256(msg)
+
+	for i, authorizedKey := range authorizedKeys {
+		if verifySignature(authorizedKey.PublicKey, digest[:], sig) == nil {
+			return &authorizedKeys[i], nil
+		}
+	}
+	return nil, errors.New("invalid authentication signature")
+}
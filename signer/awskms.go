@@ -0,0 +1,54 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+type awsKMSSigner struct {
+	kms kmsiface.KMSAPI
+}
+
+// NewAWSKMSSigner creates a signer backed by AWS KMS
+func NewAWSKMSSigner(kmsClient kmsiface.KMSAPI) Signer {
+	return &awsKMSSigner{
+		kms: kmsClient,
+	}
+}
+
+// GetAWSKMSSigner creates a signer backed by AWS KMS in $AWS_DEFAULT_REGION
+func GetAWSKMSSigner() (Signer, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_DEFAULT_REGION")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewAWSKMSSigner(kms.New(sess)), nil
+}
+
+// Sign with the KMS key whose id, ARN or alias is the key's name.  The key must
+// be an ECC_SECG_P256K1 (tz2) or ECC_NIST_P256 (tz3) key.
+func (a *awsKMSSigner) Sign(ctx context.Context, message []byte, key *Key) ([]byte, error) {
+	if _, err := ecdsaCurve(key); err != nil {
+		return nil, fmt.Errorf("AWS KMS does not support the curve of %v", key.PublicKeyHash)
+	}
+
+	// The message is a Blake2b digest, which KMS signs as if it were SHA256
+	response, err := a.kms.SignWithContext(ctx, &kms.SignInput{
+		KeyId:            aws.String(key.Name),
+		Message:          message,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecEcdsaSha256),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("KMS sign request failed: %v", err)
+	}
+	return parseDERSignature(response.Signature, key)
+}
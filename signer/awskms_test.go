@@ -0,0 +1,72 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// fakeAWSKMS serves the KMS Sign API, signing with the test keys by key id
+type fakeAWSKMS struct {
+	requests []kms.SignInput
+}
+
+func (f *fakeAWSKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input kms.SignInput
+	if r.Header.Get("X-Amz-Target") != "TrentService.Sign" || json.NewDecoder(r.Body).Decode(&input) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, input)
+
+	der, err := signTestDigest(*input.KeyId, input.Message)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"NotFoundException","message":"key not found"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(kms.SignOutput{KeyId: input.KeyId, Signature: der, SigningAlgorithm: input.SigningAlgorithm})
+}
+
+func getTestAWSKMSSigner(t *testing.T, fake *fakeAWSKMS) (Signer, func()) {
+	server := httptest.NewServer(fake)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAWSKMSSigner(kms.New(sess)), server.Close
+}
+
+func TestAWSKMSSigner(t *testing.T) {
+	fake := &fakeAWSKMS{}
+	signer, stop := getTestAWSKMSSigner(t, fake)
+	defer stop()
+
+	testKMSSigner(t, signer)
+	if len(fake.requests) != 2 || *fake.requests[0].MessageType != kms.MessageTypeDigest || *fake.requests[0].SigningAlgorithm != kms.SigningAlgorithmSpecEcdsaSha256 {
+		log.Printf("Unexpected KMS requests %v\n", fake.requests)
+		t.Fail()
+	}
+
+	// KMS errors are returned
+	key := &Key{Name: "missing", PublicKeyHash: testP256Transfer.PublicKeyHash}
+	if _, err := signer.Sign(context.Background(), make([]byte, 32), key); err == nil {
+		log.Println("Expected an error signing with a missing key")
+		t.Fail()
+	}
+}
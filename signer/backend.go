@@ -0,0 +1,63 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backends keys may be held in
+const (
+	BackendPKCS11 = "pkcs11"
+	BackendGCPKMS = "gcpkms"
+	BackendAWSKMS = "awskms"
+	BackendVault  = "vault"
+	BackendFile   = "file"
+	BackendProxy  = "proxy"
+)
+
+// Backends lists every supported backend
+var Backends = []string{BackendPKCS11, BackendGCPKMS, BackendAWSKMS, BackendVault, BackendFile, BackendProxy}
+
+type routingSigner struct {
+	signers        map[string]Signer
+	defaultBackend string
+}
+
+// NewRoutingSigner creates a signer that signs with the backend named by each
+// key's Backend, or the default backend for keys that don't name one
+func NewRoutingSigner(signers map[string]Signer, defaultBackend string) Signer {
+	return &routingSigner{
+		signers:        signers,
+		defaultBackend: defaultBackend,
+	}
+}
+
+func (r *routingSigner) Sign(ctx context.Context, message []byte, key *Key) ([]byte, error) {
+	signer, err := r.route(key)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(ctx, message, key)
+}
+
+// SignOperation with the key's backend, passing the whole operation to backends
+// that are RawSigners
+func (r *routingSigner) SignOperation(ctx context.Context, operation []byte, key *Key) ([]byte, error) {
+	signer, err := r.route(key)
+	if err != nil {
+		return nil, err
+	}
+	return signPayload(ctx, signer, operation, key)
+}
+
+func (r *routingSigner) route(key *Key) (Signer, error) {
+	backend := key.Backend
+	if len(backend) == 0 {
+		backend = r.defaultBackend
+	}
+	signer, ok := r.signers[backend]
+	if !ok {
+		return nil, fmt.Errorf("backend %v of key %v is not configured", backend, key.Name)
+	}
+	return signer, nil
+}
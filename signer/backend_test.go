@@ -0,0 +1,25 @@
+package signer
+
+import (
+	"context"
+	"log"
+	"testing"
+)
+
+func TestRoutingSigner(t *testing.T) {
+	pkcs11 := &testSigner{SignedBytes: []byte{1}}
+	vault := &testSigner{SignedBytes: []byte{2}}
+	router := NewRoutingSigner(map[string]Signer{BackendPKCS11: pkcs11, BackendVault: vault}, BackendPKCS11)
+
+	for backend, expected := range map[string]byte{"": 1, BackendPKCS11: 1, BackendVault: 2} {
+		signed, err := router.Sign(context.Background(), []byte{}, &Key{Backend: backend})
+		if err != nil || signed[0] != expected {
+			log.Printf("Expected backend %q to sign with signer %v, got %v: %v\n", backend, expected, signed, err)
+			t.Fail()
+		}
+	}
+	if _, err := router.Sign(context.Background(), []byte{}, &Key{Backend: BackendAWSKMS}); err == nil {
+		log.Println("Expected an error signing with an unconfigured backend")
+		t.Fail()
+	}
+}
@@ -0,0 +1,207 @@
+package signer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// decoder reads the binary encoding of a forged tezos operation.
+// Field encodings are defined by lib_data_encoding:
+// https://gitlab.com/tezos/tezos/blob/master/src/lib_data_encoding/binary_reader.ml
+type decoder struct {
+	bytes  []byte
+	offset int
+}
+
+func newDecoder(bytes []byte) *decoder {
+	return &decoder{bytes: bytes}
+}
+
+// remaining number of unread bytes
+func (d *decoder) remaining() int {
+	return len(d.bytes) - d.offset
+}
+
+// peek at the next byte without consuming it
+func (d *decoder) peek() (byte, bool) {
+	if d.remaining() < 1 {
+		return 0, false
+	}
+	return d.bytes[d.offset], true
+}
+
+// fixed reads exactly n bytes
+func (d *decoder) fixed(n int) ([]byte, error) {
+	if n < 0 || d.remaining() < n {
+		return nil, fmt.Errorf("unexpected end of operation reading %v bytes at offset %v", n, d.offset)
+	}
+	b := d.bytes[d.offset : d.offset+n]
+	d.offset += n
+	return b, nil
+}
+
+func (d *decoder) uint8() (uint8, error) {
+	b, err := d.fixed(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.fixed(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *decoder) int32() (int32, error) {
+	b, err := d.fixed(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+// bool is encoded as 0x00 or 0xff
+func (d *decoder) bool() (bool, error) {
+	b, err := d.uint8()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0x00:
+		return false, nil
+	case 0xff:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid boolean byte %#x at offset %v", b, d.offset-1)
+}
+
+// variable reads bytes prefixed by their 4 byte length
+func (d *decoder) variable() ([]byte, error) {
+	length, err := d.fixed(4)
+	if err != nil {
+		return nil, err
+	}
+	return d.fixed(int(binary.BigEndian.Uint32(length)))
+}
+
+// natural reads an unsigned zarith number.  Each byte holds 7 bits of the number,
+// least significant first, with the high bit set if more bytes follow.
+func (d *decoder) natural() (*big.Int, error) {
+	result := new(big.Int)
+	for shift := uint(0); ; shift += 7 {
+		b, err := d.uint8()
+		if err != nil {
+			return nil, err
+		}
+		result.Or(result, new(big.Int).Lsh(big.NewInt(int64(b&0x7f)), shift))
+		if b&0x80 == 0 {
+			if b == 0 && shift > 0 {
+				return nil, errors.New("zarith number has a trailing zero byte")
+			}
+			return result, nil
+		}
+	}
+}
+
+// integer reads a signed zarith number.  The first byte holds a sign bit and 6 bits
+// of the number, following bytes are read as a natural.
+func (d *decoder) integer() (*big.Int, error) {
+	b, err := d.uint8()
+	if err != nil {
+		return nil, err
+	}
+	result := big.NewInt(int64(b & 0x3f))
+	if b&0x80 != 0 {
+		rest, err := d.natural()
+		if err != nil {
+			return nil, err
+		}
+		result.Or(result, rest.Lsh(rest, 6))
+	}
+	if b&0x40 != 0 {
+		result.Neg(result)
+	}
+	return result, nil
+}
+
+// b58 reads n bytes and b58 check encodes them with the hex prefix
+func (d *decoder) b58(prefixHex string, n int) (string, error) {
+	b, err := d.fixed(n)
+	if err != nil {
+		return "", err
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	return b58CheckEncode(prefix, b), nil
+}
+
+// publicKeyHash reads a tagged tz1, tz2, tz3 or tz4 address
+func (d *decoder) publicKeyHash() (string, error) {
+	tag, err := d.uint8()
+	if err != nil {
+		return "", err
+	}
+	switch tag {
+	case 0x00:
+		return d.b58(tzEd25519PublicKeyHash, 20)
+	case 0x01:
+		return d.b58(tzSecp256k1PublicKeyHash, 20)
+	case 0x02:
+		return d.b58(tzP256PublicKeyHash, 20)
+	case 0x03:
+		return d.b58(tzBLSPublicKeyHash, 20)
+	}
+	return "", fmt.Errorf("unknown public key hash tag %v", tag)
+}
+
+// publicKey reads a tagged edpk, sppk, p2pk or BLpk public key
+func (d *decoder) publicKey() (string, error) {
+	tag, err := d.uint8()
+	if err != nil {
+		return "", err
+	}
+	switch tag {
+	case 0x00:
+		return d.b58(tzEd25519PublicKey, 32)
+	case 0x01:
+		return d.b58(tzSecp256k1PublicKey, 33)
+	case 0x02:
+		return d.b58(tzP256PublicKey, 33)
+	case 0x03:
+		return d.b58(tzBLSPublicKey, 48)
+	}
+	return "", fmt.Errorf("unknown public key tag %v", tag)
+}
+
+// contract reads an implicit (tz) or originated (KT1) contract address
+func (d *decoder) contract() (string, error) {
+	tag, err := d.uint8()
+	if err != nil {
+		return "", err
+	}
+	switch tag {
+	case 0x00:
+		return d.publicKeyHash()
+	case 0x01:
+		return d.originatedContract()
+	}
+	return "", fmt.Errorf("unknown contract tag %v", tag)
+}
+
+// originatedContract reads a KT1 address and its padding byte
+func (d *decoder) originatedContract() (string, error) {
+	address, err := d.b58(tzContractHash, 20)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.fixed(1); err != nil {
+		return "", err
+	}
+	return address, nil
+}
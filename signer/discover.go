@@ -0,0 +1,248 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/miekg/pkcs11"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DER encoded CKA_EC_PARAMS of the curves tezos supports
+var (
+	ecParamsEd25519   = []byte{0x06, 0x03, 0x2b, 0x65, 0x70}
+	ecParamsSecp256k1 = []byte{0x06, 0x05, 0x2b, 0x81, 0x04, 0x00, 0x0a}
+	ecParamsP256      = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	// Some HSMs name the Edwards curve rather than using its OID
+	ecParamsEdwards25519 = append([]byte{0x13, 0x0c}, []byte("edwards25519")...)
+)
+
+// keyObject is a key found on a token
+type keyObject struct {
+	label string
+	id    []byte
+}
+
+// Discover the keys on every usable slot of the HSM that tezos can sign with.  Each
+// private key is matched to its public key by CKA_ID, or by label if it has no
+// id, and the public key is read from CKA_EC_POINT.
+func (hsm *PKCS11Signer) Discover(ctx context.Context) ([]Key, error) {
+	hsm.mux.Lock()
+	err := hsm.initialize()
+	var slots []uint
+	if err == nil {
+		slots, err = hsm.ctx.GetSlotList(true)
+	}
+	hsm.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip slots we can't use, such as tokens that haven't been initialized
+	keys := []Key{}
+	for _, slot := range slots {
+		slotKeys, err := hsm.discoverSlot(ctx, slot)
+		if err != nil {
+			log.Printf("Skipping slot %v: %v\n", slot, err)
+			continue
+		}
+		keys = append(keys, slotKeys...)
+	}
+	return keys, nil
+}
+
+// discoverSlot returns the keys of a single slot
+func (hsm *PKCS11Signer) discoverSlot(ctx context.Context, slot uint) ([]Key, error) {
+	pool, err := hsm.getPool(slot)
+	if err != nil {
+		return nil, err
+	}
+	session, err := hsm.acquire(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	defer hsm.release(pool, session, true)
+
+	privateKeys, err := hsm.findObjects(session, pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY))
+	if err != nil {
+		return nil, err
+	}
+	publicKeys, err := hsm.findObjects(session, pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY))
+	if err != nil {
+		return nil, err
+	}
+
+	publicObjects := make([]*keyObject, len(publicKeys))
+	for i, public := range publicKeys {
+		if publicObjects[i], err = hsm.getKeyObject(session, public); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := []Key{}
+	for _, private := range privateKeys {
+		privateKey, err := hsm.getKeyObject(session, private)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := "", errors.New("no matching public key")
+		for i, public := range publicObjects {
+			if privateKey.matches(public) {
+				publicKey, err = hsm.getPublicKey(session, publicKeys[i])
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Skipping key %q on slot %v: %v\n", privateKey.label, slot, err)
+			continue
+		}
+
+		pkh, err := publicKeyHash(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		name := privateKey.label
+		if len(name) == 0 {
+			name = pkh
+		}
+		keys = append(keys, Key{
+			Name:          name,
+			PublicKeyHash: pkh,
+			PublicKey:     publicKey,
+			HsmSlot:       slot,
+			HsmLabel:      privateKey.label,
+		})
+	}
+	return keys, nil
+}
+
+// matches a private key to its public key
+func (object *keyObject) matches(other *keyObject) bool {
+	if len(object.id) > 0 {
+		return bytes.Equal(object.id, other.id)
+	}
+	return object.label == other.label
+}
+
+// findObjects returns every object matching the template
+func (hsm *PKCS11Signer) findObjects(session pkcs11.SessionHandle, template ...*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	err := hsm.ctx.FindObjectsInit(session, template)
+	if err != nil {
+		return nil, err
+	}
+	defer hsm.ctx.FindObjectsFinal(session)
+
+	objects := []pkcs11.ObjectHandle{}
+	for {
+		found, _, err := hsm.ctx.FindObjects(session, 100)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return objects, nil
+		}
+		objects = append(objects, found...)
+	}
+}
+
+// getKeyObject reads the label and id of a key
+func (hsm *PKCS11Signer) getKeyObject(session pkcs11.SessionHandle, object pkcs11.ObjectHandle) (*keyObject, error) {
+	attributes, err := hsm.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	key := &keyObject{}
+	for _, attribute := range attributes {
+		switch attribute.Type {
+		case pkcs11.CKA_LABEL:
+			key.label = string(attribute.Value)
+		case pkcs11.CKA_ID:
+			key.id = attribute.Value
+		}
+	}
+	return key, nil
+}
+
+// getPublicKey reads the curve and point of a public key and encodes it as an
+// edpk, sppk or p2pk
+func (hsm *PKCS11Signer) getPublicKey(session pkcs11.SessionHandle, object pkcs11.ObjectHandle) (string, error) {
+	attributes, err := hsm.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return "", fmt.Errorf("not an elliptic curve key: %v", err)
+	}
+	var params, point []byte
+	for _, attribute := range attributes {
+		switch attribute.Type {
+		case pkcs11.CKA_EC_PARAMS:
+			params = attribute.Value
+		case pkcs11.CKA_EC_POINT:
+			point = attribute.Value
+		}
+	}
+	return encodeECPoint(params, point)
+}
+
+// encodeECPoint encodes a CKA_EC_POINT as a tezos public key.  The point is
+// usually a DER octet string, but some HSMs return it raw.
+func encodeECPoint(params []byte, point []byte) (string, error) {
+	var prefixHex string
+	var raw []byte
+	switch {
+	case bytes.Equal(params, ecParamsEd25519) || bytes.Equal(params, ecParamsEdwards25519):
+		prefixHex = tzEd25519PublicKey
+		raw = unwrapECPoint(point, 32)
+		if len(raw) != 32 {
+			return "", fmt.Errorf("invalid ed25519 point %v", hex.EncodeToString(point))
+		}
+	case bytes.Equal(params, ecParamsSecp256k1):
+		prefixHex = tzSecp256k1PublicKey
+		pub, err := btcec.ParsePubKey(unwrapECPoint(point, 65), btcec.S256())
+		if err != nil {
+			return "", fmt.Errorf("invalid secp256k1 point %v: %v", hex.EncodeToString(point), err)
+		}
+		raw = pub.SerializeCompressed()
+	case bytes.Equal(params, ecParamsP256):
+		prefixHex = tzP256PublicKey
+		raw = unwrapECPoint(point, 65)
+		if len(raw) != 65 || raw[0] != 0x04 {
+			return "", fmt.Errorf("invalid p256 point %v", hex.EncodeToString(point))
+		}
+		x, y := new(big.Int).SetBytes(raw[1:33]), new(big.Int).SetBytes(raw[33:])
+		raw = append([]byte{0x02 + byte(y.Bit(0))}, leftPad(x.Bytes(), 32)...)
+	default:
+		return "", fmt.Errorf("unsupported curve %v", hex.EncodeToString(params))
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	return b58CheckEncode(prefix, raw), nil
+}
+
+// unwrapECPoint returns the contents of a DER octet string, or the point as is
+// if it is already the raw length
+func unwrapECPoint(point []byte, length int) []byte {
+	if len(point) == length {
+		return point
+	}
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) > 0 {
+		return point
+	}
+	return raw
+}
+
+// MarshalKeys in the key file format
+func MarshalKeys(keys []Key) ([]byte, error) {
+	return yaml.Marshal(keys)
+}
@@ -0,0 +1,82 @@
+package signer
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"log"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ed25519"
+)
+
+func getTestKeyObject(class uint, label string, id []byte, attributes ...*pkcs11.Attribute) []*pkcs11.Attribute {
+	return append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}, attributes...)
+}
+
+func TestDiscover(t *testing.T) {
+	edPrivateKey, edClient := getTestAuthorizedKey(1)
+	secp256k1Point, _ := asn1.Marshal(testSecp256k1PrivateKey.PubKey().SerializeUncompressed())
+	p256Point := elliptic.Marshal(elliptic.P256(), testP256PrivateKey.X, testP256PrivateKey.Y)
+	ed25519Point, _ := asn1.Marshal([]byte(edPrivateKey.Public().(ed25519.PublicKey)))
+
+	fake := newFakePKCS11()
+	fake.objects = map[pkcs11.ObjectHandle][]*pkcs11.Attribute{
+		// Matched by id, with a DER encoded point
+		1: getTestKeyObject(pkcs11.CKO_PRIVATE_KEY, "baker", []byte{1}),
+		2: getTestKeyObject(pkcs11.CKO_PUBLIC_KEY, "baker-public", []byte{1},
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParamsSecp256k1),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, secp256k1Point)),
+		// Matched by label, with a raw point
+		3: getTestKeyObject(pkcs11.CKO_PRIVATE_KEY, "payouts", nil),
+		4: getTestKeyObject(pkcs11.CKO_PUBLIC_KEY, "payouts", nil,
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParamsP256),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, p256Point)),
+		5: getTestKeyObject(pkcs11.CKO_PRIVATE_KEY, "consensus", []byte{5}),
+		6: getTestKeyObject(pkcs11.CKO_PUBLIC_KEY, "consensus", []byte{5},
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParamsEd25519),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ed25519Point)),
+		// Keys that aren't on a tezos curve or have no public key are skipped
+		7: getTestKeyObject(pkcs11.CKO_PRIVATE_KEY, "rsa", []byte{7}),
+		8: getTestKeyObject(pkcs11.CKO_PUBLIC_KEY, "rsa", []byte{7}),
+		9: getTestKeyObject(pkcs11.CKO_PRIVATE_KEY, "orphan", []byte{9}),
+	}
+	hsm := getTestPKCS11Signer(fake)
+
+	keys, err := hsm.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake has the same objects on both of its slots
+	if len(keys) != 6 || keys[0].HsmSlot != 1 || keys[3].HsmSlot != 2 {
+		log.Printf("Expected three keys on each slot, got %v\n", keys)
+		t.FailNow()
+	}
+	for i, expected := range []Key{
+		{Name: "baker", PublicKey: testSecp256k1Transfer.PublicKey, PublicKeyHash: testSecp256k1Transfer.PublicKeyHash, HsmLabel: "baker"},
+		{Name: "payouts", PublicKey: testP256Transfer.PublicKey, PublicKeyHash: testP256Transfer.PublicKeyHash, HsmLabel: "payouts"},
+		{Name: "consensus", PublicKey: edClient.PublicKey, PublicKeyHash: edClient.PublicKeyHash(), HsmLabel: "consensus"},
+	} {
+		key := keys[i]
+		if key.Name != expected.Name || key.PublicKey != expected.PublicKey || key.PublicKeyHash != expected.PublicKeyHash || key.HsmLabel != expected.HsmLabel {
+			log.Printf("Expected %v, got %v\n", expected, key)
+			t.Fail()
+		}
+	}
+
+	// Discovered keys load as a key file
+	contents, err := MarshalKeys(keys[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadTestKeyFile(t, string(contents))
+	if err != nil || len(loaded) != 3 || loaded[2].HsmSlot != 1 {
+		log.Printf("Unable to load discovered keys %v: %v\n", string(contents), err)
+		t.Fail()
+	}
+}
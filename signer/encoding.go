@@ -1,12 +1,15 @@
 package signer
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/blake2b"
 )
 
 // Tezos Constants from:
@@ -16,14 +19,18 @@ const (
 	tzEd25519PublicKeyHash   = "06a19f" // tz1
 	tzSecp256k1PublicKeyHash = "06a1a1" // tz2
 	tzP256PublicKeyHash      = "06a1a4" // tz3
+	tzBLSPublicKeyHash       = "06a1a6" // tz4
+	tzContractHash           = "025a79" // KT1
 
 	/* Public Keys */
 	tzEd25519PublicKey   = "0d0f25d9" // edpk
 	tzSecp256k1PublicKey = "03fee256" // sppk
 	tzP256PublicKey      = "03b28b7f" // p2pk
+	tzBLSPublicKey       = "069587cc" // BLpk
 
 	/* Secret Keys */
-	tzEd25519Seed        = "0d0f3a07" // edsk
+	tzEd25519Seed        = "0d0f3a07" // edsk (len: 54)
+	tzEd25519SecretKey   = "2bf64e07" // edsk (len: 98)
 	tzSecp256k1SecretKey = "11a2e0c9" // spsk
 	tzP256SecretKey      = "1051eebd" // p2sk
 
@@ -40,6 +47,10 @@ const (
 
 	/* Chain ID */
 	tzChainID = "575200" // Net(15)
+
+	/* Hashes */
+	tzBlockHash    = "0134" // B(51)
+	tzProtocolHash = "02aa" // P(51)
 )
 
 // getSignaturePrefix for a given key to produce the correct
@@ -86,6 +97,129 @@ func b58CheckEncode(prefix []byte, bytes []byte) string {
 	return encoded
 }
 
+// b58CheckDecode validates the checksum of a b58 check encoded string and
+// returns its payload with the expected prefix stripped
+func b58CheckDecode(prefix []byte, encoded string) ([]byte, error) {
+	decoded := base58.Decode(encoded)
+	if len(decoded) < len(prefix)+4 {
+		return nil, errors.New("b58 check encoded string is too short")
+	}
+	message := decoded[:len(decoded)-4]
+	h := sha256.Sum256(message)
+	h2 := sha256.Sum256(h[:])
+	if !bytes.Equal(h2[:4], decoded[len(decoded)-4:]) {
+		return nil, errors.New("invalid b58 checksum")
+	}
+	if !bytes.HasPrefix(message, prefix) {
+		return nil, errors.New("unexpected b58 prefix")
+	}
+	return message[len(prefix):], nil
+}
+
+// decodePublicKey returns the curve and raw bytes of an edpk, sppk or p2pk
+// encoded public key
+func decodePublicKey(publicKey string) (int, []byte, error) {
+	var curve int
+	var prefixHex string
+	var length int
+	switch {
+	case strings.HasPrefix(publicKey, "edpk"):
+		curve, prefixHex, length = curveEd25519, tzEd25519PublicKey, 32
+	case strings.HasPrefix(publicKey, "sppk"):
+		curve, prefixHex, length = curveSecp256k1, tzSecp256k1PublicKey, 33
+	case strings.HasPrefix(publicKey, "p2pk"):
+		curve, prefixHex, length = curveNistP256, tzP256PublicKey, 33
+	default:
+		return curveUnknown, nil, fmt.Errorf("unknown public key type: %v", publicKey)
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	raw, err := b58CheckDecode(prefix, publicKey)
+	if err != nil {
+		return curveUnknown, nil, err
+	}
+	if len(raw) != length {
+		return curveUnknown, nil, fmt.Errorf("public key is %v bytes, expected %v", len(raw), length)
+	}
+	return curve, raw, nil
+}
+
+// publicKeyHash derives the tz1, tz2 or tz3 address of an encoded public key
+func publicKeyHash(publicKey string) (string, error) {
+	curve, raw, err := decodePublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	hash, err := blake2b.New(20, nil)
+	if err != nil {
+		return "", err
+	}
+	hash.Write(raw)
+
+	var prefix []byte
+	switch curve {
+	case curveEd25519:
+		prefix, _ = hex.DecodeString(tzEd25519PublicKeyHash)
+	case curveSecp256k1:
+		prefix, _ = hex.DecodeString(tzSecp256k1PublicKeyHash)
+	case curveNistP256:
+		prefix, _ = hex.DecodeString(tzP256PublicKeyHash)
+	}
+	return b58CheckEncode(prefix, hash.Sum(nil)), nil
+}
+
+// publicKeyHashBytes returns the binary encoding of a tz1, tz2 or tz3 address:
+// a one byte curve tag followed by the 20 byte hash
+func publicKeyHashBytes(pkh string) ([]byte, error) {
+	var tag byte
+	var prefixHex string
+	switch {
+	case strings.HasPrefix(pkh, "tz1"):
+		tag, prefixHex = 0x00, tzEd25519PublicKeyHash
+	case strings.HasPrefix(pkh, "tz2"):
+		tag, prefixHex = 0x01, tzSecp256k1PublicKeyHash
+	case strings.HasPrefix(pkh, "tz3"):
+		tag, prefixHex = 0x02, tzP256PublicKeyHash
+	default:
+		return nil, fmt.Errorf("unknown public key hash type: %v", pkh)
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	hash, err := b58CheckDecode(prefix, pkh)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != 20 {
+		return nil, fmt.Errorf("public key hash is %v bytes, expected 20", len(hash))
+	}
+	return append([]byte{tag}, hash...), nil
+}
+
+// decodeSignature returns the raw 64 signature bytes of an edsig, spsig1,
+// p2sig or generic sig encoded signature
+func decodeSignature(sig string) ([]byte, error) {
+	var prefixHex string
+	switch {
+	case strings.HasPrefix(sig, "edsig"):
+		prefixHex = tzEd25519Signature
+	case strings.HasPrefix(sig, "spsig1"):
+		prefixHex = tzSecp256k1Signature
+	case strings.HasPrefix(sig, "p2sig"):
+		prefixHex = tzP256Signature
+	case strings.HasPrefix(sig, "sig"):
+		prefixHex = tzGenericSignature
+	default:
+		return nil, fmt.Errorf("unknown signature type: %v", sig)
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	raw, err := b58CheckDecode(prefix, sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 64 {
+		return nil, fmt.Errorf("signature is %v bytes, expected 64", len(raw))
+	}
+	return raw, nil
+}
+
 // PubkeyHashToByteString strips the prefix and checksum bytes,
 // returning only the pubkeyhash bytes
 func PubkeyHashToByteString(pubkeyhash string) string {
@@ -0,0 +1,153 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailoverBackend is one of the backends of a failover signer
+type FailoverBackend struct {
+	Name   string
+	Signer Signer
+}
+
+// FailoverConfig configures the circuit breaker of each failover backend
+type FailoverConfig struct {
+	// Consecutive failures after which a backend is skipped.  Defaults to 3
+	Threshold int
+	// Time a failed backend is skipped for before it is tried again.  Defaults
+	// to 30 seconds
+	Cooldown time.Duration
+}
+
+// breaker tracks the health of a backend.  A backend is skipped once it fails
+// Threshold times in a row, until Cooldown has passed.  It is then tried again,
+// and the breaker closes on success or reopens on the next failure.
+type breaker struct {
+	name      string
+	signer    Signer
+	mux       sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+type failoverSigner struct {
+	backends []*breaker
+	config   FailoverConfig
+	now      func() time.Time
+}
+
+var _ RawSigner = &failoverSigner{}
+
+// NewFailoverSigner creates a signer that signs with the first healthy backend,
+// in order, and fails over to the next when a backend returns an error.  Every
+// backend must hold the same keys.
+func NewFailoverSigner(backends []FailoverBackend, config FailoverConfig) (RawSigner, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = 3
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = 30 * time.Second
+	}
+	signer := &failoverSigner{config: config, now: time.Now}
+	for _, backend := range backends {
+		signer.backends = append(signer.backends, &breaker{name: backend.Name, signer: backend.Signer})
+		backendHealthy.WithLabelValues(backend.Name).Set(1)
+	}
+	return signer, nil
+}
+
+// Sign the digest with the first healthy backend
+func (f *failoverSigner) Sign(ctx context.Context, message []byte, key *Key) ([]byte, error) {
+	return f.sign(ctx, key, func(signer Signer) ([]byte, error) {
+		return signer.Sign(ctx, message, key)
+	})
+}
+
+// SignOperation with the first healthy backend, passing the whole operation to
+// backends that are RawSigners
+func (f *failoverSigner) SignOperation(ctx context.Context, operation []byte, key *Key) ([]byte, error) {
+	return f.sign(ctx, key, func(signer Signer) ([]byte, error) {
+		return signPayload(ctx, signer, operation, key)
+	})
+}
+
+func (f *failoverSigner) sign(ctx context.Context, key *Key, sign func(Signer) ([]byte, error)) ([]byte, error) {
+	// Try healthy backends first, then unhealthy ones rather than failing outright
+	now := f.now()
+	healthy, unhealthy := []*breaker{}, []*breaker{}
+	for _, backend := range f.backends {
+		if backend.allow(now) {
+			healthy = append(healthy, backend)
+		} else {
+			unhealthy = append(unhealthy, backend)
+		}
+	}
+
+	errs := []string{}
+	for i, backend := range append(healthy, unhealthy...) {
+		signed, err := sign(backend.signer)
+		if err == nil {
+			backend.succeed()
+			backendSignRequests.WithLabelValues(key.PublicKeyHash, backend.name, resultSigned).Inc()
+			if i > 0 {
+				log.Printf("Signed for %v with backend %v after failing over\n", key.PublicKeyHash, backend.name)
+			} else {
+				debugf("Signed for %v with backend %v\n", key.PublicKeyHash, backend.name)
+			}
+			return signed, nil
+		}
+		// Requests cancelled by the client say nothing about the backend
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		backendSignRequests.WithLabelValues(key.PublicKeyHash, backend.name, resultError).Inc()
+		if backend.fail(f.now(), f.config) {
+			log.Printf("Backend %v is unhealthy, skipping it for %v: %v\n", backend.name, f.config.Cooldown, err)
+		} else {
+			log.Printf("Backend %v failed to sign for %v: %v\n", backend.name, key.PublicKeyHash, err)
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", backend.name, err))
+	}
+	return nil, fmt.Errorf("every backend failed to sign: %v", strings.Join(errs, "; "))
+}
+
+// allow requests through if the breaker is closed or its cooldown has passed
+func (b *breaker) allow(now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return !now.Before(b.openUntil)
+}
+
+// succeed closes the breaker
+func (b *breaker) succeed() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if !b.openUntil.IsZero() {
+		log.Printf("Backend %v is healthy again\n", b.name)
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+	backendHealthy.WithLabelValues(b.name).Set(1)
+}
+
+// fail counts a failure, returning true if it opened the breaker
+func (b *breaker) fail(now time.Time, config FailoverConfig) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.failures++
+	if b.failures < config.Threshold {
+		return false
+	}
+	b.openUntil = now.Add(config.Cooldown)
+	backendHealthy.WithLabelValues(b.name).Set(0)
+	return true
+}
@@ -0,0 +1,132 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakySigner counts its calls and fails while err is set
+type flakySigner struct {
+	calls int
+	err   error
+}
+
+func (signer *flakySigner) Sign(_ context.Context, message []byte, key *Key) ([]byte, error) {
+	signer.calls++
+	if signer.err != nil {
+		return nil, signer.err
+	}
+	return []byte{1}, nil
+}
+
+func getTestFailoverSigner(primary Signer, secondary Signer) *failoverSigner {
+	signer, _ := NewFailoverSigner([]FailoverBackend{
+		{Name: "primary", Signer: primary},
+		{Name: "secondary", Signer: secondary},
+	}, FailoverConfig{Threshold: 2, Cooldown: time.Minute})
+	return signer.(*failoverSigner)
+}
+
+func TestFailoverSigner(t *testing.T) {
+	primary, secondary := &flakySigner{}, &flakySigner{}
+	failover := getTestFailoverSigner(primary, secondary)
+	clock := time.Unix(0, 0)
+	failover.now = func() time.Time { return clock }
+	key := &Key{PublicKeyHash: "tz1failover"}
+	sign := func(name string, expectedPrimary int, expectedSecondary int) {
+		primary.calls, secondary.calls = 0, 0
+		if _, err := failover.Sign(context.Background(), []byte{}, key); err != nil {
+			log.Printf("%v: Unable to sign: %v\n", name, err)
+			t.Fail()
+		}
+		if primary.calls != expectedPrimary || secondary.calls != expectedSecondary {
+			log.Printf("%v: Expected %v primary and %v secondary calls, got %v and %v\n", name, expectedPrimary, expectedSecondary, primary.calls, secondary.calls)
+			t.Fail()
+		}
+	}
+	healthy := backendHealthy.WithLabelValues("primary")
+
+	sign("Healthy", 1, 0)
+
+	// Failures fail over to the secondary until the breaker opens
+	primary.err = errors.New("CKR_DEVICE_ERROR")
+	sign("First Failure", 1, 1)
+	sign("Second Failure", 1, 1)
+	if testutil.ToFloat64(healthy) != 0 {
+		log.Println("Expected the primary to be reported unhealthy")
+		t.Fail()
+	}
+	sign("Open", 0, 1)
+	signed := testutil.ToFloat64(backendSignRequests.WithLabelValues(key.PublicKeyHash, "secondary", resultSigned))
+	if signed != 3 {
+		log.Printf("Expected 3 requests signed by the secondary, got %v\n", signed)
+		t.Fail()
+	}
+
+	// After the cooldown the primary is tried again, and reopens if it still fails
+	clock = clock.Add(time.Minute)
+	sign("Still Failing", 1, 1)
+	sign("Reopened", 0, 1)
+
+	// And is used again once it recovers
+	clock = clock.Add(time.Minute)
+	primary.err = nil
+	sign("Recovered", 1, 0)
+	sign("Closed", 1, 0)
+	if testutil.ToFloat64(healthy) != 1 {
+		log.Println("Expected the primary to be reported healthy")
+		t.Fail()
+	}
+}
+
+func TestFailoverSignerUnhealthy(t *testing.T) {
+	primary := &flakySigner{err: errors.New("primary down")}
+	secondary := &flakySigner{err: errors.New("secondary down")}
+	failover := getTestFailoverSigner(primary, secondary)
+	key := &Key{PublicKeyHash: "tz1unhealthy"}
+
+	for i := 0; i < 3; i++ {
+		if _, err := failover.Sign(context.Background(), []byte{}, key); err == nil {
+			log.Println("Expected an error when every backend fails")
+			t.Fail()
+		}
+	}
+
+	// Unhealthy backends are still tried when no backend is healthy
+	secondary.err = nil
+	if _, err := failover.Sign(context.Background(), []byte{}, key); err != nil || primary.calls != 4 || secondary.calls != 4 {
+		log.Printf("Expected both backends to be tried, got %v and %v calls: %v\n", primary.calls, secondary.calls, err)
+		t.Fail()
+	}
+
+	// Cancelled requests don't count against a backend
+	primary.err, secondary.err = errors.New("cancelled"), errors.New("cancelled")
+	failover = getTestFailoverSigner(primary, secondary)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		failover.Sign(ctx, []byte{}, key)
+	}
+	if !failover.backends[0].allow(time.Now()) || secondary.calls != 4 {
+		log.Println("Expected cancelled requests not to fail over or open the breaker")
+		t.Fail()
+	}
+}
+
+func TestFailoverSignerOperations(t *testing.T) {
+	// Operations fail over to backends holding real keys
+	keySigner, _ := NewSecretKeySigner(getTestUnencryptedSecretKeys())
+	failover := getTestFailoverSigner(&flakySigner{err: errors.New("down")}, keySigner)
+	op, _ := ParseOperation([]byte(testSecp256k1Transfer.Operation))
+	key := &Key{PublicKeyHash: testSecp256k1Transfer.PublicKeyHash, PublicKey: testSecp256k1Transfer.PublicKey}
+	signed, err := op.TzSign(context.Background(), failover, key)
+	if err != nil || "{\"signature\":\""+signed+"\"}" != testSecp256k1Transfer.SignerResponse {
+		log.Printf("Expected the secondary to sign, got %v: %v\n", signed, err)
+		t.Fail()
+	}
+}
@@ -1,13 +1,17 @@
 package signer
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"time"
+
+	"github.com/gracenoah/tezos-hsm-signer/signer/spending"
 )
 
-// OperationFilter controls what operations will be signed
+// OperationFilter controls what operations will be signed.  A filter can be set
+// globally from flags or per key with a Policy section in the key file.
 type OperationFilter struct {
 	EnableGeneric        bool
 	EnableTx             bool
@@ -15,43 +19,179 @@ type OperationFilter struct {
 	TxWhitelistAddresses []string
 	TxDailyMax           *big.Int
 
-	// Keep track of daily max withdrawals
-	dailyTxMaxKey     string
-	dailyTxMaxCounter *big.Int
+	// Only sign operations with these magic bytes, if set
+	AllowedMagicBytes []uint8
+	// Allow generic operation contents of these kinds, e.g. "transaction" or "delegation"
+	AllowedKinds []string
+	// Only sign blocks and consensus operations on these chains, if set
+	AllowedChainIDs []string
+	// Maximum mutez value of a single transaction, if set
+	TxMaxAmount *big.Int
+	// Limits on the mutez spent over rolling windows, in addition to TxDailyMax
+	SpendLimits []spending.Limit
+}
+
+// filterYAML is the key file representation of an OperationFilter with amounts in XTZ
+type filterYAML struct {
+	EnableGeneric       bool             `yaml:"EnableGeneric"`
+	EnableTx            bool             `yaml:"EnableTx"`
+	EnableVoting        bool             `yaml:"EnableVoting"`
+	AllowedMagicBytes   []uint8          `yaml:"AllowedMagicBytes"`
+	AllowedKinds        []string         `yaml:"AllowedKinds"`
+	AllowedChainIDs     []string         `yaml:"AllowedChainIDs"`
+	AllowedDestinations []string         `yaml:"AllowedDestinations"`
+	TxMaxAmount         string           `yaml:"TxMaxAmount"`
+	TxDailyMax          string           `yaml:"TxDailyMax"`
+	SpendLimits         []spendLimitYAML `yaml:"SpendLimits"`
+}
+
+// spendLimitYAML is a rolling window limit such as {Window: 7d, Max: 1000}
+type spendLimitYAML struct {
+	Window      string `yaml:"Window"`
+	Max         string `yaml:"Max"`
+	Destination string `yaml:"Destination"`
+}
+
+// UnmarshalYAML reads a Policy section from the key file
+func (filter *OperationFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policy filterYAML
+	if err := unmarshal(&policy); err != nil {
+		return err
+	}
+	for _, kind := range policy.AllowedKinds {
+		if !isKnownKind(kind) {
+			return fmt.Errorf("unknown operation kind in policy: %v", kind)
+		}
+	}
+
+	*filter = OperationFilter{
+		EnableGeneric:        policy.EnableGeneric,
+		EnableTx:             policy.EnableTx,
+		EnableVoting:         policy.EnableVoting,
+		TxWhitelistAddresses: policy.AllowedDestinations,
+		AllowedMagicBytes:    policy.AllowedMagicBytes,
+		AllowedKinds:         policy.AllowedKinds,
+		AllowedChainIDs:      policy.AllowedChainIDs,
+	}
+	var err error
+	if len(policy.TxMaxAmount) > 0 {
+		if filter.TxMaxAmount, err = ParseTez(policy.TxMaxAmount); err != nil {
+			return fmt.Errorf("invalid TxMaxAmount: %v", err)
+		}
+	}
+	if len(policy.TxDailyMax) > 0 {
+		if filter.TxDailyMax, err = ParseTez(policy.TxDailyMax); err != nil {
+			return fmt.Errorf("invalid TxDailyMax: %v", err)
+		}
+	}
+	for _, limit := range policy.SpendLimits {
+		window, err := spending.ParseWindow(limit.Window)
+		if err != nil {
+			return fmt.Errorf("invalid spend limit window: %v", err)
+		}
+		max, err := ParseTez(limit.Max)
+		if err != nil {
+			return fmt.Errorf("invalid spend limit max: %v", err)
+		}
+		filter.SpendLimits = append(filter.SpendLimits, spending.Limit{
+			Window:      window,
+			Max:         max,
+			Destination: limit.Destination,
+		})
+	}
+	return nil
+}
+
+// ParseTez parses a decimal amount of XTZ, such as "1.5", into mutez
+func ParseTez(amount string) (*big.Int, error) {
+	tez, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a number", amount)
+	}
+	mutez := tez.Mul(tez, new(big.Rat).SetInt64(1000000))
+	if !mutez.IsInt() || mutez.Sign() < 0 {
+		return nil, errors.New("amounts must be positive with at most 6 decimals")
+	}
+	return new(big.Int).Set(mutez.Num()), nil
+}
+
+// isKnownKind returns true if this is the name of a generic operation kind
+func isKnownKind(name string) bool {
+	for _, kindName := range opKindNames {
+		if kindName == name {
+			return true
+		}
+	}
+	return false
 }
 
 // IsAllowed by this filter?
 func (filter *OperationFilter) IsAllowed(op *Operation) bool {
+	if len(filter.AllowedMagicBytes) > 0 && !containsMagicByte(filter.AllowedMagicBytes, op.MagicByte()) {
+		log.Printf("[WARN] Magic byte %#x is not allowed\n", op.MagicByte())
+		return false
+	}
+
 	switch op.MagicByte() {
-	case opMagicByteBlock, opMagicByteEndorsement:
+	case opMagicByteBlock, opMagicByteEndorsement,
+		opMagicByteTenderbakeBlock, opMagicBytePreattestation, opMagicByteAttestation:
+		if len(filter.AllowedChainIDs) > 0 && !containsString(filter.AllowedChainIDs, op.ChainID()) {
+			log.Println("[WARN] Chain is not allowed:", op.ChainID())
+			return false
+		}
 		return true
 	case opMagicByteGeneric:
-		generic := GetGenericOperation(op)
-		if filter.EnableGeneric {
+		if filter.EnableGeneric && filter.TxMaxAmount == nil && filter.TxWhitelistAddresses == nil {
 			return true
 		}
-		if filter.EnableTx && generic.Kind() == opKindTransaction {
-			return filter.isWhitelisted(generic) && filter.authorizeTxAmount(generic.TransactionValue())
+		generic, err := GetGenericOperation(op)
+		if err != nil {
+			log.Println("[WARN] Unable to decode generic operation:", err)
+			return false
 		}
-		if filter.EnableVoting && (generic.Kind() == opKindBallot) {
-			return true
-		}
-		if filter.EnableVoting && (generic.Kind() == opKindProposals) {
-			return true
+		// Every content in the batch must be allowed
+		for _, content := range generic.Contents {
+			// Amount and destination limits apply even when generic operations are enabled
+			if !(filter.isTxAmountAllowed(content) && filter.isWhitelisted(content)) {
+				return false
+			}
+			if !filter.EnableGeneric && !filter.isContentAllowed(content) {
+				log.Printf("[WARN] Operation kind %v is not allowed\n", content.KindName())
+				return false
+			}
 		}
-		return false
+		return true
 	default:
 		return false
 	}
 }
 
-// Is this address whitelisted? Returns true if whitelistising is disabled
-func (filter *OperationFilter) isWhitelisted(generic *GenericOperation) bool {
-	if filter.TxWhitelistAddresses == nil {
+// isContentAllowed checks a single content of a generic operation
+func (filter *OperationFilter) isContentAllowed(content *OperationContent) bool {
+	if containsString(filter.AllowedKinds, content.KindName()) {
+		return true
+	}
+
+	switch content.Kind {
+	case opKindTransaction:
+		return filter.EnableTx
+	case opKindReveal:
+		// tezos-client reveals unrevealed accounts in the same batch as their first transfer
+		return filter.EnableTx
+	case opKindBallot, opKindProposals:
+		return filter.EnableVoting
+	}
+	return false
+}
+
+// Is this address whitelisted? Returns true if whitelistising is disabled or
+// the content has no destination
+func (filter *OperationFilter) isWhitelisted(content *OperationContent) bool {
+	if filter.TxWhitelistAddresses == nil || content.Destination == "" {
 		return true
 	}
 	for _, pkh := range filter.TxWhitelistAddresses {
-		if generic.TransactionDestination() == PubkeyHashToByteString(pkh) {
+		if content.Destination == pkh {
 			return true
 		}
 	}
@@ -59,20 +199,89 @@ func (filter *OperationFilter) isWhitelisted(generic *GenericOperation) bool {
 	return false
 }
 
-// AuthorizeTxAmount for withdrawal.  Fails if this amount would push us
-// over the daily limit in XTZ.  Returns true if limits are disabled
-func (filter *OperationFilter) authorizeTxAmount(value *big.Int) bool {
-	if filter.TxDailyMax == nil {
+// isTxAmountAllowed checks the mutez moved by a single content against TxMaxAmount
+func (filter *OperationFilter) isTxAmountAllowed(content *OperationContent) bool {
+	if filter.TxMaxAmount == nil {
+		return true
+	}
+	amount, bounded := transferredAmount(content)
+	if !bounded {
+		log.Printf("[WARN] Amount of %v can not be checked against the maximum\n", content.KindName())
+		return false
+	}
+	if amount == nil || amount.Cmp(filter.TxMaxAmount) != 1 {
 		return true
 	}
+	log.Printf("[WARN] Amount %v of %v exceeds the maximum of %v\n", amount, content.KindName(), filter.TxMaxAmount)
+	return false
+}
+
+// transferredAmount in mutez sent by a content, excluding fees and burns for its
+// own storage limit.  Drained balances and tickets have no amount in mutez that
+// can be known from the operation, so they are reported as unbounded.
+func transferredAmount(content *OperationContent) (*big.Int, bool) {
+	switch content.Kind {
+	case opKindTransaction:
+		return content.Amount, true
+	case opKindOrigination:
+		return content.Balance, true
+	case opKindIncreasePaidStorage:
+		return new(big.Int).Mul(content.Amount, big.NewInt(storageCostPerByte)), true
+	case opKindDrainDelegate, opKindTransferTicket:
+		return nil, false
+	}
+	return nil, true
+}
+
+// spendLimits enforced for this filter, including TxDailyMax as a 24 hour limit.
+// Like every other limit, TxDailyMax counts fees and burns as well as amounts.
+func (filter *OperationFilter) spendLimits() []spending.Limit {
+	limits := filter.SpendLimits
+	if filter.TxDailyMax != nil {
+		limits = append([]spending.Limit{{Window: 24 * time.Hour, Max: filter.TxDailyMax}}, limits...)
+	}
+	return limits
+}
+
+// operationSpends returns the mutez spent by a generic operation.  Transaction
+// amounts are spent to their destination, fees, burns and other balances are
+// spent without a destination.
+func operationSpends(op *Operation) ([]spending.Spend, error) {
+	generic, err := GetGenericOperation(op)
+	if err != nil {
+		return nil, err
+	}
+	spends := []spending.Spend{}
+	for _, content := range generic.Contents {
+		if !content.IsManager() {
+			continue
+		}
+		value := content.Value()
+		if content.Kind == opKindTransaction && content.Amount.Sign() > 0 {
+			spends = append(spends, spending.Spend{Destination: content.Destination, Amount: content.Amount})
+			value.Sub(value, content.Amount)
+		}
+		if value.Sign() > 0 {
+			spends = append(spends, spending.Spend{Amount: value})
+		}
+	}
+	return spends, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
 
-	now := time.Now()
-	key := fmt.Sprintf("%v-%v", now.Year(), now.YearDay())
-	// Reset the counter when we're in a new day
-	if filter.dailyTxMaxKey != key {
-		filter.dailyTxMaxKey = key
-		filter.dailyTxMaxCounter = new(big.Int).SetInt64(0)
+func containsMagicByte(values []uint8, value uint8) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	filter.dailyTxMaxCounter.Add(filter.dailyTxMaxCounter, value)
-	return filter.dailyTxMaxCounter.Cmp(filter.TxDailyMax) == -1
+	return false
 }
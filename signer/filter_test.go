@@ -0,0 +1,198 @@
+package signer
+
+import (
+	"log"
+	"math/big"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func filterAllows(t *testing.T, filter *OperationFilter, test testOperation) bool {
+	op, err := ParseOperation([]byte(test.Operation))
+	if err != nil {
+		log.Println("Unable to parse operation:", err)
+		t.Fail()
+		return false
+	}
+	return filter.IsAllowed(op)
+}
+
+func TestParsePolicy(t *testing.T) {
+	var keys []Key
+	err := yaml.Unmarshal([]byte(`
+- Name: payouts
+  PublicKeyHash: tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m
+  Policy:
+    AllowedMagicBytes: [0x03]
+    AllowedKinds: [reveal, transaction]
+    AllowedDestinations: [tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m]
+    TxMaxAmount: 1.5
+    TxDailyMax: 500
+    SpendLimits:
+      - Window: 7d
+        Max: 2000
+      - Window: 1h
+        Max: 10
+        Destination: tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m
+- Name: baker
+  PublicKeyHash: tz3fNgiRyEZeXD5eh6rEocSp8PBzii2w38Ku
+`), &keys)
+	if err != nil {
+		log.Println("Unable to parse policy:", err)
+		t.FailNow()
+	}
+
+	policy := keys[0].Policy
+	if policy == nil || keys[1].Policy != nil {
+		log.Println("Expected a policy on the first key only")
+		t.FailNow()
+	}
+	if len(policy.AllowedMagicBytes) != 1 || policy.AllowedMagicBytes[0] != opMagicByteGeneric {
+		log.Printf("Unexpected magic bytes: %v\n", policy.AllowedMagicBytes)
+		t.Fail()
+	}
+	if len(policy.TxWhitelistAddresses) != 1 || len(policy.AllowedKinds) != 2 {
+		log.Println("Unexpected destinations or kinds")
+		t.Fail()
+	}
+	if policy.TxMaxAmount.Cmp(big.NewInt(1500000)) != 0 || policy.TxDailyMax.Cmp(big.NewInt(500000000)) != 0 {
+		log.Printf("Unexpected amounts: %v %v\n", policy.TxMaxAmount, policy.TxDailyMax)
+		t.Fail()
+	}
+
+	limits := policy.spendLimits()
+	if len(limits) != 3 || limits[0].Window != 24*time.Hour || limits[1].Window != 7*24*time.Hour ||
+		limits[2].Max.Cmp(big.NewInt(10000000)) != 0 || len(limits[2].Destination) == 0 {
+		log.Printf("Unexpected spend limits: %v\n", limits)
+		t.Fail()
+	}
+
+	// Default filters apply to keys without a policy
+	defaultFilter := &OperationFilter{}
+	if keys[0].Filter(defaultFilter) != policy || keys[1].Filter(defaultFilter) != defaultFilter {
+		log.Println("Keys did not select the expected filter")
+		t.Fail()
+	}
+
+	// Unknown kinds are a configuration error
+	err = yaml.Unmarshal([]byte("AllowedKinds: [transfer]"), &OperationFilter{})
+	if err == nil {
+		log.Println("Expected an error for an unknown kind")
+		t.Fail()
+	}
+}
+
+func TestParseTez(t *testing.T) {
+	for amount, expected := range map[string]int64{
+		"0":        0,
+		"1":        1000000,
+		"1.5":      1500000,
+		"0.000001": 1,
+	} {
+		mutez, err := ParseTez(amount)
+		if err != nil || mutez.Int64() != expected {
+			log.Printf("Parsed %v as %v, expected %v (%v)\n", amount, mutez, expected, err)
+			t.Fail()
+		}
+	}
+	for _, amount := range []string{"", "abc", "-1", "0.0000001"} {
+		if _, err := ParseTez(amount); err == nil {
+			log.Printf("Expected an error parsing %v\n", amount)
+			t.Fail()
+		}
+	}
+}
+
+func TestPolicyMagicBytes(t *testing.T) {
+	filter := &OperationFilter{AllowedMagicBytes: []uint8{opMagicByteTenderbakeBlock, opMagicByteAttestation}}
+	assertAllowed(t, "Tenderbake block", filterAllows(t, filter, testTenderbakeBlock), true)
+	assertAllowed(t, "Attestation", filterAllows(t, filter, testAttestation), true)
+	assertAllowed(t, "Preattestation", filterAllows(t, filter, testPreattestation), false)
+	assertAllowed(t, "Legacy block", filterAllows(t, filter, testBlock), false)
+}
+
+func TestPolicyChainIDs(t *testing.T) {
+	filter := &OperationFilter{AllowedChainIDs: []string{"NetXdQprcVkpaWU"}}
+	assertAllowed(t, "Allowed chain", filterAllows(t, filter, testTenderbakeBlock), true)
+
+	filter.AllowedChainIDs = []string{"NetXeSG6ShTTieu"}
+	assertAllowed(t, "Other chain", filterAllows(t, filter, testTenderbakeBlock), false)
+}
+
+func TestPolicyKinds(t *testing.T) {
+	// Kinds allow operations without the global flags
+	filter := &OperationFilter{AllowedKinds: []string{"transaction"}}
+	assertAllowed(t, "Allowed kind", filterAllows(t, filter, testSecp256k1Transfer), true)
+
+	filter.AllowedKinds = []string{"delegation"}
+	assertAllowed(t, "Other kind", filterAllows(t, filter, testSecp256k1Transfer), false)
+
+	// Destinations still apply to allowed transactions
+	filter.AllowedKinds = []string{"transaction"}
+	filter.TxWhitelistAddresses = []string{"tz3fNgiRyEZeXD5eh6rEocSp8PBzii2w38Ku"}
+	assertAllowed(t, "Allowed destination", filterAllows(t, filter, testP256Transfer), true)
+	assertAllowed(t, "Other destination", filterAllows(t, filter, testSecp256k1Transfer), false)
+}
+
+func TestPolicyTxMaxAmount(t *testing.T) {
+	filter := &OperationFilter{EnableTx: true, TxMaxAmount: big.NewInt(1000000)}
+	assertAllowed(t, "At the maximum", filterAllows(t, filter, testSecp256k1Transfer), true)
+
+	filter.TxMaxAmount = big.NewInt(999999)
+	assertAllowed(t, "Over the maximum", filterAllows(t, filter, testSecp256k1Transfer), false)
+}
+
+// Operations that move funds or tickets without being transactions
+var (
+	testDrainDelegate = testOperation{
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf090002298c03ed7d454a101eb7022bc95f7e5f41ac780002298c03ed7d454a101eb7022bc95f7e5f41ac780154f5d8f71ce18f9f05bb885a4120e64c667bc1b4\"",
+	}
+	testIncreasePaidStorage = testOperation{
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf710002298c03ed7d454a101eb7022bc95f7e5f41ac78010203040a6e7c23cc06c7b0743256f65e34d5b0f7c91e4eb200\"",
+	}
+	testTransferTicket = testOperation{
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf9e0002298c03ed7d454a101eb7022bc95f7e5f41ac780102030400000002000000000002036801" +
+			"6e7c23cc06c7b0743256f65e34d5b0f7c91e4eb20005016e7c23cc06c7b0743256f65e34d5b0f7c91e4eb20000000000\"",
+	}
+)
+
+func TestPolicyDestinationsOfOtherKinds(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		op          testOperation
+		destination string
+	}{
+		{"drain_delegate", testDrainDelegate, "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m"},
+		{"increase_paid_storage", testIncreasePaidStorage, "KT1JexcFezMnUAaWmvUGY99jwTA4jcKiUgFp"},
+		{"transfer_ticket", testTransferTicket, "KT1JexcFezMnUAaWmvUGY99jwTA4jcKiUgFp"},
+	} {
+		filter := &OperationFilter{EnableGeneric: true, TxWhitelistAddresses: []string{test.destination}}
+		assertAllowed(t, test.name+" to an allowed destination", filterAllows(t, filter, test.op), true)
+
+		filter.TxWhitelistAddresses = []string{"tz3fNgiRyEZeXD5eh6rEocSp8PBzii2w38Ku"}
+		assertAllowed(t, test.name+" to another destination", filterAllows(t, filter, test.op), false)
+	}
+}
+
+func TestPolicyTxMaxAmountOfOtherKinds(t *testing.T) {
+	// 10 bytes of paid storage burn 2500 mutez
+	filter := &OperationFilter{EnableGeneric: true, TxMaxAmount: big.NewInt(2500)}
+	assertAllowed(t, "increase_paid_storage at the maximum", filterAllows(t, filter, testIncreasePaidStorage), true)
+
+	filter.TxMaxAmount = big.NewInt(2499)
+	assertAllowed(t, "increase_paid_storage over the maximum", filterAllows(t, filter, testIncreasePaidStorage), false)
+
+	// Drained balances and tickets have no amount in mutez to check
+	filter.TxMaxAmount = big.NewInt(1000000000)
+	assertAllowed(t, "drain_delegate", filterAllows(t, filter, testDrainDelegate), false)
+	assertAllowed(t, "transfer_ticket", filterAllows(t, filter, testTransferTicket), false)
+}
+
+func assertAllowed(t *testing.T, name string, allowed, expected bool) {
+	if allowed != expected {
+		log.Printf("%v: allowed was %v, expected %v\n", name, allowed, expected)
+		t.Fail()
+	}
+}
@@ -0,0 +1,63 @@
+package signer
+
+import (
+	"context"
+	"log"
+	"net"
+	"testing"
+
+	cloudkms "cloud.google.com/go/kms/apiv1"
+	"google.golang.org/api/option"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeKMS signs with the test keys, by key version name
+type fakeKMS struct {
+	kmspb.KeyManagementServiceServer
+	requests []*kmspb.AsymmetricSignRequest
+}
+
+func (f *fakeKMS) AsymmetricSign(_ context.Context, req *kmspb.AsymmetricSignRequest) (*kmspb.AsymmetricSignResponse, error) {
+	f.requests = append(f.requests, req)
+	sig, err := signTestDigest(req.Name, req.Digest.GetSha256())
+	if err != nil {
+		return nil, err
+	}
+	return &kmspb.AsymmetricSignResponse{Signature: sig}, nil
+}
+
+// getTestGoogleCloudKMSSigner serves a fake KMS over gRPC
+func getTestGoogleCloudKMSSigner(t *testing.T, fake *fakeKMS) (Signer, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	kmspb.RegisterKeyManagementServiceServer(server, fake)
+	go server.Serve(listener)
+
+	client, err := cloudkms.NewKeyManagementClient(context.Background(),
+		option.WithEndpoint(listener.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGoogleCloudKMSSigner(client), func() {
+		client.Close()
+		server.Stop()
+	}
+}
+
+func TestGoogleCloudKMSSigner(t *testing.T) {
+	fake := &fakeKMS{}
+	kms, stop := getTestGoogleCloudKMSSigner(t, fake)
+	defer stop()
+
+	testKMSSigner(t, kms)
+	if len(fake.requests) != 2 || fake.requests[0].Digest.GetSha256() == nil {
+		log.Printf("Expected 2 KMS requests with SHA-256 digests, got %v\n", fake.requests)
+		t.Fail()
+	}
+}
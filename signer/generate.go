@@ -0,0 +1,91 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Curves keys can be generated on, by name
+var generateCurves = map[string]struct {
+	mechanism uint
+	params    []byte
+}{
+	"ed25519":   {ckmECEdwardsKeyPairGen, ecParamsEd25519},
+	"secp256k1": {pkcs11.CKM_EC_KEY_PAIR_GEN, ecParamsSecp256k1},
+	"p256":      {pkcs11.CKM_EC_KEY_PAIR_GEN, ecParamsP256},
+}
+
+// Generate a key pair on the curve in the given slot.  The private key is
+// sensitive and can never be extracted from the HSM.  Both keys are stored
+// with the label as their CKA_LABEL and CKA_ID.
+func (hsm *PKCS11Signer) Generate(ctx context.Context, slot uint, label string, curve string) (*Key, error) {
+	generate, ok := generateCurves[curve]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %q, expected ed25519, secp256k1 or p256", curve)
+	}
+	if len(label) == 0 {
+		return nil, errors.New("a label is required")
+	}
+
+	pool, err := hsm.getPool(slot)
+	if err != nil {
+		return nil, err
+	}
+	session, err := hsm.acquire(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	defer hsm.release(pool, session, true)
+
+	// Keys are found by label when signing, so labels must be unique
+	existing, err := hsm.findObjects(session,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("a key labelled %v already exists on slot %v", label, slot)
+	}
+
+	public, _, err := hsm.ctx.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(generate.mechanism, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, generate.params),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate a %v key: %v", curve, err)
+	}
+
+	publicKey, err := hsm.getPublicKey(session, public)
+	if err != nil {
+		return nil, err
+	}
+	pkh, err := publicKeyHash(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		Name:          label,
+		PublicKeyHash: pkh,
+		PublicKey:     publicKey,
+		HsmSlot:       slot,
+		HsmLabel:      label,
+	}, nil
+}
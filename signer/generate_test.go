@@ -0,0 +1,91 @@
+package signer
+
+import (
+	"context"
+	"crypto/elliptic"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestGenerate(t *testing.T) {
+	fake := newFakePKCS11()
+	fake.objects = map[pkcs11.ObjectHandle][]*pkcs11.Attribute{}
+	fake.generatedPoint = elliptic.Marshal(elliptic.P256(), testP256PrivateKey.X, testP256PrivateKey.Y)
+	hsm := getTestPKCS11Signer(fake)
+
+	key, err := hsm.Generate(context.Background(), 2, "payouts", "p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.PublicKey != testP256Transfer.PublicKey || key.PublicKeyHash != testP256Transfer.PublicKeyHash || key.HsmSlot != 2 || key.HsmLabel != "payouts" {
+		log.Printf("Unexpected generated key %v\n", key)
+		t.Fail()
+	}
+	if fake.mechanisms[0] != pkcs11.CKM_EC_KEY_PAIR_GEN {
+		log.Printf("Unexpected mechanism %#x\n", fake.mechanisms[0])
+		t.Fail()
+	}
+
+	// The private key is sensitive and can't be extracted
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "payouts"),
+	}
+	if !fake.matches(2, private) {
+		log.Println("Expected a sensitive, non-extractable private key")
+		t.Fail()
+	}
+
+	// Labels are unique
+	if _, err := hsm.Generate(context.Background(), 2, "payouts", "p256"); err == nil {
+		log.Println("Expected an error generating a duplicate label")
+		t.Fail()
+	}
+	if _, err := hsm.Generate(context.Background(), 2, "rsa", "rsa"); err == nil {
+		log.Println("Expected an error for an unsupported curve")
+		t.Fail()
+	}
+}
+
+func TestAppendKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "keys.yaml")
+	ioutil.WriteFile(file, []byte("# Baking keys\n- Name: baker\n  PublicKey: "+testEndorse.PublicKey), 0600)
+
+	payouts := Key{Name: "payouts", PublicKeyHash: testP256Transfer.PublicKeyHash, PublicKey: testP256Transfer.PublicKey, HsmSlot: 2, HsmLabel: "payouts"}
+	if err := AppendKeyFile(file, payouts); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyFile(file)
+	if err != nil || len(keys) != 2 || keys[1].PublicKey != payouts.PublicKey || keys[1].HsmSlot != 2 {
+		log.Printf("Expected the key to be appended, got %v: %v\n", keys, err)
+		t.Fail()
+	}
+	contents, _ := ioutil.ReadFile(file)
+	if string(contents[:14]) != "# Baking keys\n" {
+		log.Println("Expected comments to be kept")
+		t.Fail()
+	}
+
+	if err := AppendKeyFile(file, payouts); err == nil {
+		log.Println("Expected an error appending a key twice")
+		t.Fail()
+	}
+
+	// Missing files are created
+	if err := AppendKeyFile(path.Join(dir, "new.yaml"), payouts); err != nil {
+		log.Println("Expected a new key file to be created:", err)
+		t.Fail()
+	}
+}
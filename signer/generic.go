@@ -1,156 +1,473 @@
 package signer
 
 import (
-	"encoding/hex"
-	"log"
+	"errors"
+	"fmt"
 	"math/big"
 )
 
-// GenericOperation parses an operation with a generic magic byte
+// GenericOperation is a decoded operation with a generic magic byte: a branch
+// followed by a batch of one or more contents
 type GenericOperation struct {
-	hex []byte
+	Branch   string
+	Contents []*OperationContent
 }
 
+// OperationContent is a single operation within a batch.  Only the fields used
+// by its Kind are set.
+type OperationContent struct {
+	Kind uint8
+
+	// Manager operations: reveal, transaction, origination, delegation, ...
+	Source       string
+	Fee          *big.Int
+	Counter      *big.Int
+	GasLimit     *big.Int
+	StorageLimit *big.Int
+
+	// Reveal and update_consensus_key
+	PublicKey string
+
+	// Transaction, transfer_ticket, increase_paid_storage and drain_delegate
+	Amount      *big.Int
+	Destination string
+	Entrypoint  string
+	Parameters  []byte
+
+	// Origination
+	Balance *big.Int
+	Code    []byte
+	Storage []byte
+
+	// Origination, delegation and drain_delegate.  Empty when withdrawing a delegation
+	Delegate string
+
+	// Ballot and proposals
+	Period    int32
+	Proposals []string
+	Ballot    string
+
+	// Consensus operations and seed_nonce_revelation
+	Level int32
+	Round int32
+
+	// set_deposits_limit.  Nil when removing the limit
+	Limit *big.Int
+
+	// register_global_constant and failing_noop
+	Data []byte
+}
+
+// storageCostPerByte is the mutez burned for each byte of storage
+const storageCostPerByte = 250
+
 // Kind of different types of generic operations
-// Defined in gitlb.com/tezos/tezos:
-// https://gitlab.com/tezos/tezos/blob/mainnet/src/proto_003_PsddFKi3/lib_protocol/src/operation_repr.ml
+// Defined in gitlab.com/tezos/tezos:
+// https://gitlab.com/tezos/tezos/blob/master/src/proto_alpha/lib_protocol/operation_repr.ml
 const (
-	opKindUnknown     = 0xff
-	opKindProposals   = 0x05
-	opKindBallot      = 0x06
-	opKindTransaction = 0x6C
+	opKindSeedNonceRevelation          = 0x01
+	opKindDoubleAttestationEvidence    = 0x02
+	opKindDoubleBakingEvidence         = 0x03
+	opKindActivateAccount              = 0x04
+	opKindProposals                    = 0x05
+	opKindBallot                       = 0x06
+	opKindDoublePreattestationEvidence = 0x07
+	opKindVdfRevelation                = 0x08
+	opKindDrainDelegate                = 0x09
+	opKindFailingNoop                  = 0x11
+	opKindPreattestation               = 0x14
+	opKindAttestation                  = 0x15
+	opKindAttestationWithDal           = 0x17
+	opKindReveal                       = 0x6B
+	opKindTransaction                  = 0x6C
+	opKindOrigination                  = 0x6D
+	opKindDelegation                   = 0x6E
+	opKindRegisterGlobalConstant       = 0x6F
+	opKindSetDepositsLimit             = 0x70
+	opKindIncreasePaidStorage          = 0x71
+	opKindUpdateConsensusKey           = 0x72
+	opKindTransferTicket               = 0x9E
 )
 
-// GetGenericOperation to parse specific Generic fields
-func GetGenericOperation(op *Operation) *GenericOperation {
+// opKindNames as used in tezos RPCs
+var opKindNames = map[uint8]string{
+	opKindSeedNonceRevelation:          "seed_nonce_revelation",
+	opKindDoubleAttestationEvidence:    "double_attestation_evidence",
+	opKindDoubleBakingEvidence:         "double_baking_evidence",
+	opKindActivateAccount:              "activate_account",
+	opKindProposals:                    "proposals",
+	opKindBallot:                       "ballot",
+	opKindDoublePreattestationEvidence: "double_preattestation_evidence",
+	opKindVdfRevelation:                "vdf_revelation",
+	opKindDrainDelegate:                "drain_delegate",
+	opKindFailingNoop:                  "failing_noop",
+	opKindPreattestation:               "preattestation",
+	opKindAttestation:                  "attestation",
+	opKindAttestationWithDal:           "attestation_with_dal",
+	opKindReveal:                       "reveal",
+	opKindTransaction:                  "transaction",
+	opKindOrigination:                  "origination",
+	opKindDelegation:                   "delegation",
+	opKindRegisterGlobalConstant:       "register_global_constant",
+	opKindSetDepositsLimit:             "set_deposits_limit",
+	opKindIncreasePaidStorage:          "increase_paid_storage",
+	opKindUpdateConsensusKey:           "update_consensus_key",
+	opKindTransferTicket:               "transfer_ticket",
+}
+
+// Entrypoints with a reserved one byte encoding
+var entrypointNames = map[uint8]string{
+	0: "default",
+	1: "root",
+	2: "do",
+	3: "set_delegate",
+	4: "remove_delegate",
+	5: "deposit",
+	6: "stake",
+	7: "unstake",
+	8: "finalize_unstake",
+	9: "set_delegate_parameters",
+}
+
+// Ballot votes
+var ballotNames = map[uint8]string{
+	0: "yay",
+	1: "nay",
+	2: "pass",
+}
+
+// GetGenericOperation decodes every content of an operation with a generic magic byte.
+// Fails unless every byte of the operation is consumed.
+func GetGenericOperation(op *Operation) (*GenericOperation, error) {
 	if op.MagicByte() != opMagicByteGeneric {
-		return nil
+		return nil, errors.New("not a generic operation")
+	}
+	d := newDecoder(op.Hex()[1:])
+
+	branch, err := d.b58(tzBlockHash, 32)
+	if err != nil {
+		return nil, err
 	}
-	return &GenericOperation{
-		hex: op.Hex(),
+	generic := GenericOperation{
+		Branch: branch,
 	}
+	for d.remaining() > 0 {
+		content, err := decodeContent(d)
+		if err != nil {
+			return nil, err
+		}
+		generic.Contents = append(generic.Contents, content)
+	}
+	if len(generic.Contents) == 0 {
+		return nil, errors.New("generic operation has no contents")
+	}
+	return &generic, nil
+}
+
+// KindName of this content as used in tezos RPCs
+func (content *OperationContent) KindName() string {
+	return kindName(content.Kind)
 }
 
-// Kind of the generic operation
-func (op *GenericOperation) Kind() uint8 {
-	// Must be at least long enough to get the kind byte
-	if len(op.hex) <= 33 {
-		return opKindUnknown
+func kindName(kind uint8) string {
+	if name, ok := opKindNames[kind]; ok {
+		return name
 	}
+	return fmt.Sprintf("unknown(%v)", kind)
+}
 
-	return op.hex[33]
+// IsManager operation, paid for with a fee by its source
+func (content *OperationContent) IsManager() bool {
+	return content.Fee != nil
 }
 
-// TransactionSource address that funds are being moved from
-func (op *GenericOperation) TransactionSource() string {
-	if op.Kind() != opKindTransaction {
-		return ""
+// Value is the total mutez that could be spent by this content: its fee, amount
+// and balance, and the most that its storage limit could burn.  The gas limit
+// is paid for by the fee.
+func (content *OperationContent) Value() *big.Int {
+	total := new(big.Int)
+	for _, value := range []*big.Int{content.Fee, content.Amount, content.Balance} {
+		if value != nil {
+			total.Add(total, value)
+		}
+	}
+	if content.StorageLimit != nil {
+		total.Add(total, new(big.Int).Mul(content.StorageLimit, big.NewInt(storageCostPerByte)))
 	}
-	return hex.EncodeToString(op.hex[36:56])
+	return total
 }
 
-// TransactionFee that's being paid along with this tx
-func (op *GenericOperation) TransactionFee() *big.Int {
-	if op.Kind() != opKindTransaction {
-		return nil
+// decodeContent reads a single tagged content
+func decodeContent(d *decoder) (*OperationContent, error) {
+	kind, err := d.uint8()
+	if err != nil {
+		return nil, err
+	}
+	content := &OperationContent{Kind: kind}
+
+	switch kind {
+	case opKindSeedNonceRevelation:
+		if content.Level, err = d.int32(); err != nil {
+			return nil, err
+		}
+		_, err = d.fixed(32)
+	case opKindDoubleAttestationEvidence, opKindDoublePreattestationEvidence, opKindDoubleBakingEvidence:
+		if _, err = d.variable(); err != nil {
+			return nil, err
+		}
+		_, err = d.variable()
+	case opKindActivateAccount:
+		if content.Source, err = d.b58(tzEd25519PublicKeyHash, 20); err != nil {
+			return nil, err
+		}
+		_, err = d.fixed(20)
+	case opKindProposals:
+		err = decodeProposals(d, content)
+	case opKindBallot:
+		err = decodeBallot(d, content)
+	case opKindVdfRevelation:
+		_, err = d.fixed(200)
+	case opKindDrainDelegate:
+		if content.Source, err = d.publicKeyHash(); err != nil {
+			return nil, err
+		}
+		if content.Delegate, err = d.publicKeyHash(); err != nil {
+			return nil, err
+		}
+		content.Destination, err = d.publicKeyHash()
+	case opKindFailingNoop:
+		content.Data, err = d.variable()
+	case opKindPreattestation, opKindAttestation, opKindAttestationWithDal:
+		err = decodeConsensus(d, content)
+	case opKindReveal, opKindTransaction, opKindOrigination, opKindDelegation,
+		opKindRegisterGlobalConstant, opKindSetDepositsLimit, opKindIncreasePaidStorage,
+		opKindUpdateConsensusKey, opKindTransferTicket:
+		if err = decodeManager(d, content); err != nil {
+			return nil, err
+		}
+		err = decodeManagerBody(d, content)
+	default:
+		return nil, fmt.Errorf("unsupported operation kind %v", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %v: %v", content.KindName(), err)
 	}
-	return op.parseSerializedNumberOffset(0)
+	return content, nil
 }
 
-// TransactionCounter ensuring idempotency of this tx
-func (op *GenericOperation) TransactionCounter() *big.Int {
-	if op.Kind() != opKindTransaction {
-		return nil
+// decodeManager reads the fields shared by every manager operation
+func decodeManager(d *decoder, content *OperationContent) error {
+	var err error
+	if content.Source, err = d.publicKeyHash(); err != nil {
+		return err
+	}
+	if content.Fee, err = d.natural(); err != nil {
+		return err
+	}
+	if content.Counter, err = d.natural(); err != nil {
+		return err
 	}
-	return op.parseSerializedNumberOffset(1)
+	if content.GasLimit, err = d.natural(); err != nil {
+		return err
+	}
+	content.StorageLimit, err = d.natural()
+	return err
 }
 
-// TransactionGasLimit of this tx
-func (op *GenericOperation) TransactionGasLimit() *big.Int {
-	if op.Kind() != opKindTransaction {
-		return nil
+// decodeManagerBody reads the fields specific to each manager operation
+func decodeManagerBody(d *decoder, content *OperationContent) error {
+	var err error
+	switch content.Kind {
+	case opKindReveal, opKindUpdateConsensusKey:
+		if content.PublicKey, err = d.publicKey(); err != nil {
+			return err
+		}
+		return decodeOptionalProof(d)
+	case opKindTransaction:
+		if content.Amount, err = d.natural(); err != nil {
+			return err
+		}
+		if content.Destination, err = d.contract(); err != nil {
+			return err
+		}
+		hasParameters, err := d.bool()
+		if err != nil || !hasParameters {
+			return err
+		}
+		if content.Entrypoint, err = decodeEntrypoint(d); err != nil {
+			return err
+		}
+		content.Parameters, err = d.variable()
+		return err
+	case opKindOrigination:
+		if content.Balance, err = d.natural(); err != nil {
+			return err
+		}
+		if content.Delegate, err = decodeOptionalDelegate(d); err != nil {
+			return err
+		}
+		if content.Code, err = d.variable(); err != nil {
+			return err
+		}
+		content.Storage, err = d.variable()
+		return err
+	case opKindDelegation:
+		content.Delegate, err = decodeOptionalDelegate(d)
+		return err
+	case opKindRegisterGlobalConstant:
+		content.Data, err = d.variable()
+		return err
+	case opKindSetDepositsLimit:
+		hasLimit, err := d.bool()
+		if err != nil || !hasLimit {
+			return err
+		}
+		content.Limit, err = d.natural()
+		return err
+	case opKindIncreasePaidStorage:
+		if content.Amount, err = d.integer(); err != nil {
+			return err
+		}
+		content.Destination, err = d.originatedContract()
+		return err
+	case opKindTransferTicket:
+		// Ticket contents and type
+		if _, err = d.variable(); err != nil {
+			return err
+		}
+		if _, err = d.variable(); err != nil {
+			return err
+		}
+		// Ticketer
+		if _, err = d.contract(); err != nil {
+			return err
+		}
+		if content.Amount, err = d.natural(); err != nil {
+			return err
+		}
+		if content.Destination, err = d.contract(); err != nil {
+			return err
+		}
+		entrypoint, err := d.variable()
+		content.Entrypoint = string(entrypoint)
+		return err
 	}
-	return op.parseSerializedNumberOffset(2)
+	return fmt.Errorf("unsupported manager operation kind %v", content.Kind)
 }
 
-// TransactionStorageLimit of this tx
-func (op *GenericOperation) TransactionStorageLimit() *big.Int {
-	if op.Kind() != opKindTransaction {
+// decodeOptionalProof reads the BLS proof of possession that follows public keys
+// since protocol R.  Older protocols omit the field entirely, which is unambiguous
+// because no operation kind is tagged 0x00 or 0xff.
+func decodeOptionalProof(d *decoder) error {
+	next, ok := d.peek()
+	if !ok || (next != 0x00 && next != 0xff) {
 		return nil
 	}
-	return op.parseSerializedNumberOffset(3)
+	hasProof, err := d.bool()
+	if err != nil || !hasProof {
+		return err
+	}
+	_, err = d.variable()
+	return err
 }
 
-// TransactionAmount that's moving with this tx
-func (op *GenericOperation) TransactionAmount() *big.Int {
-	if op.Kind() != opKindTransaction {
-		return nil
+// decodeOptionalDelegate reads an optional public key hash
+func decodeOptionalDelegate(d *decoder) (string, error) {
+	hasDelegate, err := d.bool()
+	if err != nil || !hasDelegate {
+		return "", err
 	}
-	return op.parseSerializedNumberOffset(4)
+	return d.publicKeyHash()
 }
 
-// TransactionDestination address we're sending funds to
-func (op *GenericOperation) TransactionDestination() string {
-	if op.Kind() != opKindTransaction {
-		return ""
+// decodeEntrypoint reads a reserved or named entrypoint
+func decodeEntrypoint(d *decoder) (string, error) {
+	tag, err := d.uint8()
+	if err != nil {
+		return "", err
 	}
-	// Verify these indices align with the end_index of transaction amount
-	numberIndex := 56
-	for i := 0; i <= 4; i++ {
-		_, numberIndex = op.parseSerializedNumber(numberIndex)
+	if name, ok := entrypointNames[tag]; ok {
+		return name, nil
 	}
-
-	start := len(op.hex) - 21
-	end := len(op.hex) - 1
-	if start-numberIndex != 2 {
-		log.Println("[WARN] Incorrect offset between numbers and destination.  Unsure where we're sending.")
-		return ""
+	if tag != 0xff {
+		return "", fmt.Errorf("unknown entrypoint tag %v", tag)
+	}
+	length, err := d.uint8()
+	if err != nil {
+		return "", err
 	}
-	return hex.EncodeToString(op.hex[start:end])
+	name, err := d.fixed(int(length))
+	return string(name), err
 }
 
-// TransactionValue is the total value of all XTZ that could be spent in this tx
-func (op *GenericOperation) TransactionValue() *big.Int {
-	if op.Kind() != opKindTransaction {
-		return nil
+// decodeProposals reads a proposals operation
+func decodeProposals(d *decoder, content *OperationContent) error {
+	var err error
+	if content.Source, err = d.publicKeyHash(); err != nil {
+		return err
 	}
-	total := &big.Int{}
-	total.Add(total, op.TransactionFee())
-	total.Add(total, op.TransactionAmount())
-	total.Add(total, op.TransactionGasLimit())
-	total.Add(total, op.TransactionStorageLimit())
-	return total
+	if content.Period, err = d.int32(); err != nil {
+		return err
+	}
+	proposals, err := d.variable()
+	if err != nil {
+		return err
+	}
+	if len(proposals)%32 != 0 {
+		return fmt.Errorf("proposals list is %v bytes, expected a multiple of 32", len(proposals))
+	}
+	pd := newDecoder(proposals)
+	for pd.remaining() > 0 {
+		proposal, _ := pd.b58(tzProtocolHash, 32)
+		content.Proposals = append(content.Proposals, proposal)
+	}
+	return nil
 }
 
-// Private funcs to parse sequentially serialized numbers in the operation's hex
-func (op *GenericOperation) parseSerializedNumberOffset(offset int) *big.Int {
-	var num *big.Int
-	// Numbers always begin at this index
-	index := 56
-	for i := 0; i <= offset; i++ {
-		num, index = op.parseSerializedNumber(index)
+// decodeBallot reads a ballot operation
+func decodeBallot(d *decoder, content *OperationContent) error {
+	var err error
+	if content.Source, err = d.publicKeyHash(); err != nil {
+		return err
+	}
+	if content.Period, err = d.int32(); err != nil {
+		return err
+	}
+	proposal, err := d.b58(tzProtocolHash, 32)
+	if err != nil {
+		return err
 	}
-	return num
+	content.Proposals = []string{proposal}
+	ballot, err := d.uint8()
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if content.Ballot, ok = ballotNames[ballot]; !ok {
+		return fmt.Errorf("unknown ballot %v", ballot)
+	}
+	return nil
 }
 
-// Parse a numbers starting at the provided index.  Return the number and
-// the index of the next byte in the operation.  Follows the recursive reading
-// fn @ https://gitlab.com/tezos/tezos/blob/master/src/lib_data_encoding/binary_reader.ml#L174
-func (op *GenericOperation) parseSerializedNumber(startIndex int) (*big.Int, int) {
-	if len(op.hex) <= startIndex {
-		log.Println("[WARN] Ran into end of bytes while parsing.  Returning zero.")
-		return new(big.Int).SetInt64(0), startIndex
+// decodeConsensus reads a preattestation or attestation
+func decodeConsensus(d *decoder, content *OperationContent) error {
+	var err error
+	// Slot
+	if _, err = d.uint16(); err != nil {
+		return err
 	}
-	b := op.hex[startIndex]
-	nextIndex := startIndex + 1
-
-	base := new(big.Int).SetInt64(int64(0))
-	top := new(big.Int).SetInt64(int64(b))
-	top.Mod(top, new(big.Int).SetInt64(0x80))
-	if b >= 0x80 {
-		var result *big.Int
-		result, nextIndex = op.parseSerializedNumber(nextIndex)
-		base.Mul(new(big.Int).SetInt64(0x80), result)
+	if content.Level, err = d.int32(); err != nil {
+		return err
+	}
+	if content.Round, err = d.int32(); err != nil {
+		return err
+	}
+	// Block payload hash
+	if _, err = d.fixed(32); err != nil {
+		return err
+	}
+	if content.Kind == opKindAttestationWithDal {
+		_, err = d.integer()
 	}
-	return top.Add(top, base), nextIndex
+	return err
 }
@@ -8,8 +8,12 @@ import (
 )
 
 type testGenericOperation struct {
-	Name         string
-	Operation    string
+	Name      string
+	Operation string
+	Contents  []testContent
+}
+
+type testContent struct {
 	Kind         uint8
 	Source       string
 	Fee          *big.Int
@@ -18,142 +22,294 @@ type testGenericOperation struct {
 	StorageLimit *big.Int
 	Amount       *big.Int
 	Destination  string
+	Entrypoint   string
+	Delegate     string
+	PublicKey    string
 }
 
 func TestParseKind(t *testing.T) {
-	var op *Operation
-	op, _ = ParseOperation([]byte(testP256Tx.Operation))
-	generic := GetGenericOperation(op)
-	if generic.Kind() != opKindTransaction {
-		log.Println("Tx was not parsed as a generic transaction")
-		t.Fail()
-	}
-	op, _ = ParseOperation([]byte(testSecp256k1Tx.Operation))
-	if generic.Kind() != opKindTransaction {
-		log.Println("Tx was not parsed as a generic transaction")
-		t.Fail()
+	for _, test := range []testOperation{testP256Transfer, testSecp256k1Transfer} {
+		op, _ := ParseOperation([]byte(test.Operation))
+		generic, err := GetGenericOperation(op)
+		if err != nil || len(generic.Contents) != 1 || generic.Contents[0].Kind != opKindTransaction {
+			log.Println("Tx was not parsed as a generic transaction", err)
+			t.Fail()
+		}
 	}
 }
 
-func testParseGenericOperation(t *testing.T, test *testGenericOperation) {
-	op, _ := ParseOperation([]byte(test.Operation))
-	generic := GetGenericOperation(op)
-	// Verify Each Field
-	if generic.Kind() != test.Kind {
-		log.Printf("[Generic Test - %v] Kind mismatch. Expected %v but received %v\n", test.Name, test.Kind, generic.Kind())
-		t.Fail()
-	}
-
-	if generic.TransactionSource() != PubkeyHashToByteString(test.Source) {
-		log.Printf("[Generic Test - %v] Source mismatch. Expected %v but received %v\n", test.Name, test.Source, generic.TransactionSource())
-		t.Fail()
+func compareBigInt(t *testing.T, name string, field string, expected *big.Int, received *big.Int) {
+	if expected == nil && received == nil {
+		return
 	}
-	if generic.TransactionFee().Cmp(test.Fee) != 0 {
-		log.Printf("[Generic Test - %v] Fee mismatch. Expected %v but received %v\n", test.Name, test.Fee, generic.TransactionFee())
+	if expected == nil || received == nil || expected.Cmp(received) != 0 {
+		log.Printf("[Generic Test - %v] %v mismatch. Expected %v but received %v\n", name, field, expected, received)
 		t.Fail()
 	}
-	if generic.TransactionCounter().Cmp(test.Counter) != 0 {
-		log.Printf("[Generic Test - %v] Counter mismatch. Expected %v but received %v\n", test.Name, test.Counter, generic.TransactionCounter())
+}
+
+func compareString(t *testing.T, name string, field string, expected string, received string) {
+	if expected != received {
+		log.Printf("[Generic Test - %v] %v mismatch. Expected %v but received %v\n", name, field, expected, received)
 		t.Fail()
 	}
-	if generic.TransactionGasLimit().Cmp(test.GasLimit) != 0 {
-		log.Printf("[Generic Test - %v] GasLimit mismatch. Expected %v but received %v\n", test.Name, test.GasLimit, generic.TransactionGasLimit())
+}
+
+func testParseGenericOperation(t *testing.T, test *testGenericOperation) {
+	op, err := ParseOperation([]byte(test.Operation))
+	if err != nil {
+		log.Printf("[Generic Test - %v] Error parsing operation: %v\n", test.Name, err)
 		t.Fail()
+		return
 	}
-	if generic.TransactionStorageLimit().Cmp(test.StorageLimit) != 0 {
-		log.Printf("[Generic Test - %v] StorageLimit mismatch. Expected %v but received %v\n", test.Name, test.StorageLimit, generic.TransactionStorageLimit())
+	generic, err := GetGenericOperation(op)
+	if err != nil {
+		log.Printf("[Generic Test - %v] Error decoding operation: %v\n", test.Name, err)
 		t.Fail()
+		return
 	}
-	if generic.TransactionAmount().Cmp(test.Amount) != 0 {
-		log.Printf("[Generic Test - %v] Amount mismatch. Expected %v but received %v\n", test.Name, test.Amount, generic.TransactionAmount())
+	if len(generic.Contents) != len(test.Contents) {
+		log.Printf("[Generic Test - %v] Expected %v contents but received %v\n", test.Name, len(test.Contents), len(generic.Contents))
 		t.Fail()
+		return
 	}
-	if generic.TransactionDestination() != PubkeyHashToByteString(test.Destination) {
-		log.Printf("[Generic Test - %v] Destination mismatch. Expected %v but received %v\n", test.Name, test.Destination, generic.TransactionDestination())
-		t.Fail()
+	// Verify Each Field
+	for i, expected := range test.Contents {
+		content := generic.Contents[i]
+		if content.Kind != expected.Kind {
+			log.Printf("[Generic Test - %v] Kind mismatch. Expected %v but received %v\n", test.Name, expected.Kind, content.Kind)
+			t.Fail()
+		}
+		compareString(t, test.Name, "Source", expected.Source, content.Source)
+		compareBigInt(t, test.Name, "Fee", expected.Fee, content.Fee)
+		compareBigInt(t, test.Name, "Counter", expected.Counter, content.Counter)
+		compareBigInt(t, test.Name, "GasLimit", expected.GasLimit, content.GasLimit)
+		compareBigInt(t, test.Name, "StorageLimit", expected.StorageLimit, content.StorageLimit)
+		compareBigInt(t, test.Name, "Amount", expected.Amount, content.Amount)
+		compareString(t, test.Name, "Destination", expected.Destination, content.Destination)
+		compareString(t, test.Name, "Entrypoint", expected.Entrypoint, content.Entrypoint)
+		compareString(t, test.Name, "Delegate", expected.Delegate, content.Delegate)
+		compareString(t, test.Name, "PublicKey", expected.PublicKey, content.PublicKey)
 	}
 }
 
+// Hand-written transactions in the Babylon encoding, tagged 0x6c with an implicit source
 func TestParseTransactions(t *testing.T) {
 	testParseGenericOperation(t, &testGenericOperation{
-		Name:         "Small Values",
-		Kind:         opKindTransaction,
-		Operation:    "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac780102030405000202298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
-		Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
-		Fee:          new(big.Int).SetInt64(1),
-		Counter:      new(big.Int).SetInt64(2),
-		GasLimit:     new(big.Int).SetInt64(3),
-		StorageLimit: new(big.Int).SetInt64(4),
-		Amount:       new(big.Int).SetInt64(5),
-		Destination:  "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+		Name:      "Small Values",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6c0002298c03ed7d454a101eb7022bc95f7e5f41ac780102030405000002298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
+		Contents: []testContent{{
+			Kind:         opKindTransaction,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(1),
+			Counter:      big.NewInt(2),
+			GasLimit:     big.NewInt(3),
+			StorageLimit: big.NewInt(4),
+			Amount:       big.NewInt(5),
+			Destination:  "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+		}},
 	})
 	testParseGenericOperation(t, &testGenericOperation{
-		Name: "Large Values",
-		Kind: opKindTransaction,
-
-		Operation:    "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac787f80018101ffff03808004000202298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
-		Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
-		Fee:          new(big.Int).SetInt64(127),
-		Counter:      new(big.Int).SetInt64(128),
-		GasLimit:     new(big.Int).SetInt64(129),
-		StorageLimit: new(big.Int).SetInt64(65535),
-		Amount:       new(big.Int).SetInt64(65536),
-		Destination:  "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+		Name:      "Large Values",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6c0002298c03ed7d454a101eb7022bc95f7e5f41ac787f80018101ffff03808004000002298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
+		Contents: []testContent{{
+			Kind:         opKindTransaction,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(127),
+			Counter:      big.NewInt(128),
+			GasLimit:     big.NewInt(129),
+			StorageLimit: big.NewInt(65535),
+			Amount:       big.NewInt(65536),
+			Destination:  "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+		}},
 	})
 	testParseGenericOperation(t, &testGenericOperation{
-		Name:         "Zero Values",
-		Kind:         opKindTransaction,
-		Operation:    "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac786404020000000002298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
-		Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
-		Fee:          new(big.Int).SetInt64(100),
-		Counter:      new(big.Int).SetInt64(4),
-		GasLimit:     new(big.Int).SetInt64(2),
-		StorageLimit: new(big.Int).SetInt64(0),
-		Amount:       new(big.Int).SetInt64(0),
-		Destination:  "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+		Name:      "KT Address",
+		Operation: "\"037072fa916732ed788ab030ca81714956fea286521fc0ead7ad533868e0f030846c0154f5d8f71ce18f9f05bb885a4120e64c667bc1b4f809ca69d84f00c0843d016e7c23cc06c7b0743256f65e34d5b0f7c91e4eb20000\"",
+		Contents: []testContent{{
+			Kind:         opKindTransaction,
+			Source:       "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+			Fee:          big.NewInt(1272),
+			Counter:      big.NewInt(13514),
+			GasLimit:     big.NewInt(10200),
+			StorageLimit: big.NewInt(0),
+			Amount:       big.NewInt(1000000),
+			Destination:  "KT1JexcFezMnUAaWmvUGY99jwTA4jcKiUgFp",
+		}},
 	})
 	testParseGenericOperation(t, &testGenericOperation{
-		Name:         "KT Address",
+		Name:      "Parameters",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6c0002298c03ed7d454a101eb7022bc95f7e5f41ac78b81703a09c01ac0200016e7c23cc06c7b0743256f65e34d5b0f7c91e4eb200ffff087472616e73666572000000050200000000\"",
+		Contents: []testContent{{
+			Kind:         opKindTransaction,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(3000),
+			Counter:      big.NewInt(3),
+			GasLimit:     big.NewInt(20000),
+			StorageLimit: big.NewInt(300),
+			Amount:       big.NewInt(0),
+			Destination:  "KT1JexcFezMnUAaWmvUGY99jwTA4jcKiUgFp",
+			Entrypoint:   "transfer",
+		}},
+	})
+}
+
+func TestParseLegacyTransactions(t *testing.T) {
+	// Transactions in the pre-Babylon encoding, tagged 0x08 with a contract source,
+	// are refused rather than misread
+	for name, operation := range map[string]string{
+		"Small Values": "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac780102030405000202298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
+		"Large Values": "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac787f80018101ffff03808004000202298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
+		"Zero Values":  "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf08000002298c03ed7d454a101eb7022bc95f7e5f41ac786404020000000002298c03ed7d454a101eb7022bc95f7e5f41ac7800\"",
+		"KT Address":   "\"037072fa916732ed788ab030ca81714956fea286521fc0ead7ad533868e0f0308408000154f5d8f71ce18f9f05bb885a4120e64c667bc1b4f809ca69d84f00c0843d016e7c23cc06c7b0743256f65e34d5b0f7c91e4eb20000\"",
+		"Secp256k1":    testSecp256k1Tx.Operation,
+		"P256":         testP256Tx.Operation,
+	} {
+		op, _ := ParseOperation([]byte(operation))
+		if _, err := GetGenericOperation(op); err == nil {
+			log.Printf("[Generic Test - Legacy %v] Expected a decoding error\n", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	testParseGenericOperation(t, &testGenericOperation{
+		Name:      "Reveal and Transaction",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6b0002298c03ed7d454a101eb7022bc95f7e5f41ac78f40901e8070000a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a16c0002298c03ed7d454a101eb7022bc95f7e5f41ac78820a02f70b8102c08db701000154f5d8f71ce18f9f05bb885a4120e64c667bc1b400\"",
+		Contents: []testContent{{
+			Kind:         opKindReveal,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(1268),
+			Counter:      big.NewInt(1),
+			GasLimit:     big.NewInt(1000),
+			StorageLimit: big.NewInt(0),
+			PublicKey:    "edpkusQbNLqDnVB2Du2SzcTiV3WyuGjzJgTPnFWvP1rQ724ozsFPRy",
+		}, {
+			Kind:         opKindTransaction,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(1282),
+			Counter:      big.NewInt(2),
+			GasLimit:     big.NewInt(1527),
+			StorageLimit: big.NewInt(257),
+			Amount:       big.NewInt(3000000),
+			Destination:  "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		}},
+	})
+}
+
+func TestContentValue(t *testing.T) {
+	// Fees, amounts and storage burns are spent, but gas is paid for by the fee
+	content := &OperationContent{
 		Kind:         opKindTransaction,
-		Operation:    "\"037072fa916732ed788ab030ca81714956fea286521fc0ead7ad533868e0f0308408000154f5d8f71ce18f9f05bb885a4120e64c667bc1b4f809ca69d84f00c0843d016e7c23cc06c7b0743256f65e34d5b0f7c91e4eb20000\"",
-		Source:       "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
-		Fee:          new(big.Int).SetInt64(1272),
-		Counter:      new(big.Int).SetInt64(13514),
-		GasLimit:     new(big.Int).SetInt64(10200),
-		StorageLimit: new(big.Int).SetInt64(0),
-		Amount:       new(big.Int).SetInt64(1000000),
-		Destination:  "KT1JexcFezMnUAaWmvUGY99jwTA4jcKiUgFp",
+		Fee:          big.NewInt(1282),
+		GasLimit:     big.NewInt(1527),
+		StorageLimit: big.NewInt(257),
+		Amount:       big.NewInt(3000000),
+	}
+	compareBigInt(t, "Content Value", "Value", big.NewInt(1282+3000000+257*250), content.Value())
+}
+
+func TestParseDelegation(t *testing.T) {
+	testParseGenericOperation(t, &testGenericOperation{
+		Name:      "Delegation",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6e0002298c03ed7d454a101eb7022bc95f7e5f41ac78e90904cc0800ff0154f5d8f71ce18f9f05bb885a4120e64c667bc1b4\"",
+		Contents: []testContent{{
+			Kind:         opKindDelegation,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(1257),
+			Counter:      big.NewInt(4),
+			GasLimit:     big.NewInt(1100),
+			StorageLimit: big.NewInt(0),
+			Delegate:     "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		}},
+	})
+	testParseGenericOperation(t, &testGenericOperation{
+		Name:      "Withdraw Delegation",
+		Operation: "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6e0002298c03ed7d454a101eb7022bc95f7e5f41ac78e90905cc080000\"",
+		Contents: []testContent{{
+			Kind:         opKindDelegation,
+			Source:       "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx",
+			Fee:          big.NewInt(1257),
+			Counter:      big.NewInt(5),
+			GasLimit:     big.NewInt(1100),
+			StorageLimit: big.NewInt(0),
+		}},
 	})
+}
 
+func TestParseOrigination(t *testing.T) {
+	op, _ := ParseOperation([]byte("\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6d0002298c03ed7d454a101eb7022bc95f7e5f41ac78d00f068827f403a0cb9801000000000702000000020317000000020000\""))
+	generic, err := GetGenericOperation(op)
+	if err != nil {
+		log.Println("[Origination Test] Error decoding operation:", err)
+		t.FailNow()
+	}
+	content := generic.Contents[0]
+	if content.Kind != opKindOrigination || content.Balance.Cmp(big.NewInt(2500000)) != 0 {
+		log.Printf("[Origination Test] Expected a 2500000 origination, received %v %v\n", content.KindName(), content.Balance)
+		t.Fail()
+	}
+	if hex.EncodeToString(content.Code) != "02000000020317" || hex.EncodeToString(content.Storage) != "0000" {
+		log.Println("[Origination Test] Script mismatch")
+		t.Fail()
+	}
 }
 
 func TestParseProposal(t *testing.T) {
 	op, _ := ParseOperation([]byte("\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf05008fb5cea62d147c696afd9a93dbce962f4c8a9c910000000a00000020ab22e46e7872aa13e366e455bb4f5dbede856ab0864e1da7e122554579ee71f8\""))
-	generic := GetGenericOperation(op)
+	generic, err := GetGenericOperation(op)
 	// Verify Each Field
-	if generic.Kind() != opKindProposals {
-		log.Printf("[Proposal Test] Kind mismatch. Expected %v but received %v\n", opKindProposals, generic.Kind())
+	if err != nil || generic.Contents[0].Kind != opKindProposals {
+		log.Printf("[Proposal Test] Kind mismatch. Expected %v. Error: %v\n", opKindProposals, err)
+		t.FailNow()
+	}
+	if generic.Contents[0].Period != 10 || len(generic.Contents[0].Proposals) != 1 {
+		log.Printf("[Proposal Test] Expected 1 proposal in period 10, received %v\n", generic.Contents[0].Proposals)
 		t.Fail()
 	}
 }
+
 func TestParseBallot(t *testing.T) {
 	op, _ := ParseOperation([]byte("\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf0600531ab5764a29f77c5d40b80a5da45c84468f08a10000000bab22e46e7872aa13e366e455bb4f5dbede856ab0864e1da7e122554579ee71f800\""))
-	generic := GetGenericOperation(op)
+	generic, err := GetGenericOperation(op)
 	// Verify Each Field
-	if generic.Kind() != opKindBallot {
-		log.Printf("[Proposal Test] Kind mismatch. Expected %v but received %v\n", opKindProposals, generic.Kind())
+	if err != nil || generic.Contents[0].Kind != opKindBallot {
+		log.Printf("[Ballot Test] Kind mismatch. Expected %v. Error: %v\n", opKindBallot, err)
+		t.FailNow()
+	}
+	if generic.Contents[0].Period != 11 || generic.Contents[0].Ballot != "yay" {
+		log.Printf("[Ballot Test] Expected a yay in period 11, received %v\n", generic.Contents[0].Ballot)
 		t.Fail()
 	}
 }
 
+func TestParseInvalidGeneric(t *testing.T) {
+	tx := testSecp256k1Transfer.Operation[:len(testSecp256k1Transfer.Operation)-1]
+	for name, operation := range map[string]string{
+		"Trailing Bytes": tx + "00\"",
+		"Truncated":      tx[:len(tx)-4] + "\"",
+		"Unknown Kind":   "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cfee00\"",
+		"No Contents":    "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf\"",
+	} {
+		op, err := ParseOperation([]byte(operation))
+		if err != nil {
+			continue
+		}
+		if _, err := GetGenericOperation(op); err == nil {
+			log.Printf("[Invalid Generic Test - %v] Operation should fail to decode\n", name)
+			t.Fail()
+		}
+	}
+}
+
 func testParseBytes(t *testing.T, bytes string, expect int64) {
-	var op GenericOperation
 	hex, _ := hex.DecodeString(bytes)
-	op = GenericOperation{hex: hex}
+	d := newDecoder(hex)
 
-	num, _ := op.parseSerializedNumber(0)
-	if num.Int64() != expect {
-		log.Printf("Expecting %v, received %v\n", expect, num.String())
+	num, err := d.natural()
+	if err != nil || num.Int64() != expect || d.remaining() != 0 {
+		log.Printf("Expecting %v, received %v\n", expect, num)
 		t.Fail()
 	}
 }
@@ -174,3 +330,14 @@ func TestParseBytes(t *testing.T) {
 	testParseBytes(t, "ffff03", 65535)
 	testParseBytes(t, "808004", 65536)
 }
+
+func TestParseIntegerBytes(t *testing.T) {
+	for encoded, expect := range map[string]int64{"00": 0, "01": 1, "41": -1, "3f": 63, "8001": 64, "c001": -64} {
+		b, _ := hex.DecodeString(encoded)
+		num, err := newDecoder(b).integer()
+		if err != nil || num.Int64() != expect {
+			log.Printf("Expecting %v from %v, received %v\n", expect, encoded, num)
+			t.Fail()
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package signer
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"strings"
 
 	yaml "gopkg.in/yaml.v2"
@@ -10,11 +12,27 @@ import (
 
 // A Key identifies a key preloaded in your HSM
 type Key struct {
-	Name          string `yaml:"Name"`
+	Name string `yaml:"Name"`
+	// Derived from the public key if omitted
 	PublicKeyHash string `yaml:"PublicKeyHash"`
 	PublicKey     string `yaml:"PublicKey"`
 	HsmSlot       uint   `yaml:"HsmSlot"`
 	HsmLabel      string `yaml:"HsmLabel"`
+	// Backend that holds this key, one of Backends, or a comma delimited list
+	// of backends to fail over between in order.  Defaults to --backend
+	Backend string `yaml:"Backend,omitempty"`
+	// Policy replaces the global operation filter for this key, if set
+	Policy *OperationFilter `yaml:"Policy,omitempty"`
+	// Only accept requests from TLS clients with these certificate subjects, if set
+	AllowedClientSubjects []string `yaml:"AllowedClientSubjects,omitempty"`
+}
+
+// Filter that applies to this key, either its own policy or the provided default
+func (key *Key) Filter(defaultFilter *OperationFilter) *OperationFilter {
+	if key.Policy != nil {
+		return key.Policy
+	}
+	return defaultFilter
 }
 
 // Curve represented by this key
@@ -34,17 +52,77 @@ func (key *Key) IsECDSA() bool {
 	return key.Curve() == curveNistP256 || key.Curve() == curveSecp256k1
 }
 
-// LoadKeyFile loads keys from a file
-func LoadKeyFile(keyfile string) []Key {
+// LoadKeyFile loads keys from a file, deriving each public key hash from its
+// public key
+func LoadKeyFile(keyfile string) ([]Key, error) {
 	keys := []Key{}
 
 	yamlFile, err := ioutil.ReadFile(keyfile)
 	if err != nil {
-		log.Fatalln("Unable to read file: " + keyfile)
+		return nil, fmt.Errorf("unable to read file %v: %v", keyfile, err)
 	}
 	err = yaml.Unmarshal(yamlFile, &keys)
 	if err != nil {
-		log.Fatalln("Unable to parse yaml file: " + keyfile)
+		return nil, fmt.Errorf("unable to parse yaml file %v: %v", keyfile, err)
+	}
+	for i := range keys {
+		if err = keys[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid key %v: %v", keys[i].Name, err)
+		}
+	}
+	return keys, nil
+}
+
+// Validate the public key, hash and backend of a key, filling in the hash if
+// it's missing
+func (key *Key) Validate() error {
+	pkh, err := publicKeyHash(key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key %v: %v", key.PublicKey, err)
+	}
+	if len(key.Backend) > 0 {
+		for _, backend := range strings.Split(key.Backend, ",") {
+			if !containsString(Backends, backend) {
+				return fmt.Errorf("unknown backend %v", backend)
+			}
+		}
+	}
+	if len(key.PublicKeyHash) == 0 {
+		key.PublicKeyHash = pkh
+		return nil
+	}
+	if _, err = publicKeyHashBytes(key.PublicKeyHash); err != nil {
+		return fmt.Errorf("invalid public key hash %v: %v", key.PublicKeyHash, err)
+	}
+	if key.PublicKeyHash != pkh {
+		return fmt.Errorf("public key hash %v does not match public key %v, expected %v", key.PublicKeyHash, key.PublicKey, pkh)
+	}
+	return nil
+}
+
+// AppendKeyFile adds a key to the end of a key file, creating the file if it
+// doesn't exist.  Existing entries and comments are left as they are.
+func AppendKeyFile(keyfile string, key Key) error {
+	contents, err := ioutil.ReadFile(keyfile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read file %v: %v", keyfile, err)
+	}
+	keys := []Key{}
+	if err = yaml.Unmarshal(contents, &keys); err != nil {
+		return fmt.Errorf("unable to parse yaml file %v: %v", keyfile, err)
+	}
+	for _, existing := range keys {
+		if existing.Name == key.Name || existing.PublicKey == key.PublicKey {
+			return fmt.Errorf("key %v is already in %v", key.Name, keyfile)
+		}
+	}
+
+	entry, err := yaml.Marshal([]Key{key})
+	if err != nil {
+		return err
+	}
+	if len(contents) > 0 && !bytes.HasSuffix(contents, []byte("\n")) {
+		contents = append(contents, '\n')
 	}
-	return keys
+	return ioutil.WriteFile(keyfile, append(contents, entry...), 0644)
 }
@@ -0,0 +1,82 @@
+package signer
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func loadTestKeyFile(t *testing.T, contents string) ([]Key, error) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "keys.yaml")
+	ioutil.WriteFile(file, []byte(contents), 0600)
+	return LoadKeyFile(file)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	keys, err := loadTestKeyFile(t, `
+- Name: baker
+  PublicKeyHash: tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m
+  PublicKey: sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD
+  HsmSlot: 1
+- Name: payouts
+  PublicKey: p2pk65Dd82G3JpWBNWmRdUJ7XJhkTbX1Q7jQDFkJKK5TJyhZLGqSG1N
+  HsmSlot: 1
+  Backend: pkcs11,vault
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].PublicKeyHash != "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m" {
+		log.Println("Expected the configured public key hash to be kept")
+		t.Fail()
+	}
+	if keys[1].PublicKeyHash != testP256Transfer.PublicKeyHash || keys[1].Curve() != curveNistP256 {
+		log.Printf("Expected a missing public key hash to be derived, got %v\n", keys[1].PublicKeyHash)
+		t.Fail()
+	}
+
+	_, err = loadTestKeyFile(t, "- Name: baker\n  PublicKey: "+testP256Transfer.PublicKey+"\n  Backend: pkcs11,hsm2\n")
+	if err == nil || !strings.Contains(err.Error(), "hsm2") {
+		log.Printf("Expected an error naming the unknown backend, got %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestLoadExampleKeyFile(t *testing.T) {
+	// The keys.yaml shipped with the signer should always load
+	keys, err := LoadKeyFile("../keys.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[1].PublicKeyHash != testP256Transfer.PublicKeyHash || keys[1].Policy == nil {
+		log.Printf("Unexpected keys in the example key file: %+v\n", keys)
+		t.Fail()
+	}
+}
+
+func TestLoadKeyFileInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		PublicKeyHash string
+		PublicKey     string
+	}{
+		"Mismatched hash":    {"tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg", "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD"},
+		"Mismatched curve":   {"tz3PUkjqtsAg1uV3aQTWTMs6SBDYbY9BkUp6", "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S"},
+		"Hash checksum":      {"tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9n", "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD"},
+		"Public key typo":    {"tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m", "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpE"},
+		"Missing public key": {"tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m", ""},
+	} {
+		_, err := loadTestKeyFile(t, "- Name: baker\n  PublicKeyHash: "+test.PublicKeyHash+"\n  PublicKey: "+test.PublicKey+"\n")
+		if err == nil || !strings.Contains(err.Error(), "baker") {
+			log.Printf("%v: Expected an error naming the key, got %v\n", name, err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"log"
+	"math/big"
+	"testing"
+)
+
+// signTestDigest returns the DER signature a cloud KMS would return for the
+// test key of this name
+func signTestDigest(name string, digest []byte) ([]byte, error) {
+	switch name {
+	case "secp256k1":
+		sig, err := testSecp256k1PrivateKey.Sign(digest)
+		if err != nil {
+			return nil, err
+		}
+		return sig.Serialize(), nil
+	case "p256":
+		r, s, err := ecdsa.Sign(rand.Reader, testP256PrivateKey, digest)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+	return nil, fmt.Errorf("unknown key %v", name)
+}
+
+// testKMSSigner signs with both test keys through a KMS signer whose key names
+// are those of signTestDigest
+func testKMSSigner(t *testing.T, signer Signer) {
+	for name, test := range map[string]testOperation{"secp256k1": testSecp256k1Transfer, "p256": testP256Transfer} {
+		op, _ := ParseOperation([]byte(test.Operation))
+		key := &Key{Name: name, PublicKeyHash: test.PublicKeyHash, PublicKey: test.PublicKey}
+		signed, err := op.TzSign(context.Background(), signer, key)
+		if err != nil {
+			log.Printf("Unable to sign with %v: %v\n", name, err)
+			t.Fail()
+		} else if name == "secp256k1" && "{\"signature\":\""+signed+"\"}" != test.SignerResponse {
+			log.Printf("Unexpected secp256k1 signature %v\n", signed)
+			t.Fail()
+		}
+	}
+
+	// KMS has no tezos compatible Ed25519 keys
+	_, client := getTestAuthorizedKey(1)
+	if _, err := signer.Sign(context.Background(), make([]byte, 32), &Key{PublicKeyHash: client.PublicKeyHash()}); err == nil {
+		log.Println("Expected an error signing with a tz1 key")
+		t.Fail()
+	}
+}
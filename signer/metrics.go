@@ -0,0 +1,127 @@
+package signer
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Results of a sign request, as reported by the sign requests counter
+const (
+	resultSigned           = "signed"
+	resultFiltered         = "filtered"
+	resultWatermarkRefused = "watermark_refused"
+	resultSpendRefused     = "spend_refused"
+	resultUnauthorized     = "unauthorized"
+	resultUnverified       = "unverified"
+	resultError            = "error"
+)
+
+var (
+	signRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tezos_signer_sign_requests_total",
+		Help: "Sign requests by key, magic byte, operation kind and result",
+	}, []string{"key", "magic_byte", "kind", "result"})
+
+	hsmSignDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tezos_signer_hsm_sign_duration_seconds",
+		Help:    "Time taken by the HSM to sign a digest",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"key"})
+
+	backendSignRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tezos_signer_backend_sign_requests_total",
+		Help: "Sign requests made to each failover backend by key and result",
+	}, []string{"key", "backend", "result"})
+
+	backendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tezos_signer_backend_healthy",
+		Help: "Whether each failover backend is healthy (1) or being skipped after failures (0)",
+	}, []string{"backend"})
+
+	watermarkLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tezos_signer_watermark_level",
+		Help: "Level of the last block or consensus operation signed by this process, by key, chain and magic byte",
+	}, []string{"key", "chain_id", "magic_byte"})
+
+	spendUsedDesc = prometheus.NewDesc(
+		"tezos_signer_spend_used_mutez",
+		"Mutez spent or reserved towards each spend limit",
+		[]string{"key", "window", "destination"}, nil)
+	spendLimitDesc = prometheus.NewDesc(
+		"tezos_signer_spend_limit_mutez",
+		"Maximum mutez that may be spent within each spend limit",
+		[]string{"key", "window", "destination"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(signRequests, hsmSignDuration, backendSignRequests, backendHealthy, watermarkLevel)
+}
+
+// ServeMetrics exposes prometheus metrics on /metrics at a separate bind address
+func (server *Server) ServeMetrics(bindString string) {
+	prometheus.MustRegister(&spendCollector{server: server})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Println("Serving metrics on:", bindString)
+		log.Fatal(http.ListenAndServe(bindString, mux))
+	}()
+}
+
+// observeSignRequest counts a sign request with its result
+func observeSignRequest(key *Key, op *Operation, result string) {
+	signRequests.WithLabelValues(key.PublicKeyHash, magicByteLabel(op.MagicByte()), op.KindName(), result).Inc()
+}
+
+// observeWatermark records the level of a signed block or consensus operation.
+// The gauge is not read back from the watermark store, so after a restart a key
+// has no level until it signs again.
+func observeWatermark(key *Key, op *Operation) {
+	level, _ := new(big.Float).SetInt(op.Level()).Float64()
+	watermarkLevel.WithLabelValues(key.PublicKeyHash, op.ChainID(), magicByteLabel(op.MagicByte())).Set(level)
+}
+
+func magicByteLabel(magicByte uint8) string {
+	return fmt.Sprintf("0x%02x", magicByte)
+}
+
+// spendCollector reports spend limit usage from the ledger when scraped, so
+// that usage falls as spends leave their windows
+type spendCollector struct {
+	server *Server
+}
+
+// Describe the spend limit metrics
+func (collector *spendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- spendUsedDesc
+	ch <- spendLimitDesc
+}
+
+// Collect the usage of every key's spend limits
+func (collector *spendCollector) Collect(ch chan<- prometheus.Metric) {
+	server := collector.server
+	keys, filter := server.config()
+	for i := range keys {
+		key := &keys[i]
+		// Limits with the same window and destination are only reported once
+		seen := map[string]bool{}
+		for _, limit := range key.Filter(&filter).spendLimits() {
+			labels := []string{key.PublicKeyHash, limit.Window.String(), limit.Destination}
+			if seen[labels[1]+"/"+labels[2]] {
+				continue
+			}
+			seen[labels[1]+"/"+labels[2]] = true
+
+			used, _ := new(big.Float).SetInt(server.spending.Used(key.PublicKeyHash, limit)).Float64()
+			max, _ := new(big.Float).SetInt(limit.Max).Float64()
+			ch <- prometheus.MustNewConstMetric(spendUsedDesc, prometheus.GaugeValue, used, labels...)
+			ch <- prometheus.MustNewConstMetric(spendLimitDesc, prometheus.GaugeValue, max, labels...)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package signer
+
+import (
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gracenoah/tezos-hsm-signer/signer/spending"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSignRequestMetrics(t *testing.T) {
+	server := getTestServer("tz123")
+	pkh := testTenderbakeBlock.PublicKeyHash
+	signed := signRequests.WithLabelValues(pkh, "0x11", "block", resultSigned)
+	refused := signRequests.WithLabelValues(pkh, "0x11", "block", resultWatermarkRefused)
+	before := testutil.ToFloat64(signed)
+
+	resp, body := testPost(t, server, testTenderbakeBlock)
+	compare(t, "Tenderbake Block", resp.StatusCode, http.StatusOK, body, testTenderbakeBlock.SignerResponse)
+	resp, body = testPost(t, server, testTenderbakeBlock)
+	compare(t, "Tenderbake Block Retry", resp.StatusCode, http.StatusOK, body, testTenderbakeBlock.SignerResponse)
+
+	if testutil.ToFloat64(signed)-before != 2 {
+		log.Println("Expected two signed requests to be counted")
+		t.Fail()
+	}
+	level := testutil.ToFloat64(watermarkLevel.WithLabelValues(pkh, "NetXdQprcVkpaWU", "0x11"))
+	if level != 3333330 {
+		log.Printf("Unexpected watermark level %v\n", level)
+		t.Fail()
+	}
+
+	before = testutil.ToFloat64(refused)
+	lower := testTenderbakeBlock
+	lower.Operation = strings.Replace(testTenderbakeBlock.Operation, "0032dcd2", "0032dcd1", 1)
+	resp, _ = testPost(t, server, lower)
+	if resp.StatusCode != http.StatusForbidden || testutil.ToFloat64(refused)-before != 1 {
+		log.Println("Expected a watermark refusal to be counted")
+		t.Fail()
+	}
+}
+
+func TestUnverifiedSignatureMetrics(t *testing.T) {
+	server := getTestServer("tz123")
+	unverified := signRequests.WithLabelValues(testTenderbakeBlock.PublicKeyHash, "0x11", "block", resultUnverified)
+	before := testutil.ToFloat64(unverified)
+
+	// Signatures by another key are never returned
+	wrongKey := testTenderbakeBlock
+	wrongKey.HsmResponse = testEndorse.HsmResponse
+	resp, body := testPost(t, server, wrongKey)
+	compare(t, "Wrong Key", resp.StatusCode, http.StatusInternalServerError, body, "{\"error\":\"signature verification failed\"}")
+	if testutil.ToFloat64(unverified)-before != 1 {
+		log.Println("Expected an unverified signature to be counted")
+		t.Fail()
+	}
+}
+
+func TestSpendMetrics(t *testing.T) {
+	server := getTestServer(testSecp256k1Transfer.PublicKeyHash)
+	server.filter.EnableTx = true
+	server.filter.TxDailyMax = big.NewInt(5000000)
+	server.filter.SpendLimits = []spending.Limit{{Window: time.Hour, Max: big.NewInt(2000000), Destination: "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m"}}
+
+	resp, body := testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Tx", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+
+	// Fees and the transferred amount count towards the daily limit, only the
+	// amount counts towards the destination's limit
+	expected := `
+# HELP tezos_signer_spend_used_mutez Mutez spent or reserved towards each spend limit
+# TYPE tezos_signer_spend_used_mutez gauge
+tezos_signer_spend_used_mutez{destination="",key="tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",window="24h0m0s"} 1.001275e+06
+tezos_signer_spend_used_mutez{destination="",key="tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg2",window="24h0m0s"} 0
+tezos_signer_spend_used_mutez{destination="tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",key="tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",window="1h0m0s"} 1e+06
+tezos_signer_spend_used_mutez{destination="tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",key="tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg2",window="1h0m0s"} 0
+`
+	err := testutil.CollectAndCompare(&spendCollector{server: server}, strings.NewReader(expected), "tezos_signer_spend_used_mutez")
+	if err != nil {
+		log.Println("Unexpected spend metrics:", err)
+		t.Fail()
+	}
+}
@@ -1,12 +1,15 @@
 package signer
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"strings"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 // Operation parses and validates an arbitrary tz request
@@ -21,6 +24,20 @@ const (
 	opMagicByteBlock       = 0x01
 	opMagicByteEndorsement = 0x02
 	opMagicByteGeneric     = 0x03
+	// Tenderbake: https://gitlab.com/tezos/tezos/blob/master/src/lib_crypto/signature_v1.ml
+	opMagicByteTenderbakeBlock = 0x11
+	opMagicBytePreattestation  = 0x12
+	opMagicByteAttestation     = 0x13
+)
+
+// Byte offsets of Tenderbake fields
+const (
+	// magic(1) + chain_id(4) + level(4) + proto(1) + predecessor(32) +
+	// timestamp(8) + validation_pass(1) + operations_hash(32)
+	tenderbakeBlockFitnessOffset = 83
+	// magic(1) + chain_id(4) + branch(32) + tag(1) + slot(2)
+	tenderbakeConsensusLevelOffset = 40
+	tenderbakeConsensusRoundOffset = 44
 )
 
 // ParseOperation parses a raw byte string into a meaningful tz operation
@@ -40,6 +57,9 @@ func ParseOperation(opBytes []byte) (*Operation, error) {
 		return nil, err
 	}
 
+	if len(parsedHex) == 0 {
+		return nil, errors.New("Operation: Empty operation")
+	}
 	op := Operation{
 		hex: parsedHex,
 	}
@@ -47,11 +67,34 @@ func ParseOperation(opBytes []byte) (*Operation, error) {
 	// Validate and print debug statements
 	switch op.MagicByte() {
 	case opMagicByteGeneric:
+		if len(op.hex) < 33 {
+			return nil, errors.New("Operation: Generic operation is too short")
+		}
 		debugln("Operation is Generic.  Possibly a Transaction")
 	case opMagicByteBlock:
+		if len(op.hex) < 9 {
+			return nil, errors.New("Operation: Block is too short")
+		}
 		debugln("Operation is a Block at level: ", op.Level().String())
 	case opMagicByteEndorsement:
+		if len(op.hex) < 9 {
+			return nil, errors.New("Operation: Endorsement is too short")
+		}
 		debugln("Operation is an Endorsement at level: ", op.Level().String())
+	case opMagicByteTenderbakeBlock:
+		if len(op.hex) < tenderbakeBlockFitnessOffset+4 {
+			return nil, errors.New("Operation: Tenderbake block is too short")
+		}
+		fitnessLength := binary.BigEndian.Uint32(op.hex[tenderbakeBlockFitnessOffset:])
+		if fitnessLength < 4 || uint64(len(op.hex)) < uint64(tenderbakeBlockFitnessOffset+4)+uint64(fitnessLength) {
+			return nil, errors.New("Operation: Tenderbake block has an invalid fitness")
+		}
+		debugln("Operation is a Tenderbake Block at level: ", op.Level().String(), " round: ", op.Round().String())
+	case opMagicBytePreattestation, opMagicByteAttestation:
+		if len(op.hex) < tenderbakeConsensusRoundOffset+4 {
+			return nil, errors.New("Operation: Tenderbake consensus operation is too short")
+		}
+		debugln("Operation is a (Pre)attestation at level: ", op.Level().String(), " round: ", op.Round().String())
 	default:
 		return nil, fmt.Errorf("Operation: Unsupported Operation MagicByte: %v", op.MagicByte())
 	}
@@ -66,6 +109,12 @@ func (op *Operation) Hex() []byte {
 	return hexCopy
 }
 
+// Digest is the 256 bit (32 Byte) Blake2b hash of the operation that gets signed
+func (op *Operation) Digest() []byte {
+	digest := blake2b.Sum256(op.hex)
+	return digest[:]
+}
+
 // MagicByte of this tezos operation included in the operation
 func (op *Operation) MagicByte() uint8 {
 	return op.hex[0]
@@ -80,11 +129,60 @@ func (op *Operation) ChainID() string {
 
 // Level returns a copy of the level, if one can be parsed from this operation
 func (op *Operation) Level() *big.Int {
-	if op.MagicByte() == opMagicByteBlock {
+	switch op.MagicByte() {
+	case opMagicByteBlock, opMagicByteTenderbakeBlock:
 		return new(big.Int).SetBytes(op.hex[5:9])
-	} else if op.MagicByte() == opMagicByteEndorsement {
+	case opMagicByteEndorsement:
 		return new(big.Int).SetBytes(op.hex[len(op.hex)-4:])
+	case opMagicBytePreattestation, opMagicByteAttestation:
+		return new(big.Int).SetBytes(op.hex[tenderbakeConsensusLevelOffset:tenderbakeConsensusRoundOffset])
 	}
 	log.Println("Warn: Requested level for unexpected magic byte", op.MagicByte())
 	return nil
 }
+
+// Round returns a copy of the Tenderbake round, if one can be parsed from this
+// operation.  Pre-Tenderbake blocks and endorsements are always at round 0.
+func (op *Operation) Round() *big.Int {
+	switch op.MagicByte() {
+	case opMagicByteBlock, opMagicByteEndorsement:
+		return new(big.Int)
+	case opMagicByteTenderbakeBlock:
+		// The round is the last element of the block's fitness
+		fitnessLength := int(binary.BigEndian.Uint32(op.hex[tenderbakeBlockFitnessOffset:]))
+		end := tenderbakeBlockFitnessOffset + 4 + fitnessLength
+		return new(big.Int).SetBytes(op.hex[end-4 : end])
+	case opMagicBytePreattestation, opMagicByteAttestation:
+		return new(big.Int).SetBytes(op.hex[tenderbakeConsensusRoundOffset : tenderbakeConsensusRoundOffset+4])
+	}
+	log.Println("Warn: Requested round for unexpected magic byte", op.MagicByte())
+	return nil
+}
+
+// KindName of this operation for logs and metrics.  Generic operations are named
+// after the kinds of their contents.
+func (op *Operation) KindName() string {
+	switch op.MagicByte() {
+	case opMagicByteBlock, opMagicByteTenderbakeBlock:
+		return "block"
+	case opMagicByteEndorsement:
+		return "endorsement"
+	case opMagicBytePreattestation:
+		return "preattestation"
+	case opMagicByteAttestation:
+		return "attestation"
+	case opMagicByteGeneric:
+		generic, err := GetGenericOperation(op)
+		if err != nil {
+			return "unknown"
+		}
+		kinds := []string{}
+		for _, content := range generic.Contents {
+			if !containsString(kinds, content.KindName()) {
+				kinds = append(kinds, content.KindName())
+			}
+		}
+		return strings.Join(kinds, ",")
+	}
+	return "unknown"
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestParseTx(t *testing.T) {
-	op, err := ParseOperation([]byte(testP256Tx.Operation))
+	op, err := ParseOperation([]byte(testP256Transfer.Operation))
 
 	if err != nil {
 		log.Println("Error parsing operation: ", err.Error())
@@ -43,6 +43,14 @@ func testParse(t *testing.T, test testOperation, id string) {
 		t.Fail()
 	}
 
+	if len(test.Round) > 0 {
+		round, _ := new(big.Int).SetString(test.Round, 10)
+		if op.Round().Cmp(round) != 0 {
+			log.Printf("%v: Incorrectly parsed op round. Received %v, expecting %v\n", id, op.Round(), round)
+			t.Fail()
+		}
+	}
+
 	if op.ChainID() != test.ChainID {
 		log.Printf("%v: Incorrectly parsed Chain ID. Received %v, expecting %v\n", id, op.ChainID(), test.ChainID)
 		t.Fail()
@@ -56,3 +64,29 @@ func TestParseEndorsement(t *testing.T) {
 func TestParseBlock(t *testing.T) {
 	testParse(t, testBlock, "Block")
 }
+
+func TestParseTenderbakeBlock(t *testing.T) {
+	testParse(t, testTenderbakeBlock, "Tenderbake Block")
+}
+
+func TestParsePreattestation(t *testing.T) {
+	testParse(t, testPreattestation, "Preattestation")
+}
+
+func TestParseAttestation(t *testing.T) {
+	testParse(t, testAttestation, "Attestation")
+}
+
+func TestParseTruncated(t *testing.T) {
+	// Truncated payloads must be rejected rather than read out of bounds
+	for _, test := range []testOperation{testBlock, testEndorse, testTenderbakeBlock, testAttestation} {
+		if _, err := ParseOperation([]byte(test.Operation[:11] + "\"")); err == nil {
+			log.Printf("Truncated %v operation should fail to parse\n", test.OpMagicByte)
+			t.Fail()
+		}
+	}
+	if _, err := ParseOperation([]byte("\"\"")); err == nil {
+		log.Println("Empty operation should fail to parse")
+		t.Fail()
+	}
+}
@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package signer
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// getPeerCredentials reads SO_PEERCRED from a unix socket connection
+func getPeerCredentials(conn net.Conn) (*peerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials require a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &peerCredentials{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
+
+// peerCredentialsSupported on this platform
+const peerCredentialsSupported = true
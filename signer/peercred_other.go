@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package signer
+
+import "net"
+
+// getPeerCredentials is only implemented on linux
+func getPeerCredentials(conn net.Conn) (*peerCredentials, error) {
+	return nil, errPeerCredentialsUnsupported
+}
+
+// peerCredentialsSupported on this platform
+const peerCredentialsSupported = false
@@ -0,0 +1,415 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Default number of sessions that may be open on each slot at once
+const defaultMaxSessionsPerSlot = 4
+
+// PKCS#11 v3.0 mechanisms for Ed25519, which predate our pkcs11 bindings
+const (
+	ckmECEdwardsKeyPairGen = 0x1055
+	ckmEdDSA               = 0x1057
+)
+
+// PKCS11Signer is responsible for signing an arbitrary byte slice with the given
+// Key stored within the HSM.  The PKCS#11 library is initialized once and
+// sessions are reused across requests.
+type PKCS11Signer struct {
+	UserPin string `yaml:"UserPin"`
+	LibPath string `yaml:"LibPath"`
+	// Maximum number of sessions open on each slot.  Defaults to 4
+	MaxSessionsPerSlot int `yaml:"MaxSessionsPerSlot"`
+
+	mux   sync.Mutex
+	ctx   pkcs11Context
+	pools map[uint]*slotPool
+	// newContext loads the library, replaced in tests
+	newContext func(libPath string) pkcs11Context
+}
+
+var _ Signer = &PKCS11Signer{}
+
+// pkcs11Context is the subset of *pkcs11.Ctx used by the signer
+type pkcs11Context interface {
+	Initialize() error
+	Finalize() error
+	Destroy()
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error
+	Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error)
+}
+
+func newPKCS11Context(libPath string) pkcs11Context {
+	ctx := pkcs11.New(libPath)
+	if ctx == nil {
+		// Avoid returning a typed nil
+		return nil
+	}
+	return ctx
+}
+
+// slotPool holds the open sessions and cached key handles of a slot.  Logins
+// apply to every session of the application on a token, so the pool only logs
+// in when opening its first session or after the HSM reports a logout.
+type slotPool struct {
+	slot    uint
+	idle    chan pkcs11.SessionHandle
+	tokens  chan struct{}
+	mux     sync.Mutex
+	login   bool
+	handles map[string]pkcs11.ObjectHandle
+}
+
+func newSlotPool(slot uint, maxSessions int) *slotPool {
+	return &slotPool{
+		slot:    slot,
+		idle:    make(chan pkcs11.SessionHandle, maxSessions),
+		tokens:  make(chan struct{}, maxSessions),
+		handles: map[string]pkcs11.ObjectHandle{},
+	}
+}
+
+// Sign a transaction request
+func (hsm *PKCS11Signer) Sign(ctx context.Context, message []byte, key *Key) ([]byte, error) {
+	pool, err := hsm.getPool(key.HsmSlot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry once with a fresh session or login if the HSM lost our state
+	for attempt := 0; ; attempt++ {
+		session, err := hsm.acquire(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		signedMsg, err := hsm.signWithSession(pool, session, message, key)
+		if err == nil {
+			hsm.release(pool, session, true)
+			return signedMsg, nil
+		}
+
+		retry := attempt == 0
+		switch {
+		case isLoginError(err):
+			log.Println("HSM session is not logged in, logging in again:", err)
+			hsm.release(pool, session, true)
+			pool.setLoggedIn(false)
+		case isSessionError(err):
+			log.Println("HSM session is no longer valid, opening a new session:", err)
+			hsm.release(pool, session, false)
+			pool.clearHandles()
+			// Closing the last session of a token also logs it out
+			pool.setLoggedIn(false)
+		case isKeyHandleError(err):
+			log.Println("HSM key handle is no longer valid, finding the key again:", err)
+			hsm.release(pool, session, true)
+			pool.clearHandles()
+		default:
+			hsm.release(pool, session, true)
+			retry = false
+		}
+		if !retry {
+			return nil, err
+		}
+	}
+}
+
+// Close every session and finalize the library
+func (hsm *PKCS11Signer) Close() {
+	hsm.mux.Lock()
+	defer hsm.mux.Unlock()
+	if hsm.ctx == nil {
+		return
+	}
+	for _, pool := range hsm.pools {
+		for len(pool.idle) > 0 {
+			hsm.ctx.CloseSession(<-pool.idle)
+		}
+	}
+	hsm.ctx.Finalize()
+	hsm.ctx.Destroy()
+	hsm.ctx = nil
+	hsm.pools = nil
+}
+
+// getPool initializes the library on first use and returns the pool for a slot
+func (hsm *PKCS11Signer) getPool(slot uint) (*slotPool, error) {
+	hsm.mux.Lock()
+	defer hsm.mux.Unlock()
+
+	if err := hsm.initialize(); err != nil {
+		return nil, err
+	}
+	if pool, ok := hsm.pools[slot]; ok {
+		return pool, nil
+	}
+
+	// Requested slot must be present
+	slots, err := hsm.ctx.GetSlotList(true)
+	if err != nil {
+		log.Println("Could not get slot list. Error: ", err)
+		return nil, err
+	}
+	if !hsm.isSlotAvailable(slot, slots) {
+		debugln("Available slots are: ", slots)
+		return nil, fmt.Errorf("Slot %v not found", slot)
+	}
+
+	maxSessions := hsm.MaxSessionsPerSlot
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxSessionsPerSlot
+	}
+	pool := newSlotPool(slot, maxSessions)
+	hsm.pools[slot] = pool
+	return pool, nil
+}
+
+// initialize the library if it hasn't been yet.  Must hold hsm.mux.
+func (hsm *PKCS11Signer) initialize() error {
+	if hsm.ctx == nil {
+		newContext := hsm.newContext
+		if newContext == nil {
+			newContext = newPKCS11Context
+		}
+		ctx := newContext(hsm.LibPath)
+		if ctx == nil {
+			return fmt.Errorf("unable to load PKCS#11 library %v", hsm.LibPath)
+		}
+		if err := ctx.Initialize(); err != nil && !isPKCS11Error(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+			log.Println("Error initializing the shared object.  Are you sure this is available? Error: ", err)
+			ctx.Destroy()
+			return err
+		}
+		hsm.ctx = ctx
+		hsm.pools = map[uint]*slotPool{}
+	}
+	return nil
+}
+
+// acquire an idle session or open a new one, waiting if the slot has the
+// maximum number of sessions in use
+func (hsm *PKCS11Signer) acquire(ctx context.Context, pool *slotPool) (pkcs11.SessionHandle, error) {
+	select {
+	case pool.tokens <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	var session pkcs11.SessionHandle
+	select {
+	case session = <-pool.idle:
+	default:
+		var err error
+		session, err = hsm.ctx.OpenSession(pool.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			<-pool.tokens
+			log.Println("Error opening session: ", err)
+			return 0, err
+		}
+		debugln("Opened HSM session on slot", pool.slot)
+	}
+
+	if err := hsm.ensureLoggedIn(pool, session); err != nil {
+		hsm.release(pool, session, false)
+		return 0, err
+	}
+	return session, nil
+}
+
+// release a session back to the pool, or close it if it is no longer usable
+func (hsm *PKCS11Signer) release(pool *slotPool, session pkcs11.SessionHandle, healthy bool) {
+	if healthy {
+		pool.idle <- session
+	} else {
+		hsm.ctx.CloseSession(session)
+	}
+	<-pool.tokens
+}
+
+// ensureLoggedIn logs in to the token if the pool has not done so yet
+func (hsm *PKCS11Signer) ensureLoggedIn(pool *slotPool, session pkcs11.SessionHandle) error {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if pool.login {
+		return nil
+	}
+	err := hsm.ctx.Login(session, pkcs11.CKU_USER, hsm.UserPin)
+	if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		log.Println("Error logging into HSM: ", err)
+		return err
+	}
+	pool.login = true
+	return nil
+}
+
+func (pool *slotPool) setLoggedIn(login bool) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	pool.login = login
+}
+
+func (pool *slotPool) clearHandles() {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	pool.handles = map[string]pkcs11.ObjectHandle{}
+}
+
+// signWithSession signs the message with a session from the pool
+func (hsm *PKCS11Signer) signWithSession(pool *slotPool, session pkcs11.SessionHandle, message []byte, key *Key) ([]byte, error) {
+	// Get a handle to our private key
+	privateKey, err := hsm.getCachedKeyHandle(pool, session, key.HsmLabel)
+	if err != nil {
+		log.Println("Error retrieving a handle to our private key: ", err)
+		return nil, err
+	}
+
+	// Init the signature with this private key handle
+	err = hsm.ctx.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(signMechanism(key), nil)}, privateKey)
+	if err != nil {
+		log.Println("Error initializing the signature: ", err)
+		return nil, err
+	}
+
+	// Sign
+	signedMsg, err := hsm.ctx.Sign(session, message)
+	if err != nil {
+		log.Println("Error signing the message: ", err)
+		return nil, err
+	}
+	return signedMsg, nil
+}
+
+// signMechanism for the key's curve.  Both mechanisms sign the Blake2b digest
+// as is: ECDSA keys sign it as a prehashed message and Ed25519 keys run pure
+// EdDSA over it, as tezos expects.
+func signMechanism(key *Key) uint {
+	if key.Curve() == curveEd25519 {
+		return ckmEdDSA
+	}
+	return pkcs11.CKM_ECDSA
+}
+
+// getCachedKeyHandle returns the cached handle of a key, looking it up on first use
+func (hsm *PKCS11Signer) getCachedKeyHandle(pool *slotPool, session pkcs11.SessionHandle, tokenLabel string) (pkcs11.ObjectHandle, error) {
+	pool.mux.Lock()
+	handle, ok := pool.handles[tokenLabel]
+	pool.mux.Unlock()
+	if ok {
+		return handle, nil
+	}
+
+	handle, err := hsm.getPrivateKeyHandle(session, tokenLabel)
+	if err != nil {
+		return handle, err
+	}
+	pool.mux.Lock()
+	pool.handles[tokenLabel] = handle
+	pool.mux.Unlock()
+	return handle, nil
+}
+
+// getPrivateKeyHandle returns the handle of the private key loaded
+// into your HSM for the corresponding opened session
+func (hsm *PKCS11Signer) getPrivateKeyHandle(session pkcs11.SessionHandle, tokenLabel string) (pkcs11.ObjectHandle, error) {
+	var noKeyFound pkcs11.ObjectHandle = math.MaxUint8
+
+	// Combine attributes to select the correct key
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if len(tokenLabel) > 0 {
+		// SoftHSM does not support label queries, so make this optional
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, tokenLabel))
+	}
+
+	err := hsm.ctx.FindObjectsInit(session, template)
+	if err != nil {
+		log.Println("Error initializing FindObjects, returning no keys. Error: ", err)
+		return noKeyFound, err
+	}
+
+	// find a maximum of 2 objects that match the template
+	keyHandles, _, err := hsm.ctx.FindObjects(session, 2)
+	if err != nil {
+		log.Println("Error Finding Objects, returning no keys. Error: ", err)
+		hsm.ctx.FindObjectsFinal(session)
+		return noKeyFound, err
+	}
+
+	// complete the object search
+	err = hsm.ctx.FindObjectsFinal(session)
+	if err != nil {
+		log.Println("Error Finalizing FindObjects, returning no keys. Error:", err)
+		return noKeyFound, err
+	}
+
+	// must have found exactly one key
+	if len(keyHandles) == 0 {
+		return noKeyFound, errors.New("Querier key not found")
+	} else if len(keyHandles) > 1 {
+		return noKeyFound, errors.New("Multiple matching keys, unsure how to proceed. Returning no results")
+	}
+
+	return keyHandles[0], nil
+}
+
+// Is Slot available in the provided slice of slots
+func (*PKCS11Signer) isSlotAvailable(slotID uint, slots []uint) bool {
+	for _, value := range slots {
+		if value == slotID {
+			return true
+		}
+	}
+	return false
+}
+
+func isPKCS11Error(err error, codes ...uint) bool {
+	var pkcs11Err pkcs11.Error
+	if !errors.As(err, &pkcs11Err) {
+		return false
+	}
+	for _, code := range codes {
+		if uint(pkcs11Err) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoginError is returned when the token has logged out our application
+func isLoginError(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_USER_NOT_LOGGED_IN)
+}
+
+// isSessionError is returned when a session can no longer be used
+func isSessionError(err error) bool {
+	return isPKCS11Error(err,
+		pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_SESSION_COUNT,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_DEVICE_ERROR)
+}
+
+// isKeyHandleError is returned when a cached key handle is no longer valid
+func isKeyHandleError(err error) bool {
+	return isPKCS11Error(err, pkcs11.CKR_KEY_HANDLE_INVALID, pkcs11.CKR_OBJECT_HANDLE_INVALID)
+}
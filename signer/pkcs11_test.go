@@ -0,0 +1,294 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// fakePKCS11 records calls made by the signer and fails on request
+type fakePKCS11 struct {
+	mux          sync.Mutex
+	initialized  int
+	logins       int
+	findObjects  int
+	opened       int
+	open         map[pkcs11.SessionHandle]bool
+	maxOpen      int
+	signed       [][]byte
+	mechanisms   []uint
+	signErrors   []error
+	signDuration time.Duration
+	// Objects on the token by handle, a single private key if unset
+	objects map[pkcs11.ObjectHandle][]*pkcs11.Attribute
+	found   []pkcs11.ObjectHandle
+	// CKA_EC_POINT of generated public keys
+	generatedPoint []byte
+}
+
+func newFakePKCS11() *fakePKCS11 {
+	return &fakePKCS11{open: map[pkcs11.SessionHandle]bool{}}
+}
+
+func (f *fakePKCS11) Initialize() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.initialized++
+	return nil
+}
+
+func (f *fakePKCS11) Finalize() error { return nil }
+
+func (f *fakePKCS11) Destroy() {}
+
+func (f *fakePKCS11) GetSlotList(bool) ([]uint, error) {
+	return []uint{1, 2}, nil
+}
+
+func (f *fakePKCS11) OpenSession(uint, uint) (pkcs11.SessionHandle, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.opened++
+	session := pkcs11.SessionHandle(f.opened)
+	f.open[session] = true
+	if len(f.open) > f.maxOpen {
+		f.maxOpen = len(f.open)
+	}
+	return session, nil
+}
+
+func (f *fakePKCS11) CloseSession(session pkcs11.SessionHandle) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.open, session)
+	return nil
+}
+
+func (f *fakePKCS11) Login(pkcs11.SessionHandle, uint, string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.logins++
+	return nil
+}
+
+func (f *fakePKCS11) FindObjectsInit(_ pkcs11.SessionHandle, template []*pkcs11.Attribute) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.findObjects++
+	if f.objects == nil {
+		f.found = []pkcs11.ObjectHandle{7}
+		return nil
+	}
+	f.found = nil
+	for handle := range f.objects {
+		if f.matches(handle, template) {
+			f.found = append(f.found, handle)
+		}
+	}
+	sort.Slice(f.found, func(i, j int) bool { return f.found[i] < f.found[j] })
+	return nil
+}
+
+// matches is true if the object has every attribute of the template
+func (f *fakePKCS11) matches(object pkcs11.ObjectHandle, template []*pkcs11.Attribute) bool {
+	for _, requested := range template {
+		found := false
+		for _, attribute := range f.objects[object] {
+			found = found || (attribute.Type == requested.Type && bytes.Equal(attribute.Value, requested.Value))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakePKCS11) FindObjects(_ pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if max > len(f.found) {
+		max = len(f.found)
+	}
+	found := f.found[:max]
+	f.found = f.found[max:]
+	return found, false, nil
+}
+
+func (f *fakePKCS11) GenerateKeyPair(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.mechanisms = append(f.mechanisms, m[0].Mechanism)
+	publicHandle := pkcs11.ObjectHandle(len(f.objects) + 1)
+	f.objects[publicHandle] = append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, f.generatedPoint),
+	}, public...)
+	privateHandle := publicHandle + 1
+	f.objects[privateHandle] = append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}, private...)
+	return publicHandle, privateHandle, nil
+}
+
+func (f *fakePKCS11) GetAttributeValue(_ pkcs11.SessionHandle, object pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	result := []*pkcs11.Attribute{}
+	for _, requested := range template {
+		var value *pkcs11.Attribute
+		for _, attribute := range f.objects[object] {
+			if attribute.Type == requested.Type {
+				value = attribute
+			}
+		}
+		if value == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+func (f *fakePKCS11) FindObjectsFinal(pkcs11.SessionHandle) error { return nil }
+
+func (f *fakePKCS11) SignInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.mechanisms = append(f.mechanisms, m[0].Mechanism)
+	return nil
+}
+
+func (f *fakePKCS11) Sign(session pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	time.Sleep(f.signDuration)
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if !f.open[session] {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	if len(f.signErrors) > 0 {
+		err := f.signErrors[0]
+		f.signErrors = f.signErrors[1:]
+		return nil, err
+	}
+	f.signed = append(f.signed, message)
+	return make([]byte, 64), nil
+}
+
+func getTestPKCS11Signer(fake *fakePKCS11) *PKCS11Signer {
+	return &PKCS11Signer{
+		UserPin:    "1234",
+		newContext: func(string) pkcs11Context { return fake },
+	}
+}
+
+func TestPKCS11ReusesSessions(t *testing.T) {
+	fake := newFakePKCS11()
+	hsm := getTestPKCS11Signer(fake)
+	key := &Key{PublicKeyHash: "tz3...", HsmSlot: 1}
+
+	for i := 0; i < 10; i++ {
+		if _, err := hsm.Sign(context.Background(), []byte{byte(i)}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.initialized != 1 || fake.logins != 1 || fake.opened != 1 || fake.findObjects != 1 {
+		log.Printf("Expected a single initialize, login, session and key lookup.  Got %v, %v, %v, %v\n",
+			fake.initialized, fake.logins, fake.opened, fake.findObjects)
+		t.Fail()
+	}
+	if len(fake.signed) != 10 {
+		log.Printf("Expected 10 signatures, got %v\n", len(fake.signed))
+		t.Fail()
+	}
+
+	// ECDSA is used for tz2 and tz3 keys, EdDSA for tz1 keys
+	hsm.Sign(context.Background(), []byte{}, &Key{PublicKeyHash: "tz1...", HsmSlot: 1})
+	if fake.mechanisms[0] != pkcs11.CKM_ECDSA || fake.mechanisms[10] != ckmEdDSA {
+		log.Printf("Unexpected mechanisms %#x and %#x\n", fake.mechanisms[0], fake.mechanisms[10])
+		t.Fail()
+	}
+
+	// Slots that aren't present fail
+	if _, err := hsm.Sign(context.Background(), []byte{}, &Key{HsmSlot: 3}); err == nil {
+		log.Println("Expected an error signing with a missing slot")
+		t.Fail()
+	}
+}
+
+func TestPKCS11ConcurrentSessions(t *testing.T) {
+	fake := newFakePKCS11()
+	fake.signDuration = 5 * time.Millisecond
+	hsm := getTestPKCS11Signer(fake)
+	hsm.MaxSessionsPerSlot = 2
+	key := &Key{PublicKeyHash: "tz3...", HsmSlot: 1}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := hsm.Sign(context.Background(), []byte{}, key); err != nil {
+				log.Println("Error signing concurrently:", err)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fake.maxOpen != 2 || len(fake.signed) != 20 {
+		log.Printf("Expected at most 2 sessions for 20 signatures.  Got %v sessions, %v signatures\n", fake.maxOpen, len(fake.signed))
+		t.Fail()
+	}
+
+	// Waiting for a session respects the request context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blocked := getTestPKCS11Signer(newFakePKCS11())
+	blocked.MaxSessionsPerSlot = 1
+	pool, _ := blocked.getPool(1)
+	pool.tokens <- struct{}{}
+	if _, err := blocked.Sign(ctx, []byte{}, key); err != context.Canceled {
+		log.Println("Expected a cancelled context to stop waiting for a session:", err)
+		t.Fail()
+	}
+}
+
+func TestPKCS11Recovery(t *testing.T) {
+	fake := newFakePKCS11()
+	hsm := getTestPKCS11Signer(fake)
+	key := &Key{PublicKeyHash: "tz3...", HsmSlot: 1}
+	hsm.Sign(context.Background(), []byte{}, key)
+
+	// Log in again when the HSM logs us out
+	fake.signErrors = []error{pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)}
+	if _, err := hsm.Sign(context.Background(), []byte{}, key); err != nil || fake.logins != 2 {
+		log.Printf("Expected to log in again, got %v logins: %v\n", fake.logins, err)
+		t.Fail()
+	}
+
+	// Replace sessions that the HSM has closed, and log in on the new session
+	fake.CloseSession(1)
+	if _, err := hsm.Sign(context.Background(), []byte{}, key); err != nil || fake.opened != 2 || fake.logins != 3 {
+		log.Printf("Expected a new session and login, got %v sessions and %v logins: %v\n", fake.opened, fake.logins, err)
+		t.Fail()
+	}
+
+	// Only retry once
+	fake.signErrors = []error{pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN), pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)}
+	if _, err := hsm.Sign(context.Background(), []byte{}, key); err == nil {
+		log.Println("Expected repeated errors to fail")
+		t.Fail()
+	}
+
+	// Other errors aren't retried
+	fake.signErrors = []error{pkcs11.Error(pkcs11.CKR_DATA_LEN_RANGE)}
+	signed := len(fake.signed)
+	if _, err := hsm.Sign(context.Background(), []byte{}, key); err == nil || len(fake.signed) != signed {
+		log.Println("Expected other errors to fail without a retry")
+		t.Fail()
+	}
+}
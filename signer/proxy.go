@@ -0,0 +1,162 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ProxyConfig locates an upstream tezos remote signer and the credentials used
+// to authenticate with it
+type ProxyConfig struct {
+	// URL of the upstream signer, such as http://octez-signer:6732
+	URL string
+	// Unencrypted secret key used to sign requests for upstreams that require
+	// authorized keys, if set
+	AuthenticationKey string
+	// Client certificate for upstreams that require mutual TLS, if set
+	CertFile string
+	KeyFile  string
+	// CA bundle used to verify the upstream instead of the system roots, if set
+	CAFile string
+}
+
+// proxySigner forwards operations to an upstream signer
+type proxySigner struct {
+	url               string
+	authenticationKey *secretKey
+	client            *http.Client
+}
+
+var _ RawSigner = &proxySigner{}
+
+// NewProxySigner creates a signer that forwards operations to an upstream
+// tezos remote signer, such as octez-signer, over the same /keys/<pkh>
+// protocol that Server exposes.  Operations are still filtered, watermarked
+// and verified against the key's public key locally.
+func NewProxySigner(config ProxyConfig) (RawSigner, error) {
+	if _, err := url.Parse(config.URL); err != nil || len(config.URL) == 0 {
+		return nil, fmt.Errorf("invalid upstream signer url %q", config.URL)
+	}
+	proxy := &proxySigner{
+		url:    strings.TrimSuffix(config.URL, "/"),
+		client: http.DefaultClient,
+	}
+	if len(config.AuthenticationKey) > 0 {
+		key, err := parseSecretKey(config.AuthenticationKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication key: %v", err)
+		}
+		proxy.authenticationKey = key
+	}
+
+	if len(config.CertFile) > 0 || len(config.KeyFile) > 0 || len(config.CAFile) > 0 {
+		tlsConfig := &tls.Config{}
+		if len(config.CertFile) > 0 || len(config.KeyFile) > 0 {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load TLS client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if len(config.CAFile) > 0 {
+			pem, err := ioutil.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read CA file: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %v", config.CAFile)
+			}
+		}
+		proxy.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	return proxy, nil
+}
+
+// Sign can't forward a digest, since remote signers only sign operations
+func (p *proxySigner) Sign(_ context.Context, _ []byte, _ *Key) ([]byte, error) {
+	return nil, errors.New("the upstream signer requires the operation, not its digest")
+}
+
+// SignOperation by forwarding it to the upstream signer
+func (p *proxySigner) SignOperation(ctx context.Context, operation []byte, key *Key) ([]byte, error) {
+	path := fmt.Sprintf("%v/keys/%v", p.url, key.PublicKeyHash)
+	if p.authenticationKey != nil {
+		authentication, err := p.authenticate(operation, key)
+		if err != nil {
+			return nil, err
+		}
+		path += "?authentication=" + authentication
+	}
+
+	body, _ := json.Marshal(hex.EncodeToString(operation))
+	req, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream signer request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream signer returned %v: %v", resp.StatusCode, strings.TrimSpace(string(contents)))
+	}
+
+	var response struct {
+		Signature string `json:"signature"`
+	}
+	if err = json.Unmarshal(contents, &response); err != nil {
+		return nil, fmt.Errorf("unable to parse upstream signer response: %v", err)
+	}
+	sig, err := decodeSignature(response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream signature %v: %v", response.Signature, err)
+	}
+	return sig, nil
+}
+
+// authenticate a request the way tezos-client does, by signing
+// 0x04 || pkh || operation with the authentication key
+func (p *proxySigner) authenticate(operation []byte, key *Key) (string, error) {
+	pkh, err := publicKeyHashBytes(key.PublicKeyHash)
+	if err != nil {
+		return "", err
+	}
+	msg := append([]byte{authMagicByte}, pkh...)
+	msg = append(msg, operation...)
+	digest := blake2b.Sum256(msg)
+	sig, err := p.authenticationKey.sign(digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign authentication: %v", err)
+	}
+
+	authenticationPkh, _ := publicKeyHash(p.authenticationKey.publicKey)
+	authenticationKey := &Key{PublicKeyHash: authenticationPkh, PublicKey: p.authenticationKey.publicKey}
+	if authenticationKey.IsECDSA() {
+		sig = StrictECModN(authenticationKey, sig)
+	}
+	prefix, err := getSignaturePrefix(authenticationKey)
+	if err != nil {
+		return "", err
+	}
+	return b58CheckEncode(prefix, sig), nil
+}
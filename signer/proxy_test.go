@@ -0,0 +1,119 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getTestUpstream serves a signer holding the test secret keys that requires
+// requests to be authenticated by the seed 1 client key
+func getTestUpstream(requests *int) *httptest.Server {
+	keySigner, _ := NewSecretKeySigner(getTestUnencryptedSecretKeys())
+	upstream := getTestServer(testSecp256k1Transfer.PublicKeyHash)
+	upstream.signer = keySigner
+	upstream.filter.EnableTx = true
+	upstream.keys[0].PublicKey = testSecp256k1Transfer.PublicKey
+	_, client := getTestAuthorizedKey(1)
+	upstream.SetAuthorizedKeys([]AuthorizedKey{client})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		Middleware(upstream.RouteKeys)(w, r)
+	}))
+}
+
+func testPostProxy(server *Server, test testOperation) (int, string) {
+	r := httptest.NewRequest("POST", fmt.Sprintf("/keys/%v", test.PublicKeyHash), strings.NewReader(test.Operation))
+	w := httptest.NewRecorder()
+	Middleware(server.RouteKeys)(w, r)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Result().StatusCode, string(body)
+}
+
+func TestProxySigner(t *testing.T) {
+	requests := 0
+	upstream := getTestUpstream(&requests)
+	defer upstream.Close()
+
+	proxy, err := NewProxySigner(ProxyConfig{
+		URL:               upstream.URL,
+		AuthenticationKey: encodePublicKey(tzEd25519Seed, bytes.Repeat([]byte{0x01}, 32)),
+	})
+	if err != nil {
+		log.Println("Unable to create proxy signer:", err)
+		t.FailNow()
+	}
+	server := getTestServer(testSecp256k1Transfer.PublicKeyHash)
+	server.signer = proxy
+	server.keys[0].PublicKey = testSecp256k1Transfer.PublicKey
+
+	// The local filter applies before forwarding
+	status, body := testPostProxy(server, testSecp256k1Transfer)
+	compare(t, "Proxy Tx Disabled", status, http.StatusForbidden, body, "")
+	if requests != 0 {
+		log.Printf("Expected a filtered operation not to be forwarded, got %v requests\n", requests)
+		t.Fail()
+	}
+
+	server.filter.EnableTx = true
+	status, body = testPostProxy(server, testSecp256k1Transfer)
+	compare(t, "Proxy Tx Enabled", status, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+	if requests != 1 {
+		log.Printf("Expected the operation to be forwarded once, got %v requests\n", requests)
+		t.Fail()
+	}
+
+	// Upstreams that require authentication reject unauthenticated requests
+	unauthenticated, _ := NewProxySigner(ProxyConfig{URL: upstream.URL})
+	op, _ := ParseOperation([]byte(testSecp256k1Transfer.Operation))
+	key := &server.keys[0]
+	if _, err := unauthenticated.SignOperation(context.Background(), op.Hex(), key); err == nil {
+		log.Println("Expected an unauthenticated request to fail")
+		t.Fail()
+	}
+	// And digests can't be forwarded
+	if _, err := proxy.Sign(context.Background(), op.Digest(), key); err == nil {
+		log.Println("Expected signing a digest to fail")
+		t.Fail()
+	}
+}
+
+func TestProxySignerVerifies(t *testing.T) {
+	// An upstream that signs with the wrong key is rejected
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testEndorse.SignerResponse)
+	}))
+	defer upstream.Close()
+
+	proxy, _ := NewProxySigner(ProxyConfig{URL: upstream.URL})
+	server := getTestServer(testAttestation.PublicKeyHash)
+	server.signer = proxy
+	server.keys[0].PublicKey = testAttestation.PublicKey
+	status, body := testPostProxy(server, testAttestation)
+	compare(t, "Proxy Wrong Key", status, http.StatusInternalServerError, body, "")
+}
+
+func TestProxySignerRouting(t *testing.T) {
+	requests := 0
+	upstream := getTestUpstream(&requests)
+	defer upstream.Close()
+	proxy, _ := NewProxySigner(ProxyConfig{
+		URL:               upstream.URL,
+		AuthenticationKey: encodePublicKey(tzEd25519Seed, bytes.Repeat([]byte{0x01}, 32)),
+	})
+
+	// Keys routed to the proxy backend are forwarded with the whole operation
+	router := NewRoutingSigner(map[string]Signer{BackendPKCS11: &testSigner{}, BackendProxy: proxy}, BackendPKCS11)
+	op, _ := ParseOperation([]byte(testSecp256k1Transfer.Operation))
+	key := &Key{PublicKeyHash: testSecp256k1Transfer.PublicKeyHash, PublicKey: testSecp256k1Transfer.PublicKey, Backend: BackendProxy}
+	if _, err := op.TzSign(context.Background(), router, key); err != nil || requests != 1 {
+		log.Printf("Expected the operation to be forwarded, got %v requests: %v\n", requests, err)
+		t.Fail()
+	}
+}
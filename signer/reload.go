@@ -0,0 +1,94 @@
+package signer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ConfigLoader loads the keys and global operation filter, so that they can be
+// reloaded while the server runs
+type ConfigLoader func() ([]Key, OperationFilter, error)
+
+// reloadConfig locates the configuration reloaded on SIGHUP or when files change
+type reloadConfig struct {
+	load     ConfigLoader
+	files    []string
+	interval time.Duration
+}
+
+// SetReload reloads the keys and filter with the loader on SIGHUP, and whenever
+// one of the files changes if the interval is set.  The current keys and
+// filter are kept if the new ones fail to load or validate.
+func (server *Server) SetReload(load ConfigLoader, files []string, interval time.Duration) {
+	server.reload = &reloadConfig{load: load, files: files, interval: interval}
+}
+
+// config returns the current keys and filter.  Reloads replace both together
+// rather than modifying them, so each request sees one consistent snapshot.
+func (server *Server) config() ([]Key, OperationFilter) {
+	server.configMux.RLock()
+	defer server.configMux.RUnlock()
+	return server.keys, server.filter
+}
+
+// validateKeys checks keys against the server's TLS configuration.  Client
+// subjects can only be checked against verified client certificates.
+func (server *Server) validateKeys(keys []Key) error {
+	for _, key := range keys {
+		if len(key.AllowedClientSubjects) > 0 && (server.tls == nil || len(server.tls.config.ClientCAFile) == 0) {
+			return fmt.Errorf("key %v restricts client subjects but client certificates are not required", key.Name)
+		}
+	}
+	return nil
+}
+
+// reloadConfig loads and validates new keys and filter, then swaps them in
+func (server *Server) reloadConfig() error {
+	keys, filter, err := server.reload.load()
+	if err != nil {
+		return err
+	}
+	if err = server.validateKeys(keys); err != nil {
+		return err
+	}
+
+	server.configMux.Lock()
+	server.keys, server.filter = keys, filter
+	server.configMux.Unlock()
+	log.Printf("Reloaded %v keys\n", len(keys))
+	return nil
+}
+
+// watchFiles reloads the configuration whenever the modification time or size
+// of one of the files changes
+func (server *Server) watchFiles() {
+	stat := func() map[string]string {
+		versions := map[string]string{}
+		for _, file := range server.reload.files {
+			if info, err := os.Stat(file); err == nil {
+				versions[file] = fmt.Sprintf("%v/%v", info.ModTime().UnixNano(), info.Size())
+			}
+		}
+		return versions
+	}
+
+	current := stat()
+	for range time.Tick(server.reload.interval) {
+		versions := stat()
+		changed := false
+		for _, file := range server.reload.files {
+			changed = changed || versions[file] != current[file]
+		}
+		// Only retry a failed reload once the files change again
+		current = versions
+		if !changed {
+			continue
+		}
+		log.Println("Configuration changed, reloading")
+		if err := server.reloadConfig(); err != nil {
+			log.Println("Error reloading configuration, keeping the current one:", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package signer
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testGetKey(server *Server, pkh string) int {
+	r := httptest.NewRequest("GET", "/keys/"+pkh, nil)
+	w := httptest.NewRecorder()
+	server.RouteKeys(w, r)
+	return w.Result().StatusCode
+}
+
+func TestReloadConfig(t *testing.T) {
+	server := getTestServer("tz123")
+	var loaded []Key
+	var loadErr error
+	server.SetReload(func() ([]Key, OperationFilter, error) {
+		return loaded, OperationFilter{EnableTx: true}, loadErr
+	}, nil, 0)
+
+	// New keys and filters replace the current ones
+	loaded = []Key{{Name: "new", PublicKeyHash: testP256Transfer.PublicKeyHash, PublicKey: testP256Transfer.PublicKey}}
+	if err := server.reloadConfig(); err != nil {
+		log.Println("Unable to reload:", err)
+		t.Fail()
+	}
+	keys, filter := server.config()
+	if testGetKey(server, testP256Transfer.PublicKeyHash) != http.StatusOK || testGetKey(server, "tz123") != http.StatusNotFound || len(keys) != 1 || !filter.EnableTx {
+		log.Println("Expected the new keys and filter to be used")
+		t.Fail()
+	}
+
+	// Invalid configurations keep the current one
+	loadErr = errors.New("unable to parse yaml file")
+	if err := server.reloadConfig(); err == nil {
+		log.Println("Expected a load error to fail the reload")
+		t.Fail()
+	}
+	loadErr = nil
+	loaded = []Key{{Name: "restricted", PublicKeyHash: "tz1restricted", AllowedClientSubjects: []string{"baker"}}}
+	if err := server.reloadConfig(); err == nil {
+		log.Println("Expected keys restricting client subjects without mutual TLS to fail the reload")
+		t.Fail()
+	}
+	if testGetKey(server, testP256Transfer.PublicKeyHash) != http.StatusOK || testGetKey(server, "tz1restricted") != http.StatusNotFound {
+		log.Println("Expected the current keys to be kept")
+		t.Fail()
+	}
+}
+
+func TestReloadInFlight(t *testing.T) {
+	// Requests always see a complete configuration while it is reloaded
+	server := getTestServer(testSecp256k1Transfer.PublicKeyHash)
+	server.keys[0].PublicKey = testSecp256k1Transfer.PublicKey
+	keySigner, _ := NewSecretKeySigner(getTestUnencryptedSecretKeys())
+	server.signer = keySigner
+	server.filter.EnableTx = true
+	keys, filter := server.config()
+	server.SetReload(func() ([]Key, OperationFilter, error) {
+		return append([]Key{}, keys...), filter, nil
+	}, nil, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if status, body := testPostProxy(server, testSecp256k1Transfer); status != http.StatusOK {
+					log.Printf("Expected requests during reloads to succeed, got %v: %v\n", status, body)
+					t.Fail()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				server.reloadConfig()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reload")
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "keys.yaml")
+	ioutil.WriteFile(file, []byte("- Name: baker\n  PublicKey: "+testP256Transfer.PublicKey+"\n"), 0600)
+
+	server := getTestServer("tz123")
+	server.SetReload(func() ([]Key, OperationFilter, error) {
+		keys, err := LoadKeyFile(file)
+		return keys, OperationFilter{}, err
+	}, []string{file}, 10*time.Millisecond)
+	go server.watchFiles()
+
+	// Give the watcher time to record the file before changing it
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(file, []byte("- Name: payouts\n  PublicKey: "+testSecp256k1Transfer.PublicKey+"\n"), 0600)
+	for i := 0; i < 100 && testGetKey(server, testSecp256k1Transfer.PublicKeyHash) != http.StatusOK; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if testGetKey(server, testSecp256k1Transfer.PublicKeyHash) != http.StatusOK || testGetKey(server, "tz123") != http.StatusNotFound {
+		log.Println("Expected the changed key file to be reloaded")
+		t.Fail()
+	}
+}
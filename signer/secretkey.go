@@ -0,0 +1,177 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation parameters of octez encrypted secret keys, from:
+// https://gitlab.com/tezos/tezos/blob/master/src/lib_signer_backends/encrypted.ml
+const (
+	encryptedSaltLength = 8
+	encryptedIterations = 32768
+)
+
+// ErrWrongPassphrase is returned when an encrypted secret key can't be decrypted
+var ErrWrongPassphrase = errors.New("unable to decrypt secret key, is the passphrase correct?")
+
+// secretKey is a private key held in memory
+type secretKey struct {
+	curve     int
+	publicKey string
+	sign      func(digest []byte) ([]byte, error)
+}
+
+// parseSecretKey decodes an unencrypted edsk, spsk or p2sk encoded secret key.
+// Ed25519 keys may be either the 32 byte seed or the 64 byte seed and public key.
+func parseSecretKey(encoded string) (*secretKey, error) {
+	var curve int
+	var prefixHex string
+	switch {
+	case strings.HasPrefix(encoded, "edsk") && len(encoded) == 98:
+		curve, prefixHex = curveEd25519, tzEd25519SecretKey
+	case strings.HasPrefix(encoded, "edsk"):
+		curve, prefixHex = curveEd25519, tzEd25519Seed
+	case strings.HasPrefix(encoded, "spsk"):
+		curve, prefixHex = curveSecp256k1, tzSecp256k1SecretKey
+	case strings.HasPrefix(encoded, "p2sk"):
+		curve, prefixHex = curveNistP256, tzP256SecretKey
+	default:
+		return nil, errors.New("unknown secret key type")
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	raw, err := b58CheckDecode(prefix, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if prefixHex != tzEd25519SecretKey {
+		return newSecretKey(curve, raw)
+	}
+
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("secret key is %v bytes, expected %v", len(raw), ed25519.PrivateKeySize)
+	}
+	key, err := newSecretKey(curve, raw[:ed25519.SeedSize])
+	if err != nil {
+		return nil, err
+	}
+	if key.publicKey != encodePublicKey(tzEd25519PublicKey, raw[ed25519.SeedSize:]) {
+		return nil, errors.New("secret key does not match its public key")
+	}
+	return key, nil
+}
+
+// decryptSecretKey decrypts an edesk, spesk or p2esk encoded secret key.  The
+// key is encrypted with secretbox and a zero nonce, using a key derived from
+// the passphrase with PBKDF2-HMAC-SHA512.
+func decryptSecretKey(encrypted string, passphrase []byte) (*secretKey, error) {
+	var curve int
+	var prefixHex string
+	switch {
+	case strings.HasPrefix(encrypted, "edesk"):
+		curve, prefixHex = curveEd25519, tzEd25519EncryptedSeed
+	case strings.HasPrefix(encrypted, "spesk"):
+		curve, prefixHex = curveSecp256k1, tzSecp256k1EncryptedSecretKey
+	case strings.HasPrefix(encrypted, "p2esk"):
+		curve, prefixHex = curveNistP256, tzP256EncryptedSecretKey
+	default:
+		return nil, errors.New("unknown encrypted secret key type")
+	}
+	prefix, _ := hex.DecodeString(prefixHex)
+	raw, err := b58CheckDecode(prefix, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != encryptedSaltLength+32+secretbox.Overhead {
+		return nil, fmt.Errorf("encrypted secret key is %v bytes, expected %v", len(raw), encryptedSaltLength+32+secretbox.Overhead)
+	}
+
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], pbkdf2.Key(passphrase, raw[:encryptedSaltLength], encryptedIterations, 32, sha512.New))
+	decrypted, ok := secretbox.Open(nil, raw[encryptedSaltLength:], &nonce, &key)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+	return newSecretKey(curve, decrypted)
+}
+
+// newSecretKey from an ed25519 seed or a secp256k1 or p256 scalar
+func newSecretKey(curve int, raw []byte) (*secretKey, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("secret key is %v bytes, expected 32", len(raw))
+	}
+	switch curve {
+	case curveEd25519:
+		privateKey := ed25519.NewKeyFromSeed(raw)
+		return &secretKey{
+			curve:     curve,
+			publicKey: encodePublicKey(tzEd25519PublicKey, privateKey.Public().(ed25519.PublicKey)),
+			sign: func(digest []byte) ([]byte, error) {
+				return ed25519.Sign(privateKey, digest), nil
+			},
+		}, nil
+	case curveSecp256k1:
+		if err := validateScalar(btcec.S256(), raw); err != nil {
+			return nil, err
+		}
+		privateKey, publicKey := btcec.PrivKeyFromBytes(btcec.S256(), raw)
+		return &secretKey{
+			curve:     curve,
+			publicKey: encodePublicKey(tzSecp256k1PublicKey, publicKey.SerializeCompressed()),
+			sign: func(digest []byte) ([]byte, error) {
+				sig, err := privateKey.Sign(digest)
+				if err != nil {
+					return nil, err
+				}
+				return append(leftPad(sig.R.Bytes(), 32), leftPad(sig.S.Bytes(), 32)...), nil
+			},
+		}, nil
+	case curveNistP256:
+		if err := validateScalar(elliptic.P256(), raw); err != nil {
+			return nil, err
+		}
+		privateKey := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(raw)}
+		privateKey.PublicKey.Curve = elliptic.P256()
+		privateKey.PublicKey.X, privateKey.PublicKey.Y = elliptic.P256().ScalarBaseMult(raw)
+		publicKey := elliptic.MarshalCompressed(elliptic.P256(), privateKey.PublicKey.X, privateKey.PublicKey.Y)
+		return &secretKey{
+			curve:     curve,
+			publicKey: encodePublicKey(tzP256PublicKey, publicKey),
+			sign: func(digest []byte) ([]byte, error) {
+				r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest)
+				if err != nil {
+					return nil, err
+				}
+				return append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...), nil
+			},
+		}, nil
+	}
+	return nil, errors.New("unknown curve")
+}
+
+// validateScalar checks that a private key is in the range [1, n)
+func validateScalar(curve elliptic.Curve, raw []byte) error {
+	d := new(big.Int).SetBytes(raw)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return errors.New("secret key is out of range for its curve")
+	}
+	return nil
+}
+
+func encodePublicKey(prefixHex string, raw []byte) string {
+	prefix, _ := hex.DecodeString(prefixHex)
+	return b58CheckEncode(prefix, raw)
+}
@@ -0,0 +1,172 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptTestSecretKey encrypts a secret key the way octez client does
+func encryptTestSecretKey(prefixHex string, raw []byte, passphrase []byte) string {
+	salt := bytes.Repeat([]byte{0x2a}, encryptedSaltLength)
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], pbkdf2.Key(passphrase, salt, encryptedIterations, 32, sha512.New))
+	prefix, _ := hex.DecodeString(prefixHex)
+	return b58CheckEncode(prefix, secretbox.Seal(salt, raw, &nonce, &key))
+}
+
+type testSecretKey struct {
+	Name      string
+	Encrypted string
+	PublicKey string
+}
+
+func getTestSecretKeys(passphrase []byte) []testSecretKey {
+	_, client := getTestAuthorizedKey(1)
+	return []testSecretKey{
+		{
+			Name:      "ed25519",
+			Encrypted: encryptTestSecretKey(tzEd25519EncryptedSeed, bytes.Repeat([]byte{0x01}, 32), passphrase),
+			PublicKey: client.PublicKey,
+		},
+		{
+			Name:      "secp256k1",
+			Encrypted: encryptTestSecretKey(tzSecp256k1EncryptedSecretKey, bytes.Repeat([]byte{0x01}, 32), passphrase),
+			PublicKey: testSecp256k1Transfer.PublicKey,
+		},
+		{
+			Name:      "p256",
+			Encrypted: encryptTestSecretKey(tzP256EncryptedSecretKey, bytes.Repeat([]byte{0x02}, 32), passphrase),
+			PublicKey: testP256Transfer.PublicKey,
+		},
+	}
+}
+
+func TestDecryptSecretKey(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	for _, test := range getTestSecretKeys(passphrase) {
+		key, err := decryptSecretKey(test.Encrypted, passphrase)
+		if err != nil {
+			log.Printf("%v: Unable to decrypt %v: %v\n", test.Name, test.Encrypted, err)
+			t.Fail()
+			continue
+		}
+		if key.publicKey != test.PublicKey {
+			log.Printf("%v: Expected public key %v, got %v\n", test.Name, test.PublicKey, key.publicKey)
+			t.Fail()
+		}
+		if _, err = decryptSecretKey(test.Encrypted, []byte("wrong")); err != ErrWrongPassphrase {
+			log.Printf("%v: Expected the wrong passphrase to fail, got %v\n", test.Name, err)
+			t.Fail()
+		}
+	}
+
+	invalid := []string{
+		"edsk3QoqBuvdamxouPhin7swCvkQNgq4jP5KZPbwWNnwdZpSpJiEbq",
+		"edesk1111111111111",
+		encryptTestSecretKey(tzP256EncryptedSecretKey, make([]byte, 32), passphrase),
+		encryptTestSecretKey(tzEd25519EncryptedSeed, make([]byte, 64), passphrase),
+	}
+	for _, encrypted := range invalid {
+		if _, err := decryptSecretKey(encrypted, passphrase); err == nil {
+			log.Printf("Expected an error decrypting %v\n", encrypted)
+			t.Fail()
+		}
+	}
+}
+
+func TestLoadSecretKeyFile(t *testing.T) {
+	passphrase := []byte("passphrase")
+	tests := getTestSecretKeys(passphrase)
+	entries := ""
+	for i, test := range tests {
+		if i > 0 {
+			entries += ","
+		}
+		entries += fmt.Sprintf("{\"name\":%q,\"value\":\"encrypted:%v\"}", test.Name, test.Encrypted)
+	}
+	dir, _ := ioutil.TempDir("", "secret-keys")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret_keys")
+	ioutil.WriteFile(file, []byte("["+entries+"]"), 0600)
+
+	signer, err := LoadSecretKeyFile(file, passphrase)
+	if err != nil {
+		log.Println("Unable to load secret keys:", err)
+		t.FailNow()
+	}
+	op, _ := ParseOperation([]byte(testAttestation.Operation))
+	for _, test := range tests {
+		pkh, _ := publicKeyHash(test.PublicKey)
+		if _, err := op.TzSign(context.Background(), signer, &Key{PublicKeyHash: pkh, PublicKey: test.PublicKey}); err != nil {
+			log.Printf("%v: Unable to sign: %v\n", test.Name, err)
+			t.Fail()
+		}
+	}
+	if _, err := signer.Sign(context.Background(), op.Digest(), &Key{PublicKeyHash: testEndorse.PublicKeyHash}); err == nil {
+		log.Println("Expected an error signing with an unknown key")
+		t.Fail()
+	}
+
+	if _, err := LoadSecretKeyFile(file, []byte("wrong")); err == nil {
+		log.Println("Expected an error loading secret keys with the wrong passphrase")
+		t.Fail()
+	}
+}
+
+// getTestUnencryptedSecretKeys returns the test keys as edsk, spsk and p2sk
+func getTestUnencryptedSecretKeys() []string {
+	return []string{
+		encodePublicKey(tzEd25519Seed, bytes.Repeat([]byte{0x01}, 32)),
+		encodePublicKey(tzSecp256k1SecretKey, bytes.Repeat([]byte{0x01}, 32)),
+		encodePublicKey(tzP256SecretKey, bytes.Repeat([]byte{0x02}, 32)),
+	}
+}
+
+func TestParseSecretKey(t *testing.T) {
+	privateKey, client := getTestAuthorizedKey(1)
+	expected := []string{client.PublicKey, testSecp256k1Transfer.PublicKey, testP256Transfer.PublicKey}
+	secretKeys := append(getTestUnencryptedSecretKeys(), encodePublicKey(tzEd25519SecretKey, privateKey))
+	expected = append(expected, client.PublicKey)
+
+	for i, encoded := range secretKeys {
+		key, err := parseSecretKey(encoded)
+		if err != nil {
+			log.Printf("Unable to parse %v: %v\n", encoded, err)
+			t.Fail()
+			continue
+		}
+		if key.publicKey != expected[i] {
+			log.Printf("Expected %v to have public key %v, got %v\n", encoded, expected[i], key.publicKey)
+			t.Fail()
+		}
+	}
+
+	// The public key half of a 64 byte edsk must match its seed
+	otherKey, _ := getTestAuthorizedKey(2)
+	mismatched := append(append([]byte{}, privateKey[:32]...), otherKey[32:]...)
+	invalid := []string{
+		encodePublicKey(tzEd25519SecretKey, mismatched),
+		encodePublicKey(tzSecp256k1SecretKey, make([]byte, 32)),
+		encodePublicKey(tzP256SecretKey, bytes.Repeat([]byte{0xff}, 32)),
+		encodePublicKey(tzP256SecretKey, make([]byte, 31)),
+		"edesk1111111111111",
+	}
+	for _, encoded := range invalid {
+		if _, err := parseSecretKey(encoded); err == nil {
+			log.Printf("Expected an error parsing %v\n", encoded)
+			t.Fail()
+		}
+	}
+}
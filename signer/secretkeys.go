@@ -0,0 +1,85 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// secretKeyEntry is an entry of an octez client secret_keys file
+type secretKeyEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// secretKeySigner signs with secret keys held in memory, by public key hash
+type secretKeySigner struct {
+	keys map[string]*secretKey
+}
+
+var _ Signer = &secretKeySigner{}
+
+// NewSecretKeySigner creates a signer holding unencrypted edsk, spsk and p2sk
+// secret keys in memory.  Each key signs for its own public key hash.  It is
+// not suitable for production use.
+func NewSecretKeySigner(secretKeys []string) (Signer, error) {
+	signer := &secretKeySigner{keys: map[string]*secretKey{}}
+	for i, encoded := range secretKeys {
+		key, err := parseSecretKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret key %v: %v", i, err)
+		}
+		signer.add(key)
+	}
+	return signer, nil
+}
+
+// LoadSecretKeyFile creates a signer from an octez client secret_keys file,
+// such as ~/.tezos-client/secret_keys.  Encrypted edesk, spesk and p2esk keys
+// are decrypted with the passphrase, and unencrypted keys are used as is.
+// Keys are held in memory, so this is meant for testnets and CI rather than
+// production bakers.
+func LoadSecretKeyFile(file string, passphrase []byte) (Signer, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file %v: %v", file, err)
+	}
+	entries := []secretKeyEntry{}
+	if err = json.Unmarshal(contents, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse secret key file %v: %v", file, err)
+	}
+
+	signer := &secretKeySigner{keys: map[string]*secretKey{}}
+	for _, entry := range entries {
+		var key *secretKey
+		if strings.HasPrefix(entry.Value, "unencrypted:") {
+			key, err = parseSecretKey(strings.TrimPrefix(entry.Value, "unencrypted:"))
+		} else {
+			key, err = decryptSecretKey(strings.TrimPrefix(entry.Value, "encrypted:"), passphrase)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret key %v: %v", entry.Name, err)
+		}
+		log.Printf("Loaded secret key %v for %v\n", entry.Name, signer.add(key))
+	}
+	return signer, nil
+}
+
+// add a key, returning its public key hash
+func (s *secretKeySigner) add(key *secretKey) string {
+	pkh, _ := publicKeyHash(key.publicKey)
+	s.keys[pkh] = key
+	return pkh
+}
+
+// Sign with the secret key of the key's public key hash
+func (s *secretKeySigner) Sign(_ context.Context, message []byte, key *Key) ([]byte, error) {
+	secret, ok := s.keys[key.PublicKeyHash]
+	if !ok {
+		return nil, fmt.Errorf("no secret key for %v", key.PublicKeyHash)
+	}
+	return secret.sign(message)
+}
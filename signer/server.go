@@ -1,36 +1,77 @@
 package signer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/gracenoah/tezos-hsm-signer/signer/spending"
 	"github.com/gracenoah/tezos-hsm-signer/signer/watermark"
 )
 
 // Server holds all configuration data from the signer
 type Server struct {
 	signer     Signer
-	keys       []Key
 	bindString string
-	filter     OperationFilter
 	watermark  watermark.Watermark
+	spending   spending.Ledger
+
+	// Keys and the global filter are replaced together when reloaded
+	configMux sync.RWMutex
+	keys      []Key
+	filter    OperationFilter
+	// Reload keys and the global filter, if set
+	reload *reloadConfig
+
+	// Clients allowed to request signatures.  Empty disables authentication
+	authorizedKeys []AuthorizedKey
+	// Serve over TLS with these certificates, if set
+	tls *certReloader
+	// Unix socket settings when bound to unix:/path/to/socket
+	socket SocketConfig
 }
 
 // NewServer returns a new server
-func NewServer(signer Signer, keys []Key, bindString string, filter OperationFilter, watermark watermark.Watermark) *Server {
+func NewServer(signer Signer, keys []Key, bindString string, filter OperationFilter, watermark watermark.Watermark, spending spending.Ledger) *Server {
 	return &Server{
 		signer:     signer,
 		keys:       keys,
 		bindString: bindString,
 		filter:     filter,
 		watermark:  watermark,
+		spending:   spending,
+		socket:     DefaultSocketConfig,
+	}
+}
+
+// SetAuthorizedKeys requires sign requests to be authenticated by one of these keys
+func (server *Server) SetAuthorizedKeys(keys []AuthorizedKey) {
+	server.authorizedKeys = keys
+}
+
+// SetTLS serves the signer over TLS, and requires client certificates if a
+// client CA is configured.  Certificates are reloaded on SIGHUP.
+func (server *Server) SetTLS(config TLSConfig) error {
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return err
 	}
+	server.tls = reloader
+	return nil
+}
+
+// SetSocketConfig sets the mode, owner and allowed peers of the unix socket
+func (server *Server) SetSocketConfig(config SocketConfig) {
+	server.socket = config
 }
 
 // Middleware sets content type and log path for all requests
@@ -56,22 +97,37 @@ func RouteUnmatched(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// RouteAuthorizedKeys list all of they keys that we currently support.  We choose to
-// return an empty set to obscure our secrets.
+// RouteAuthorizedKeys lists the public key hashes of clients allowed to request
+// signatures.  An empty set tells clients that no authentication is required.
 func (server *Server) RouteAuthorizedKeys(w http.ResponseWriter, r *http.Request) {
 	// Route: /authorized_keys
-	// Response Body: `{}`
+	// Response Body: `{}` or `{"authorized_keys": ["<pkh>", ...]}`
 	// Status: 200
 	// mimetype: "application/json"
-	fmt.Fprintf(w, "{}")
+	if len(server.authorizedKeys) == 0 {
+		fmt.Fprintf(w, "{}")
+		return
+	}
+
+	response := struct {
+		AuthorizedKeys []string `json:"authorized_keys"`
+	}{}
+	for _, key := range server.authorizedKeys {
+		response.AuthorizedKeys = append(response.AuthorizedKeys, key.PublicKeyHash())
+	}
+	body, _ := json.Marshal(response)
+	w.Write(body)
 }
 
 // RouteKeys validates a /key/ request and routes based on HTTP Method
 func (server *Server) RouteKeys(w http.ResponseWriter, r *http.Request) {
 	requestedKeyHash := strings.Split(r.URL.Path, "/")[2]
 
+	// Use the same snapshot of the configuration for the whole request, even
+	// if it is reloaded in the meantime
+	keys, filter := server.config()
 	var key *Key
-	for _, k := range server.keys {
+	for _, k := range keys {
 		if k.PublicKeyHash == requestedKeyHash {
 			key = &k
 			break
@@ -91,7 +147,7 @@ func (server *Server) RouteKeys(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		server.RouteKeysGET(w, r, key)
 	case "POST":
-		server.RouteKeysPOST(w, r, key)
+		server.RouteKeysPOST(w, r, key, &filter)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "{\"error\":\"bad_verb\"}")
@@ -107,8 +163,9 @@ func (server *Server) RouteKeysGET(w http.ResponseWriter, r *http.Request, key *
 	fmt.Fprintf(w, "{\"public_key\":\"%s\"}", key.PublicKey)
 }
 
-// RouteKeysPOST attempts to sign the provided message from the provided keys
-func (server *Server) RouteKeysPOST(w http.ResponseWriter, r *http.Request, key *Key) {
+// RouteKeysPOST attempts to sign the provided message from the provided keys,
+// applying the key's policy or else the global filter
+func (server *Server) RouteKeysPOST(w http.ResponseWriter, r *http.Request, key *Key, globalFilter *OperationFilter) {
 	// Route: /keys/<key>
 	// Method: POST
 	// Response Body: `{"signature": "p2sig....."}`
@@ -130,25 +187,78 @@ func (server *Server) RouteKeysPOST(w http.ResponseWriter, r *http.Request, key
 	op, err := ParseOperation(body)
 	if err != nil {
 		log.Println("Error parsing signing request: ", err)
+		signRequests.WithLabelValues(key.PublicKeyHash, "", "unknown", resultError).Inc()
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "{\"error\":\"%s\"}", "error signing the request")
 		return
 	}
 
-	// Fail if the opType is disallowed
-	if !server.filter.IsAllowed(op) {
+	// Fail if the unix socket peer is not one of the allowed users or groups
+	if !server.socket.isPeerAllowed(r.Context()) {
+		log.Println("Error, socket peer is not allowed")
+		observeSignRequest(key, op, resultUnauthorized)
+
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "{\"error\":\"%s\"}", "request is not authorized")
+		return
+	}
+
+	// Fail if the key only accepts requests from certain client certificates
+	if !isClientAllowed(key, r.TLS) {
+		log.Println("Error, client certificate is not allowed for this key")
+		observeSignRequest(key, op, resultUnauthorized)
+
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "{\"error\":\"%s\"}", "request is not authorized")
+		return
+	}
+
+	// Fail if authentication is required and the request isn't signed by an authorized key
+	if len(server.authorizedKeys) > 0 {
+		client, err := authenticate(server.authorizedKeys, key, op.Hex(), r.URL.Query().Get("authentication"))
+		if err != nil {
+			log.Println("Error authenticating request:", err)
+			observeSignRequest(key, op, resultUnauthorized)
+
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\":\"%s\"}", "request is not authorized")
+			return
+		}
+		debugln("Request authenticated by: ", client.Name)
+	}
+
+	// Fail if the opType is disallowed by the key's policy
+	filter := key.Filter(globalFilter)
+	if !filter.IsAllowed(op) {
 		// Disallow transactions unless specifically enabled
 		log.Println("Error, operation is blocked by filter")
+		observeSignRequest(key, op, resultFiltered)
 
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "{\"error\":\"%s\"}", "operation blocked by filter")
 		return
 	}
 
+	// Fail if this would exceed the key's spend limits.  Spends are reserved now
+	// and only count towards the limits once the operation is signed
+	var reservation *spending.Reservation
+	if limits := filter.spendLimits(); len(limits) > 0 && op.MagicByte() == opMagicByteGeneric {
+		reservation, err = server.reserveSpends(key, op, limits)
+		if err != nil {
+			log.Println("Error reserving spend:", err)
+			observeSignRequest(key, op, resultSpendRefused)
+
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "{\"error\":\"%s\"}", "spend limit exceeded")
+			return
+		}
+	}
+
 	// Fail if not a generic operation and the watermark is unsafe
-	if op.MagicByte() != opMagicByteGeneric && !server.watermark.IsSafeToSign(key.PublicKeyHash, op.ChainID(), op.MagicByte(), op.Level()) {
+	if op.MagicByte() != opMagicByteGeneric && !server.watermark.IsSafeToSign(key.PublicKeyHash, op.ChainID(), op.MagicByte(), op.Level(), op.Round(), op.Digest()) {
 		log.Println("Could not safely sign at this level")
+		observeSignRequest(key, op, resultWatermarkRefused)
 
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "{\"error\":\"%s\"}", "could not safely sign at this level")
@@ -157,32 +267,109 @@ func (server *Server) RouteKeysPOST(w http.ResponseWriter, r *http.Request, key
 
 	// Sign the operation
 	signed, err := op.TzSign(r.Context(), server.signer, key)
-	if err != nil {
+	if reservation != nil {
+		server.settleSpends(reservation, err == nil)
+	}
+	if errors.Is(err, ErrSignatureVerification) {
+		log.Println("Refusing to return an unverified signature:", err)
+		observeSignRequest(key, op, resultUnverified)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{\"error\":\"%s\"}", "signature verification failed")
+	} else if err != nil {
 		log.Println("Error signing request:", err)
+		observeSignRequest(key, op, resultError)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "{\"error\":\"%s\"}", "error signing the request")
 	} else {
 		response := fmt.Sprintf("{\"signature\":\"%s\"}", signed)
 		log.Println("Returning signed message: ", response)
+		observeSignRequest(key, op, resultSigned)
+		if op.MagicByte() != opMagicByteGeneric {
+			observeWatermark(key, op)
+		}
+
+		fmt.Fprint(w, response)
+	}
+}
+
+// reserveSpends of a generic operation against the key's limits
+func (server *Server) reserveSpends(key *Key, op *Operation, limits []spending.Limit) (*spending.Reservation, error) {
+	spends, err := operationSpends(op)
+	if err != nil {
+		return nil, err
+	}
+	return server.spending.Reserve(key.PublicKeyHash, spends, limits)
+}
 
-		fmt.Fprintf(w, response)
+// settleSpends commits the reservation if the operation was signed and releases it otherwise
+func (server *Server) settleSpends(reservation *spending.Reservation, signed bool) {
+	if !signed {
+		server.spending.Release(reservation)
+		return
+	}
+	if err := server.spending.Commit(reservation); err != nil {
+		log.Println("Error recording spend:", err)
 	}
 }
 
 // shutdown gracefully
-func shutdown(c chan os.Signal) {
+func (server *Server) shutdown(c chan os.Signal) {
 	<-c
 	log.Println("Shutting down")
+	if path, ok := socketPath(server.bindString); ok {
+		os.Remove(path)
+	}
 	os.Exit(0)
 }
 
+// listen on the bind string, either host:port or unix:/path/to/socket
+func (server *Server) listen() (net.Listener, error) {
+	path, isUnix := socketPath(server.bindString)
+	if len(server.socket.AllowedUIDs) > 0 || len(server.socket.AllowedGIDs) > 0 {
+		if !isUnix {
+			return nil, errors.New("socket peers can only be checked when bound to a unix socket")
+		}
+		if !peerCredentialsSupported {
+			return nil, errPeerCredentialsUnsupported
+		}
+	}
+	if isUnix {
+		return listenUnix(path, server.socket)
+	}
+	return net.Listen("tcp", server.bindString)
+}
+
+// reloadOnHangup reloads TLS certificates and the configuration whenever the
+// process receives SIGHUP
+func (server *Server) reloadOnHangup(c chan os.Signal) {
+	for range c {
+		if server.tls != nil {
+			log.Println("Received SIGHUP, reloading TLS certificates")
+			if err := server.tls.reload(); err != nil {
+				log.Println("Error reloading TLS certificates, keeping the current ones:", err)
+			}
+		}
+		if server.reload != nil {
+			log.Println("Received SIGHUP, reloading configuration")
+			if err := server.reloadConfig(); err != nil {
+				log.Println("Error reloading configuration, keeping the current one:", err)
+			}
+		}
+	}
+}
+
 // Serve our routes
 func (server *Server) Serve() {
 	// Handle Sigterm
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go shutdown(c)
+	go server.shutdown(c)
+
+	if err := server.validateKeys(server.keys); err != nil {
+		log.Fatal(err)
+	}
 
 	// Routes
 	http.HandleFunc("/", Middleware(RouteUnmatched))
@@ -190,6 +377,24 @@ func (server *Server) Serve() {
 	http.HandleFunc("/keys/", Middleware(server.RouteKeys))
 
 	// Serve
+	listener, err := server.listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.tls != nil || server.reload != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go server.reloadOnHangup(hup)
+	}
+	if server.reload != nil && server.reload.interval > 0 {
+		go server.watchFiles()
+	}
+	httpServer := &http.Server{ConnContext: connContext}
+	if server.tls != nil {
+		httpServer.TLSConfig = server.tls.tlsConfig()
+		log.Println("Listening with TLS on:", server.bindString)
+		log.Fatal(httpServer.ServeTLS(listener, "", ""))
+	}
 	log.Println("Listening on:", server.bindString)
-	log.Fatal(http.ListenAndServe(server.bindString, nil))
+	log.Fatal(httpServer.Serve(listener))
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,8 +14,12 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gracenoah/tezos-hsm-signer/signer/spending"
 	"github.com/gracenoah/tezos-hsm-signer/signer/watermark"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
 )
 
 type testSigner struct {
@@ -21,6 +27,10 @@ type testSigner struct {
 }
 
 func (signer *testSigner) Sign(_ context.Context, message []byte, key *Key) ([]byte, error) {
+	// Mimic an HSM error when no response is configured
+	if len(signer.SignedBytes) == 0 {
+		return nil, errors.New("no signature")
+	}
 	return signer.SignedBytes, nil
 }
 
@@ -40,6 +50,7 @@ func getTestServer(pkh string) *Server {
 			EnableTx: false,
 		},
 		watermark: watermark.GetSessionWatermark(),
+		spending:  spending.GetSessionLedger(),
 	}
 }
 
@@ -127,7 +138,77 @@ func TestAuthorizedKeys(t *testing.T) {
 	}
 }
 
+// getTestAuthorizedKey returns a deterministic client key and its authorized entry
+func getTestAuthorizedKey(seed byte) (ed25519.PrivateKey, AuthorizedKey) {
+	privateKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	prefix, _ := hex.DecodeString(tzEd25519PublicKey)
+	publicKey := b58CheckEncode(prefix, privateKey.Public().(ed25519.PublicKey))
+	pkh, _ := publicKeyHash(publicKey)
+	return privateKey, AuthorizedKey{
+		Name:          "client",
+		PublicKey:     publicKey,
+		publicKeyHash: pkh,
+	}
+}
+
+// authenticateTestRequest signs a request the way tezos-client does
+func authenticateTestRequest(privateKey ed25519.PrivateKey, test testOperation) string {
+	pkh, _ := publicKeyHashBytes(test.PublicKeyHash)
+	data, _ := hex.DecodeString(strings.Trim(test.Operation, "\""))
+	msg := append(append([]byte{authMagicByte}, pkh...), data...)
+	digest := blake2b.Sum256(msg)
+	prefix, _ := hex.DecodeString(tzEd25519Signature)
+	return b58CheckEncode(prefix, ed25519.Sign(privateKey, digest[:]))
+}
+
+func TestAuthorizedKeysConfigured(t *testing.T) {
+	// Test: GET /authorized_keys
+	// Configured clients should be returned by public key hash
+	_, client := getTestAuthorizedKey(1)
+	server := getTestServer("tz123")
+	server.SetAuthorizedKeys([]AuthorizedKey{client})
+
+	r := httptest.NewRequest("GET", "/authorized_keys", strings.NewReader(""))
+	w := httptest.NewRecorder()
+	Middleware(server.RouteAuthorizedKeys)(w, r)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+
+	expected := "{\"authorized_keys\":[\"" + client.PublicKeyHash() + "\"]}"
+	if string(body) != expected {
+		log.Println("TestAuthorizedKeysConfigured: Expected: ", expected)
+		log.Println("Received: ", string(body))
+		t.Fail()
+	}
+}
+
+func TestPostAuthenticated(t *testing.T) {
+	privateKey, client := getTestAuthorizedKey(1)
+	otherKey, _ := getTestAuthorizedKey(2)
+
+	// Unauthenticated requests should be rejected
+	server := getTestServer("tz123")
+	server.SetAuthorizedKeys([]AuthorizedKey{client})
+	resp, body := testPost(t, server, testEndorseLevel259938)
+	compare(t, "Missing Authentication", resp.StatusCode, http.StatusUnauthorized, body, testEndorseLevel259938.SignerResponse)
+
+	// Requests signed by an unknown key should be rejected
+	resp, body = testPostAuthenticated(t, server, testEndorseLevel259938, authenticateTestRequest(otherKey, testEndorseLevel259938))
+	compare(t, "Unknown Authentication", resp.StatusCode, http.StatusUnauthorized, body, testEndorseLevel259938.SignerResponse)
+
+	// Signatures over a different request should be rejected
+	resp, body = testPostAuthenticated(t, server, testEndorseLevel259938, authenticateTestRequest(privateKey, testEndorseLevel259939))
+	compare(t, "Mismatched Authentication", resp.StatusCode, http.StatusUnauthorized, body, testEndorseLevel259938.SignerResponse)
+
+	// Requests signed by an authorized key should succeed
+	resp, body = testPostAuthenticated(t, server, testEndorseLevel259938, authenticateTestRequest(privateKey, testEndorseLevel259938))
+	compare(t, "Valid Authentication", resp.StatusCode, http.StatusOK, body, testEndorseLevel259938.SignerResponse)
+}
+
 func testPost(t *testing.T, server *Server, test testOperation) (*http.Response, string) {
+	return testPostAuthenticated(t, server, test, "")
+}
+
+func testPostAuthenticated(t *testing.T, server *Server, test testOperation, authentication string) (*http.Response, string) {
 	// Test: POST /keys/<valid key>
 	// A correctly signed JSON payload should be returned
 
@@ -136,10 +217,14 @@ func testPost(t *testing.T, server *Server, test testOperation) (*http.Response,
 		SignedBytes: signedBytes,
 	}
 	server.keys[0].PublicKeyHash = test.PublicKeyHash
+	server.keys[0].PublicKey = test.PublicKey
 
 	// Mock the request
 	postBytes := bytes.NewReader([]byte(test.Operation))
 	postPath := fmt.Sprintf("/keys/%v", test.PublicKeyHash)
+	if len(authentication) > 0 {
+		postPath += "?authentication=" + authentication
+	}
 	r := httptest.NewRequest("POST", postPath, postBytes)
 	w := httptest.NewRecorder()
 
@@ -168,16 +253,34 @@ func TestPostTx(t *testing.T) {
 	server := getTestServer("tz123")
 
 	server.filter.EnableTx = true
-	resp, body := testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 Tx Enabled", resp.StatusCode, http.StatusOK, body, testSecp256k1Tx.SignerResponse)
-	resp, body = testPost(t, server, testP256Tx)
-	compare(t, "p256 Tx Enabled", resp.StatusCode, http.StatusOK, body, testP256Tx.SignerResponse)
+	resp, body := testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Tx Enabled", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+	resp, body = testPost(t, server, testP256Transfer)
+	compare(t, "p256 Tx Enabled", resp.StatusCode, http.StatusOK, body, testP256Transfer.SignerResponse)
 
 	server.filter.EnableTx = false
-	resp, body = testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 Tx Disabled", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Tx.SignerResponse)
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Tx Disabled", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Transfer.SignerResponse)
+	resp, body = testPost(t, server, testP256Transfer)
+	compare(t, "P256 Tx Disabled", resp.StatusCode, http.StatusForbidden, body, testP256Transfer.SignerResponse)
+}
+
+func TestPostLegacyTx(t *testing.T) {
+	server := getTestServer("tz123")
+
+	// Pre-Babylon transactions can't be decoded, so they are never allowed as transactions
+	server.filter.EnableTx = true
+	resp, body := testPost(t, server, testSecp256k1Tx)
+	compare(t, "Legacy Secp256k1 Tx", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Tx.SignerResponse)
 	resp, body = testPost(t, server, testP256Tx)
-	compare(t, "P256 Tx Disabled", resp.StatusCode, http.StatusForbidden, body, testP256Tx.SignerResponse)
+	compare(t, "Legacy P256 Tx", resp.StatusCode, http.StatusForbidden, body, testP256Tx.SignerResponse)
+
+	// The capture still signs as a generic operation, by the key that endorsed testEndorse
+	server.filter.EnableGeneric = true
+	legacy := testSecp256k1Tx
+	legacy.PublicKey = testEndorse.PublicKey
+	resp, body = testPost(t, server, legacy)
+	compare(t, "Legacy Secp256k1 Generic", resp.StatusCode, http.StatusOK, body, testSecp256k1Tx.SignerResponse)
 }
 
 func TestPostTxWhitelist(t *testing.T) {
@@ -185,13 +288,13 @@ func TestPostTxWhitelist(t *testing.T) {
 
 	server.filter.EnableTx = true
 	server.filter.TxWhitelistAddresses = []string{"tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m"}
-	resp, body := testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 On Whitelist", resp.StatusCode, http.StatusOK, body, testSecp256k1Tx.SignerResponse)
+	resp, body := testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 On Whitelist", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
 
 	server.filter.EnableTx = false
 	server.filter.TxWhitelistAddresses = []string{"tz3fNgiRyEZeXD5eh6rEocSp8PBzii2w38Ku"}
-	resp, body = testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 Off Whitelist", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Tx.SignerResponse)
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Off Whitelist", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Transfer.SignerResponse)
 }
 
 func TestPostTxLimit(t *testing.T) {
@@ -199,21 +302,49 @@ func TestPostTxLimit(t *testing.T) {
 
 	server.filter.EnableTx = true
 	server.filter.TxDailyMax = new(big.Int).SetInt64(1500000)
-	resp, body := testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 Under Amount", resp.StatusCode, http.StatusOK, body, testSecp256k1Tx.SignerResponse)
+	resp, body := testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Under Amount", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Over  Amount", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Transfer.SignerResponse)
+}
+
+func TestPostTxLimitUnsigned(t *testing.T) {
+	server := getTestServer("tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m")
+	server.filter.EnableTx = true
+	server.filter.SpendLimits = []spending.Limit{{Window: time.Hour, Max: big.NewInt(1500000)}}
+
+	// Operations that fail to sign don't count towards the limit
+	failed := testSecp256k1Transfer
+	failed.HsmResponse = ""
+	resp, body := testPost(t, server, failed)
+	compare(t, "Secp256k1 Signing Failed", resp.StatusCode, http.StatusInternalServerError, body, "{\"error\":\"error signing the request\"}")
+
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Under Amount", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
 
-	resp, body = testPost(t, server, testSecp256k1Tx)
-	compare(t, "Secp256k1 Over  Amount", resp.StatusCode, http.StatusForbidden, body, testSecp256k1Tx.SignerResponse)
+	// Per destination limits only count transfers to that destination
+	server = getTestServer("tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m")
+	server.filter.EnableTx = true
+	server.filter.SpendLimits = []spending.Limit{{Window: time.Hour, Max: big.NewInt(999999), Destination: "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m"}}
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Secp256k1 Over Destination Limit", resp.StatusCode, http.StatusForbidden, body, "{\"error\":\"spend limit exceeded\"}")
 }
 
 func TestPostEndorse(t *testing.T) {
 	server := getTestServer("tz123")
-	// Endorsing at the same level twice should fail
+	// Endorsing a different block at the same level should fail
 	resp, body := testPost(t, server, testEndorseLevel259938)
 	compare(t, "Secp256k1 Endorse Same Level #1", resp.StatusCode, http.StatusOK, body, testEndorseLevel259938.SignerResponse)
-	resp, body = testPost(t, server, testEndorseLevel259938)
+	conflicting := testEndorseLevel259938
+	conflicting.Operation = strings.Replace(testEndorseLevel259938.Operation, "027a06a7706ed859dc", "027a06a7706ed859dd", 1)
+	resp, body = testPost(t, server, conflicting)
 	compare(t, "Secp256k1 Endorse Same Level #2", resp.StatusCode, http.StatusForbidden, body, testEndorseLevel259938.SignerResponse)
 
+	// Retrying the exact same endorsement should succeed
+	resp, body = testPost(t, server, testEndorseLevel259938)
+	compare(t, "Secp256k1 Endorse Retry", resp.StatusCode, http.StatusOK, body, testEndorseLevel259938.SignerResponse)
+
 	server = getTestServer("tz123")
 	// Endorsing at the same level twice should fail
 	resp, body = testPost(t, server, testEndorseLevel259939)
@@ -228,3 +359,130 @@ func TestPostEndorse(t *testing.T) {
 	resp, body = testPost(t, server, testEndorseLevel259939)
 	compare(t, "Secp256k1 Endorse Lower Level #2", resp.StatusCode, http.StatusOK, body, testEndorseLevel259939.SignerResponse)
 }
+
+func TestPostTenderbake(t *testing.T) {
+	server := getTestServer("tz123")
+	// Tenderbake blocks and consensus operations should be signed
+	for _, test := range []testOperation{testTenderbakeBlock, testPreattestation, testAttestation} {
+		resp, body := testPost(t, server, test)
+		compare(t, fmt.Sprintf("Tenderbake %v", test.OpMagicByte), resp.StatusCode, http.StatusOK, body, test.SignerResponse)
+	}
+	// And are protected by the watermark
+	conflicting := testAttestation
+	conflicting.Operation = strings.Replace(testAttestation.Operation, "137a06a770f38c", "137a06a770f38d", 1)
+	resp, body := testPost(t, server, conflicting)
+	compare(t, "Tenderbake Attestation Same Level", resp.StatusCode, http.StatusForbidden, body, testAttestation.SignerResponse)
+}
+
+func TestPostTenderbakeRounds(t *testing.T) {
+	server := getTestServer("tz123")
+	// A higher round at the same level should be signed
+	resp, body := testPost(t, server, testAttestation)
+	compare(t, "Attestation Round 1", resp.StatusCode, http.StatusOK, body, testAttestation.SignerResponse)
+
+	lowerRound := testAttestation
+	lowerRound.Operation = strings.Replace(testAttestation.Operation, "0032dcd200000001", "0032dcd200000000", 1)
+	resp, body = testPost(t, server, lowerRound)
+	compare(t, "Attestation Round 0", resp.StatusCode, http.StatusForbidden, body, testAttestation.SignerResponse)
+
+	higherRound := testAttestation
+	higherRound.Operation = strings.Replace(testAttestation.Operation, "0032dcd200000001", "0032dcd200000002", 1)
+	higherRound = signTestOperation(higherRound)
+	resp, body = testPost(t, server, higherRound)
+	compare(t, "Attestation Round 2", resp.StatusCode, http.StatusOK, body, higherRound.SignerResponse)
+}
+
+func TestPostBatch(t *testing.T) {
+	server := getTestServer("tz123")
+	server.filter.EnableTx = true
+
+	// Reveals are allowed alongside transfers
+	batch := testSecp256k1Transfer
+	batch.Operation = "\"03ce69c5713dac3537254e7be59759cf59c15abd530d10501ccf9028a5786314cf6b0002298c03ed7d454a101eb7022bc95f7e5f41ac78f40901e8070000a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a1a16c0002298c03ed7d454a101eb7022bc95f7e5f41ac78820a02f70b8102c08db701000154f5d8f71ce18f9f05bb885a4120e64c667bc1b400\""
+	batch = signTestOperation(batch)
+	resp, body := testPost(t, server, batch)
+	compare(t, "Reveal and Transaction", resp.StatusCode, http.StatusOK, body, batch.SignerResponse)
+
+	// Every content in a batch is filtered, not only the first
+	batch.Operation = strings.TrimSuffix(batch.Operation, "\"") + "6e0002298c03ed7d454a101eb7022bc95f7e5f41ac78e90904cc0800ff0154f5d8f71ce18f9f05bb885a4120e64c667bc1b4\""
+	resp, body = testPost(t, server, batch)
+	compare(t, "Reveal, Transaction and Delegation", resp.StatusCode, http.StatusForbidden, body, batch.SignerResponse)
+}
+
+func TestPostPolicy(t *testing.T) {
+	server := getTestServer("tz123")
+	server.keys[0].Policy = &OperationFilter{AllowedKinds: []string{"transaction"}}
+
+	// The key's policy replaces the global filter
+	resp, body := testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Policy allows transaction", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+
+	server.keys[0].Policy = &OperationFilter{AllowedMagicBytes: []uint8{opMagicByteTenderbakeBlock}}
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Policy blocks transaction", resp.StatusCode, http.StatusForbidden, body, "{\"error\":\"operation blocked by filter\"}")
+
+	// Amount and destination limits apply even when generic operations are enabled
+	server.keys[0].Policy = &OperationFilter{
+		EnableGeneric:        true,
+		TxMaxAmount:          big.NewInt(1000000),
+		TxWhitelistAddresses: []string{"tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m"},
+	}
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Policy allows generic transaction", resp.StatusCode, http.StatusOK, body, testSecp256k1Transfer.SignerResponse)
+
+	server.keys[0].Policy.TxMaxAmount = big.NewInt(999999)
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Policy blocks generic transaction over max amount", resp.StatusCode, http.StatusForbidden, body, "{\"error\":\"operation blocked by filter\"}")
+
+	server.keys[0].Policy.TxMaxAmount = big.NewInt(1000000)
+	server.keys[0].Policy.TxWhitelistAddresses = []string{"tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx"}
+	resp, body = testPost(t, server, testSecp256k1Transfer)
+	compare(t, "Policy blocks generic transaction to other destination", resp.StatusCode, http.StatusForbidden, body, "{\"error\":\"operation blocked by filter\"}")
+}
+
+func TestPostSecretKeySigner(t *testing.T) {
+	// Sign with real keys of every curve, end to end
+	keySigner, err := NewSecretKeySigner(getTestUnencryptedSecretKeys())
+	if err != nil {
+		log.Println("Unable to create signer:", err)
+		t.FailNow()
+	}
+	_, client := getTestAuthorizedKey(1)
+	ed25519Tx := testSecp256k1Transfer
+	ed25519Tx.PublicKeyHash, ed25519Tx.PublicKey = client.PublicKeyHash(), client.PublicKey
+
+	for _, test := range []testOperation{testSecp256k1Transfer, testP256Transfer, ed25519Tx} {
+		server := getTestServer("tz123")
+		server.signer = keySigner
+		server.filter.EnableTx = true
+		server.keys[0].PublicKeyHash, server.keys[0].PublicKey = test.PublicKeyHash, test.PublicKey
+
+		r := httptest.NewRequest("POST", fmt.Sprintf("/keys/%v", test.PublicKeyHash), strings.NewReader(test.Operation))
+		w := httptest.NewRecorder()
+		Middleware(server.RouteKeys)(w, r)
+		resp := w.Result()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("%v: Expected status code 200, received %v: %v\n", test.PublicKeyHash, resp.StatusCode, string(body))
+			t.Fail()
+			continue
+		}
+
+		// secp256k1 and ed25519 signatures are deterministic, but p256 signatures
+		// are randomized, so check them against the key instead
+		if test.PublicKeyHash == testSecp256k1Transfer.PublicKeyHash {
+			compare(t, "Secp256k1 Secret Key", resp.StatusCode, http.StatusOK, string(body), test.SignerResponse)
+		}
+		var response struct{ Signature string }
+		json.Unmarshal(body, &response)
+		sig, err := decodeSignature(response.Signature)
+		if err == nil {
+			op, _ := ParseOperation([]byte(test.Operation))
+			err = verifySignature(test.PublicKey, op.Digest(), sig)
+		}
+		if err != nil {
+			log.Printf("%v: Invalid signature %v: %v\n", test.PublicKeyHash, string(body), err)
+			t.Fail()
+		}
+	}
+}
@@ -3,11 +3,34 @@ package signer
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
+// ErrSignatureVerification is returned when the signer's signature does not
+// verify against the key's public key, such as when a misconfigured slot or
+// label signs with the wrong key
+var ErrSignatureVerification = errors.New("signature does not verify against the public key")
+
+// RawSigner is a Signer that signs whole operations rather than their digests,
+// such as a remote signer that applies its own checks to the operation
+type RawSigner interface {
+	Signer
+	SignOperation(ctx context.Context, operation []byte, key *Key) ([]byte, error)
+}
+
+// signPayload signs the operation with a RawSigner, or its digest with any other Signer
+func signPayload(ctx context.Context, signer Signer, operation []byte, key *Key) ([]byte, error) {
+	if raw, ok := signer.(RawSigner); ok {
+		return raw.SignOperation(ctx, operation, key)
+	}
+	digest := blake2b.Sum256(operation)
+	return signer.Sign(ctx, digest[:], key)
+}
+
 // TzSign this operation with the provided Signer and Key
 func (op *Operation) TzSign(ctx context.Context, signer Signer, key *Key) (string, error) {
 	msg := op.Hex()
@@ -15,10 +38,12 @@ func (op *Operation) TzSign(ctx context.Context, signer Signer, key *Key) (strin
 	debugln("About to sign raw bytes hex.EncodeToString(bytes): ", hex.EncodeToString(msg))
 
 	// Take the 256 bit (32 Byte) Blake2b Hash of the operation
-	digest := blake2b.Sum256(msg)
+	digest := op.Digest()
 
 	// Sign
-	signedMsg, err := signer.Sign(ctx, digest[:], key)
+	start := time.Now()
+	signedMsg, err := signPayload(ctx, signer, msg, key)
+	hsmSignDuration.WithLabelValues(key.PublicKeyHash).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return "", err
 	}
@@ -30,6 +55,11 @@ func (op *Operation) TzSign(ctx context.Context, signer Signer, key *Key) (strin
 		debugln("Signed bytes StrictECModN(hex.EncodeToString(bytes)): ", hex.EncodeToString(signedMsg))
 	}
 
+	// Never return a signature from the wrong key
+	if err = verifySignature(key.PublicKey, digest, signedMsg); err != nil {
+		return "", fmt.Errorf("%w %v: %v", ErrSignatureVerification, key.PublicKey, err)
+	}
+
 	// Get the correct signature prefix
 	prefix, err := getSignaturePrefix(key)
 	if err != nil {
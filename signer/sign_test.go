@@ -0,0 +1,103 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Keys that sign the test vectors which weren't produced by tezos-client
+var (
+	testSecp256k1PrivateKey, _ = btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{0x01}, 32))
+	testP256PrivateKey         = getTestP256PrivateKey(bytes.Repeat([]byte{0x02}, 32))
+)
+
+func getTestP256PrivateKey(d []byte) *ecdsa.PrivateKey {
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = elliptic.P256().ScalarBaseMult(d)
+	return key
+}
+
+// signTestOperation signs the operation with the test key of its public key,
+// for test vectors that alter an operation
+func signTestOperation(test testOperation) testOperation {
+	op, _ := ParseOperation([]byte(test.Operation))
+	key := &Key{PublicKeyHash: test.PublicKeyHash, PublicKey: test.PublicKey}
+
+	var r, s *big.Int
+	switch key.Curve() {
+	case curveSecp256k1:
+		sig, _ := testSecp256k1PrivateKey.Sign(op.Digest())
+		r, s = sig.R, sig.S
+	case curveNistP256:
+		r, s, _ = ecdsa.Sign(rand.Reader, testP256PrivateKey, op.Digest())
+	}
+	signedBytes := StrictECModN(key, append(leftPad(r.Bytes(), 32), leftPad(s.Bytes(), 32)...))
+	prefix, _ := getSignaturePrefix(key)
+
+	test.HsmResponse = hex.EncodeToString(signedBytes)
+	test.SignerResponse = fmt.Sprintf("{\"signature\":\"%s\"}", b58CheckEncode(prefix, signedBytes))
+	return test
+}
+
+func TestTzSignVerifies(t *testing.T) {
+	tests := []testOperation{testSecp256k1Transfer, testP256Transfer, testEndorse, testBlock, testTenderbakeBlock, testAttestation}
+	for _, test := range tests {
+		op, _ := ParseOperation([]byte(test.Operation))
+		key := &Key{PublicKeyHash: test.PublicKeyHash, PublicKey: test.PublicKey}
+		signedBytes, _ := hex.DecodeString(test.HsmResponse)
+		signed, err := op.TzSign(context.Background(), &testSigner{SignedBytes: signedBytes}, key)
+		if err != nil || fmt.Sprintf("{\"signature\":\"%s\"}", signed) != test.SignerResponse {
+			log.Printf("Expected %v to verify, got %v: %v\n", test.PublicKeyHash, signed, err)
+			t.Fail()
+		}
+	}
+
+	// Ed25519 signatures are verified too
+	privateKey, client := getTestAuthorizedKey(1)
+	op, _ := ParseOperation([]byte(testAttestation.Operation))
+	key := &Key{PublicKeyHash: client.PublicKeyHash(), PublicKey: client.PublicKey}
+	signer := &testSigner{SignedBytes: ed25519.Sign(privateKey, op.Digest())}
+	if _, err := op.TzSign(context.Background(), signer, key); err != nil {
+		log.Println("Expected an ed25519 signature to verify:", err)
+		t.Fail()
+	}
+}
+
+func TestTzSignWrongKey(t *testing.T) {
+	// A signature by another key, such as a misconfigured slot or label
+	op, _ := ParseOperation([]byte(testTenderbakeBlock.Operation))
+	signedBytes, _ := hex.DecodeString(testEndorse.HsmResponse)
+	key := &Key{PublicKeyHash: testTenderbakeBlock.PublicKeyHash, PublicKey: testTenderbakeBlock.PublicKey}
+	if _, err := op.TzSign(context.Background(), &testSigner{SignedBytes: signedBytes}, key); !errors.Is(err, ErrSignatureVerification) {
+		log.Println("Expected a signature by another key to fail verification:", err)
+		t.Fail()
+	}
+
+	// A signature of another operation
+	signedBytes, _ = hex.DecodeString(testAttestation.HsmResponse)
+	if _, err := op.TzSign(context.Background(), &testSigner{SignedBytes: signedBytes}, key); !errors.Is(err, ErrSignatureVerification) {
+		log.Println("Expected a signature of another operation to fail verification:", err)
+		t.Fail()
+	}
+
+	// Keys without a valid public key can't be verified
+	key.PublicKey = "keyhash"
+	signedBytes, _ = hex.DecodeString(testTenderbakeBlock.HsmResponse)
+	if _, err := op.TzSign(context.Background(), &testSigner{SignedBytes: signedBytes}, key); !errors.Is(err, ErrSignatureVerification) {
+		log.Println("Expected a key without a public key to fail verification:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,203 @@
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bind strings with this prefix listen on a unix domain socket
+const unixBindPrefix = "unix:"
+
+// SocketConfig controls the unix domain socket the signer listens on when bound
+// to unix:/path/to/socket
+type SocketConfig struct {
+	// File mode of the socket
+	Mode os.FileMode
+	// Owner of the socket, -1 leaves it unchanged
+	UID int
+	GID int
+	// Only accept requests from peers with one of these uids or gids, if set.
+	// Checked with SO_PEERCRED where supported.
+	AllowedUIDs []int
+	AllowedGIDs []int
+}
+
+// DefaultSocketConfig is readable and writable by the signer's user and group
+var DefaultSocketConfig = SocketConfig{Mode: 0660, UID: -1, GID: -1}
+
+// peerCredentials of the process on the other end of a unix socket
+type peerCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+type peerCredentialsKey struct{}
+
+// socketPath returns the path of a unix: bind string
+func socketPath(bindString string) (string, bool) {
+	if !strings.HasPrefix(bindString, unixBindPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(bindString, unixBindPrefix), true
+}
+
+// listenUnix creates the socket, replacing a stale socket left by a signer
+// that didn't shut down cleanly
+func listenUnix(path string, config SocketConfig) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, config.Mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to set socket mode: %v", err)
+	}
+	if config.UID != -1 || config.GID != -1 {
+		if err = os.Chown(path, config.UID, config.GID); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("unable to set socket owner: %v", err)
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes a socket that nothing is listening on.  Fails if
+// the path is not a socket or another process is still listening.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is listening on %v", path)
+	}
+	log.Println("Removing stale socket:", path)
+	return os.Remove(path)
+}
+
+// connContext stores the peer credentials of unix socket connections in the
+// request context
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	// TLS connections wrap the unix connection
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return ctx
+	}
+	creds, err := getPeerCredentials(conn)
+	if err != nil {
+		log.Println("Unable to read peer credentials:", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, creds)
+}
+
+// isPeerAllowed checks the peer credentials of the request against the allowed
+// uids and gids.  Any peer is allowed if neither is set.
+func (config *SocketConfig) isPeerAllowed(ctx context.Context) bool {
+	if len(config.AllowedUIDs) == 0 && len(config.AllowedGIDs) == 0 {
+		return true
+	}
+	creds, ok := ctx.Value(peerCredentialsKey{}).(*peerCredentials)
+	if !ok {
+		return false
+	}
+	debugf("Request from pid %v uid %v gid %v\n", creds.PID, creds.UID, creds.GID)
+	return containsInt(config.AllowedUIDs, creds.UID) || containsInt(config.AllowedGIDs, creds.GID)
+}
+
+// ParseSocketOwner parses a user:group owner, where each part is a name or
+// number and may be omitted.  Returns -1 for omitted parts.
+func ParseSocketOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if len(owner) == 0 {
+		return uid, gid, nil
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	if len(parts[0]) > 0 {
+		id, err := lookupID(parts[0], func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return -1, -1, err
+		}
+		uid = id
+	}
+	if len(parts) == 2 && len(parts[1]) > 0 {
+		id, err := lookupID(parts[1], func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return -1, -1, err
+		}
+		gid = id
+	}
+	return uid, gid, nil
+}
+
+// ParseIDs parses a comma delimited list of numeric uids or gids
+func ParseIDs(ids string) ([]int, error) {
+	result := []int{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	for _, id := range strings.Split(ids, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid id %v", id)
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+// lookupID returns a numeric id as is, or looks up a name
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var errPeerCredentialsUnsupported = errors.New("peer credentials are not supported on this platform")
@@ -0,0 +1,202 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "signer.sock")
+
+	config := DefaultSocketConfig
+	config.Mode = 0600
+	listener, err := listenUnix(socket, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(socket)
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		log.Printf("Unexpected socket mode %v\n", info.Mode())
+		t.Fail()
+	}
+
+	// Sockets that are still being listened on aren't replaced
+	if _, err := listenUnix(socket, config); err == nil {
+		log.Println("Expected an error binding to a live socket")
+		t.Fail()
+	}
+
+	// Stale sockets left by a crash are replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenUnix(socket, config)
+	if err != nil {
+		log.Println("Expected a stale socket to be replaced:", err)
+		t.Fail()
+	} else {
+		listener.Close()
+	}
+
+	// Other files are never removed
+	file := path.Join(dir, "file")
+	ioutil.WriteFile(file, []byte{}, 0600)
+	if _, err := listenUnix(file, config); err == nil {
+		log.Println("Expected an error binding over a regular file")
+		t.Fail()
+	}
+}
+
+func TestSocketPeerCredentials(t *testing.T) {
+	if !peerCredentialsSupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := getTestServer("tz123")
+	signedBytes, _ := hex.DecodeString(testEndorse.HsmResponse)
+	server.signer = &testSigner{SignedBytes: signedBytes}
+	server.keys[0].PublicKeyHash = testEndorse.PublicKeyHash
+	server.keys[0].PublicKey = testEndorse.PublicKey
+	server.bindString = unixBindPrefix + path.Join(dir, "signer.sock")
+	server.socket = DefaultSocketConfig
+
+	listener, err := server.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: Middleware(server.RouteKeys), ConnContext: connContext}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path.Join(dir, "signer.sock"))
+		},
+	}}
+	post := func() int {
+		resp, err := client.Post("http://signer/keys/"+testEndorse.PublicKeyHash, "application/json", bytes.NewReader([]byte(testEndorse.Operation)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Any peer is allowed by default
+	if post() != http.StatusOK {
+		log.Println("Expected any peer to be allowed")
+		t.Fail()
+	}
+
+	server.socket.AllowedUIDs = []int{os.Getuid() + 1}
+	if post() != http.StatusUnauthorized {
+		log.Println("Expected other uids to be unauthorized")
+		t.Fail()
+	}
+
+	server.socket.AllowedGIDs = []int{os.Getgid()}
+	if post() != http.StatusOK {
+		log.Println("Expected an allowed gid to be authorized")
+		t.Fail()
+	}
+}
+
+func TestSocketPeerCredentialsTLS(t *testing.T) {
+	if !peerCredentialsSupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	config := TLSConfig{CertFile: path.Join(dir, "cert.pem"), KeyFile: path.Join(dir, "key.pem")}
+	newTestCertificate(t, "signer", ca).write(t, config.CertFile, config.KeyFile)
+
+	server := getTestServer("tz123")
+	signedBytes, _ := hex.DecodeString(testEndorse.HsmResponse)
+	server.signer = &testSigner{SignedBytes: signedBytes}
+	server.keys[0].PublicKeyHash = testEndorse.PublicKeyHash
+	server.keys[0].PublicKey = testEndorse.PublicKey
+	server.bindString = unixBindPrefix + path.Join(dir, "signer.sock")
+	server.socket = DefaultSocketConfig
+	server.socket.AllowedUIDs = []int{os.Getuid()}
+	if err := server.SetTLS(config); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: Middleware(server.RouteKeys), ConnContext: connContext, TLSConfig: server.tls.tlsConfig()}
+	go httpServer.ServeTLS(listener, "", "")
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path.Join(dir, "signer.sock"))
+		},
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	// Peer credentials are read through the TLS connection
+	resp, err := client.Post("https://127.0.0.1/keys/"+testEndorse.PublicKeyHash, "application/json", bytes.NewReader([]byte(testEndorse.Operation)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Expected an allowed uid to be authorized over TLS, received %v\n", resp.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestParseSocketOwner(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("unable to look up the current user")
+	}
+	for owner, expected := range map[string][2]int{
+		"":                {-1, -1},
+		"10:20":           {10, 20},
+		"10":              {10, -1},
+		":20":             {-1, 20},
+		current.Username:  {os.Getuid(), -1},
+		":" + current.Gid: {-1, os.Getgid()},
+	} {
+		uid, gid, err := ParseSocketOwner(owner)
+		if err != nil || uid != expected[0] || gid != expected[1] {
+			log.Printf("Parsed owner %v as %v:%v, expected %v (%v)\n", owner, uid, gid, expected, err)
+			t.Fail()
+		}
+	}
+	if _, _, err := ParseSocketOwner("no-such-user-exists"); err == nil {
+		log.Println("Expected an error for an unknown user")
+		t.Fail()
+	}
+}
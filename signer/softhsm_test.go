@@ -0,0 +1,121 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// softHSMLibrary returns the SoftHSM v2 library, skipping the test if it isn't
+// installed.  Set SOFTHSM2_LIB to use a library outside the usual locations.
+func softHSMLibrary(t *testing.T) string {
+	for _, lib := range []string{
+		os.Getenv("SOFTHSM2_LIB"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	} {
+		if _, err := os.Stat(lib); len(lib) > 0 && err == nil {
+			return lib
+		}
+	}
+	t.Skip("SoftHSM v2 is not installed")
+	return ""
+}
+
+// newSoftHSMToken initializes a token in a temporary SoftHSM store with user
+// pin 1234 and returns its slot
+func newSoftHSMToken(t *testing.T, lib string, dir string) uint {
+	conf := path.Join(dir, "softhsm2.conf")
+	tokens := path.Join(dir, "tokens")
+	os.Mkdir(tokens, 0700)
+	ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %v\nobjectstore.backend = file\nlog.level = ERROR\n", tokens)), 0600)
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := pkcs11.New(lib)
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	// The signer initializes the library itself
+	defer ctx.Destroy()
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatal("no SoftHSM slots:", err)
+	}
+	if err = ctx.InitToken(slots[0], "5678", "tezos"); err != nil {
+		t.Fatal(err)
+	}
+
+	// SoftHSM moves initialized tokens to a new slot
+	slot := uint(0)
+	slots, _ = ctx.GetSlotList(true)
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err == nil && strings.TrimSpace(info.Label) == "tezos" {
+			slot = s
+		}
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err = ctx.Login(session, pkcs11.CKU_SO, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.InitPIN(session, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	return slot
+}
+
+func TestSoftHSMEd25519(t *testing.T) {
+	lib := softHSMLibrary(t)
+	dir, err := ioutil.TempDir("", "softhsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	slot := newSoftHSMToken(t, lib, dir)
+	hsm := &PKCS11Signer{UserPin: "1234", LibPath: lib}
+	defer hsm.Close()
+	key, err := hsm.Generate(context.Background(), slot, "baker", "ed25519")
+	if err != nil {
+		t.Skip("SoftHSM does not support Ed25519, v2.6+ is required: ", err)
+	}
+
+	// Generated keys are discovered
+	keys, err := hsm.Discover(context.Background())
+	if err != nil || len(keys) != 1 || keys[0].PublicKey != key.PublicKey {
+		log.Printf("Expected to discover the generated key, got %v: %v\n", keys, err)
+		t.Fail()
+	}
+
+	for _, test := range []testOperation{testTenderbakeBlock, testAttestation} {
+		op, _ := ParseOperation([]byte(test.Operation))
+		signed, err := op.TzSign(context.Background(), hsm, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(signed, "edsig") {
+			log.Printf("Expected an edsig signature, got %v\n", signed)
+			t.Fail()
+		}
+		sig, _ := decodeSignature(signed)
+		if err := verifySignature(key.PublicKey, op.Digest(), sig); err != nil {
+			log.Printf("Signature does not verify against %v: %v\n", key.PublicKey, err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package spending
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileLedger stores committed spends in a local file so that limits survive
+// restarts.  Reservations are only held in memory.  The file is only read and
+// created once a limit is checked, so signers without spend limits never write it.
+type FileLedger struct {
+	file    string
+	session *SessionLedger
+	loaded  bool
+	mux     sync.Mutex
+}
+
+// fileEntry is the yaml representation of a committed spend
+type fileEntry struct {
+	KeyHash     string `yaml:"Key"`
+	Destination string `yaml:"Destination,omitempty"`
+	Amount      string `yaml:"Amount"`
+	Time        string `yaml:"Time"`
+}
+
+// GetFileLedger returns a new file backed spend ledger
+func GetFileLedger(file string) *FileLedger {
+	// If file is not set, create a new file in our home directory
+	if len(file) == 0 {
+		file = path.Join(os.Getenv("HOME"), ".hsm-signer-spending")
+	}
+	return &FileLedger{
+		file:    file,
+		session: GetSessionLedger(),
+	}
+}
+
+// load the committed spends from disk the first time they are needed, and
+// verify that the file can be written
+func (ledger *FileLedger) load() error {
+	ledger.mux.Lock()
+	defer ledger.mux.Unlock()
+	if ledger.loaded {
+		return nil
+	}
+	entries, err := loadFromDisk(ledger.file)
+	if err != nil {
+		return fmt.Errorf("unable to load spend entries from %v: %v", ledger.file, err)
+	}
+	ledger.session.mux.Lock()
+	defer ledger.session.mux.Unlock()
+	ledger.session.entries = entries
+	if err = ledger.saveToDisk(); err != nil {
+		return fmt.Errorf("could not write to spending file %v: %v", ledger.file, err)
+	}
+	ledger.loaded = true
+	return nil
+}
+
+func loadFromDisk(file string) ([]*spendEntry, error) {
+	entries := []*spendEntry{}
+
+	// If file doesn't exist, return empty
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		log.Println("Spending file did not exist.  Initializing: ", file)
+		return entries, nil
+	}
+	yamlFile, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fileEntries := []fileEntry{}
+	if err = yaml.Unmarshal(yamlFile, &fileEntries); err != nil {
+		return nil, err
+	}
+	for _, e := range fileEntries {
+		amount, ok := new(big.Int).SetString(e.Amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %v", e.Amount)
+		}
+		t, err := time.Parse(time.RFC3339Nano, e.Time)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &spendEntry{
+			keyHash:     e.KeyHash,
+			destination: e.Destination,
+			amount:      amount,
+			time:        t,
+		})
+	}
+	return entries, nil
+}
+
+// save the spend entries to disk
+func (ledger *FileLedger) saveToDisk() error {
+	fileEntries := []fileEntry{}
+	for _, e := range ledger.session.entries {
+		fileEntries = append(fileEntries, fileEntry{
+			KeyHash:     e.keyHash,
+			Destination: e.destination,
+			Amount:      e.amount.String(),
+			Time:        e.time.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	bytes, err := yaml.Marshal(fileEntries)
+	if err != nil {
+		log.Println("Unable to marshall spend entries")
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash can't truncate the ledger
+	tmp := ledger.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, bytes, 0644); err != nil {
+		log.Println("Unable to write spending file: " + tmp)
+		return err
+	}
+	return os.Rename(tmp, ledger.file)
+}
+
+// Reserve the spends if, together with committed spends and outstanding
+// reservations, they fit within every limit
+func (ledger *FileLedger) Reserve(keyHash string, spends []Spend, limits []Limit) (*Reservation, error) {
+	if len(limits) > 0 {
+		if err := ledger.load(); err != nil {
+			return nil, err
+		}
+	}
+	return ledger.session.Reserve(keyHash, spends, limits)
+}
+
+// Commit a reservation and save it to disk.  If it can't be saved the spend is
+// still counted in memory for this session.
+func (ledger *FileLedger) Commit(reservation *Reservation) error {
+	if err := ledger.load(); err != nil {
+		return err
+	}
+	ledger.session.mux.Lock()
+	defer ledger.session.mux.Unlock()
+	if err := ledger.session.commit(reservation); err != nil {
+		return err
+	}
+	return ledger.saveToDisk()
+}
+
+// Release a reservation whose operation was not signed
+func (ledger *FileLedger) Release(reservation *Reservation) {
+	ledger.session.Release(reservation)
+}
+
+// Used returns the amount committed and reserved by a key towards a limit
+func (ledger *FileLedger) Used(keyHash string, limit Limit) *big.Int {
+	if err := ledger.load(); err != nil {
+		log.Println("[WARN]", err)
+	}
+	return ledger.session.Used(keyHash, limit)
+}
@@ -0,0 +1,41 @@
+package spending
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFileRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "spending")
+	limits := []Limit{{Window: 24 * time.Hour, Max: big.NewInt(100)}}
+
+	// The file is only created once a limit is checked
+	ledger := GetFileLedger(file)
+	_, err = os.Stat(file)
+	assert(t, os.IsNotExist(err), "Spending file should not be created without limits")
+
+	r, err := ledger.Reserve("tz1...", spend("tz2...", 60), limits)
+	assert(t, err == nil, "First spend should be within the limit")
+	assert(t, ledger.Commit(r) == nil, "Reservation should commit")
+
+	// Uncommitted reservations are not persisted
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 40), limits)
+	assert(t, err == nil, "Second spend should be within the limit")
+
+	// Committed spends survive a restart
+	ledger = GetFileLedger(file)
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 50), limits)
+	assert(t, err == ErrLimitExceeded, "Committed spend should be loaded from disk")
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 40), limits)
+	assert(t, err == nil, "Reservations should not be loaded from disk")
+}
@@ -0,0 +1,153 @@
+package spending
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// minRetention keeps spends long enough that a window which is shortened by a
+// reload or restart and later lengthened again still counts them
+const minRetention = 31 * 24 * time.Hour
+
+// SessionLedger stores spends in memory
+type SessionLedger struct {
+	entries      []*spendEntry
+	reservations []*Reservation
+	mux          sync.Mutex
+	// retention is the longest window ever configured, and at least minRetention
+	retention time.Duration
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// spendEntry is a committed spend
+type spendEntry struct {
+	keyHash     string
+	destination string
+	amount      *big.Int
+	time        time.Time
+}
+
+// GetSessionLedger returns a new in-memory spend ledger
+func GetSessionLedger() *SessionLedger {
+	return &SessionLedger{
+		entries:   []*spendEntry{},
+		mux:       sync.Mutex{},
+		retention: minRetention,
+		now:       time.Now,
+	}
+}
+
+// Reserve the spends if, together with committed spends and outstanding
+// reservations, they fit within every limit
+func (ledger *SessionLedger) Reserve(keyHash string, spends []Spend, limits []Limit) (*Reservation, error) {
+	ledger.mux.Lock()
+	defer ledger.mux.Unlock()
+
+	now := ledger.now()
+	ledger.prune(keyHash, limits, now)
+
+	for _, limit := range limits {
+		used := ledger.used(keyHash, &limit, now)
+		requested := limit.total(spends)
+		if requested.Sign() == 0 {
+			continue
+		}
+		if new(big.Int).Add(used, requested).Cmp(limit.Max) == 1 {
+			log.Printf("[WARN] Spending %v would exceed the limit of %v per %v (%v used)\n", requested, limit.Max, limit.Window, used)
+			return nil, ErrLimitExceeded
+		}
+	}
+
+	reservation := &Reservation{keyHash: keyHash, spends: spends}
+	ledger.reservations = append(ledger.reservations, reservation)
+	return reservation, nil
+}
+
+// Commit a reservation once its operation has been signed
+func (ledger *SessionLedger) Commit(reservation *Reservation) error {
+	ledger.mux.Lock()
+	defer ledger.mux.Unlock()
+	return ledger.commit(reservation)
+}
+
+// commit a reservation with the lock held
+func (ledger *SessionLedger) commit(reservation *Reservation) error {
+	if !ledger.remove(reservation) {
+		return errors.New("reservation is not outstanding")
+	}
+	now := ledger.now()
+	for _, spend := range reservation.spends {
+		ledger.entries = append(ledger.entries, &spendEntry{
+			keyHash:     reservation.keyHash,
+			destination: spend.Destination,
+			amount:      spend.Amount,
+			time:        now,
+		})
+	}
+	return nil
+}
+
+// Release a reservation whose operation was not signed
+func (ledger *SessionLedger) Release(reservation *Reservation) {
+	ledger.mux.Lock()
+	defer ledger.mux.Unlock()
+	ledger.remove(reservation)
+}
+
+// remove an outstanding reservation, returning false if it was not found
+func (ledger *SessionLedger) remove(reservation *Reservation) bool {
+	for i, r := range ledger.reservations {
+		if r == reservation {
+			ledger.reservations = append(ledger.reservations[:i], ledger.reservations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Used returns the amount committed and reserved by a key towards a limit
+func (ledger *SessionLedger) Used(keyHash string, limit Limit) *big.Int {
+	ledger.mux.Lock()
+	defer ledger.mux.Unlock()
+	return ledger.used(keyHash, &limit, ledger.now())
+}
+
+// used returns the amount committed and reserved by this key towards a limit
+func (ledger *SessionLedger) used(keyHash string, limit *Limit, now time.Time) *big.Int {
+	used := new(big.Int)
+	since := now.Add(-limit.Window)
+	for _, entry := range ledger.entries {
+		if entry.keyHash == keyHash && entry.time.After(since) &&
+			limit.applies(Spend{Destination: entry.destination, Amount: entry.amount}) {
+			used.Add(used, entry.amount)
+		}
+	}
+	for _, reservation := range ledger.reservations {
+		if reservation.keyHash == keyHash {
+			used.Add(used, limit.total(reservation.spends))
+		}
+	}
+	return used
+}
+
+// prune entries of this key that have fallen out of the longest window ever
+// configured, rather than the current limits, which may be lengthened again
+func (ledger *SessionLedger) prune(keyHash string, limits []Limit, now time.Time) {
+	for _, limit := range limits {
+		if limit.Window > ledger.retention {
+			ledger.retention = limit.Window
+		}
+	}
+	since := now.Add(-ledger.retention)
+	entries := ledger.entries[:0]
+	for _, entry := range ledger.entries {
+		if entry.keyHash != keyHash || entry.time.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+	ledger.entries = entries
+}
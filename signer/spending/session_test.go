@@ -0,0 +1,157 @@
+package spending
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, condition bool, errorMessage string) {
+	if !condition {
+		fmt.Println("Test Failure: ", errorMessage)
+		t.Fail()
+	}
+}
+
+// testClock lets tests move time forward
+type testClock struct {
+	time time.Time
+}
+
+func (clock *testClock) now() time.Time {
+	return clock.time
+}
+
+func spend(destination string, amount int64) []Spend {
+	return []Spend{{Destination: destination, Amount: big.NewInt(amount)}}
+}
+
+func TestRollingWindow(t *testing.T) {
+	ledger := GetSessionLedger()
+	clock := &testClock{time: time.Unix(1700000000, 0)}
+	ledger.now = clock.now
+	limits := []Limit{{Window: time.Hour, Max: big.NewInt(100)}}
+
+	r, err := ledger.Reserve("tz1...", spend("tz2...", 60), limits)
+	assert(t, err == nil, "First spend should be within the limit")
+	assert(t, ledger.Commit(r) == nil, "Reservation should commit")
+
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 50), limits)
+	assert(t, err == ErrLimitExceeded, "Second spend should exceed the limit")
+
+	// Other keys have their own budget
+	_, err = ledger.Reserve("tz3...", spend("tz2...", 50), limits)
+	assert(t, err == nil, "Other keys should not share the limit")
+
+	// The window rolls rather than resetting at a boundary
+	clock.time = clock.time.Add(59 * time.Minute)
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 50), limits)
+	assert(t, err == ErrLimitExceeded, "Spend should still count within the window")
+
+	assert(t, ledger.Used("tz1...", limits[0]).Int64() == 60, "Committed spend should be used")
+
+	clock.time = clock.time.Add(time.Minute)
+	assert(t, ledger.Used("tz1...", limits[0]).Sign() == 0, "Expired spend should not be used")
+	r, err = ledger.Reserve("tz1...", spend("tz2...", 100), limits)
+	assert(t, err == nil, "Spend should expire after the window")
+	assert(t, ledger.Commit(r) == nil, "Reservation should commit")
+}
+
+func TestMultipleWindows(t *testing.T) {
+	ledger := GetSessionLedger()
+	clock := &testClock{time: time.Unix(1700000000, 0)}
+	ledger.now = clock.now
+	limits := []Limit{
+		{Window: time.Hour, Max: big.NewInt(100)},
+		{Window: 24 * time.Hour, Max: big.NewInt(150)},
+	}
+
+	r, _ := ledger.Reserve("tz1...", spend("tz2...", 100), limits)
+	ledger.Commit(r)
+	clock.time = clock.time.Add(2 * time.Hour)
+
+	_, err := ledger.Reserve("tz1...", spend("tz2...", 60), limits)
+	assert(t, err == ErrLimitExceeded, "Daily limit should apply after the hourly window")
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 50), limits)
+	assert(t, err == nil, "Spend within both limits should be allowed")
+}
+
+func TestShortenedWindow(t *testing.T) {
+	ledger := GetSessionLedger()
+	clock := &testClock{time: time.Unix(1700000000, 0)}
+	ledger.now = clock.now
+	daily := []Limit{{Window: 24 * time.Hour, Max: big.NewInt(100)}}
+	hourly := []Limit{{Window: time.Hour, Max: big.NewInt(100)}}
+	bimonthly := []Limit{{Window: 60 * 24 * time.Hour, Max: big.NewInt(100)}}
+
+	r, _ := ledger.Reserve("tz1...", spend("tz2...", 60), daily)
+	ledger.Commit(r)
+
+	// Shortening the window must not forget spends a longer window needs later
+	clock.time = clock.time.Add(2 * time.Hour)
+	_, err := ledger.Reserve("tz1...", spend("tz2...", 60), hourly)
+	assert(t, err == nil, "Spend outside the hourly window should be allowed")
+	_, err = ledger.Reserve("tz1...", spend("tz2...", 60), daily)
+	assert(t, err == ErrLimitExceeded, "Spend should still count once the window is lengthened")
+
+	// Windows longer than the minimum retention keep their spends too
+	r, _ = ledger.Reserve("tz3...", spend("tz2...", 60), bimonthly)
+	ledger.Commit(r)
+	clock.time = clock.time.Add(45 * 24 * time.Hour)
+	ledger.Reserve("tz3...", spend("tz2...", 0), hourly)
+	_, err = ledger.Reserve("tz3...", spend("tz2...", 60), bimonthly)
+	assert(t, err == ErrLimitExceeded, "Spend should count within the longest window")
+}
+
+func TestDestinationLimit(t *testing.T) {
+	ledger := GetSessionLedger()
+	limits := []Limit{
+		{Window: time.Hour, Max: big.NewInt(100)},
+		{Window: time.Hour, Max: big.NewInt(10), Destination: "tz2..."},
+	}
+
+	_, err := ledger.Reserve("tz1...", spend("tz2...", 20), limits)
+	assert(t, err == ErrLimitExceeded, "Destination limit should apply")
+	r, err := ledger.Reserve("tz1...", spend("tz3...", 20), limits)
+	assert(t, err == nil, "Other destinations should only count towards the key limit")
+	ledger.Commit(r)
+
+	// Fees count towards the key limit but not the destination limit
+	fees := append(spend("", 75), spend("tz2...", 5)...)
+	_, err = ledger.Reserve("tz1...", fees, limits)
+	assert(t, err == nil, "Fees should not count towards the destination limit")
+}
+
+func TestReservations(t *testing.T) {
+	ledger := GetSessionLedger()
+	limits := []Limit{{Window: time.Hour, Max: big.NewInt(100)}}
+
+	// Outstanding reservations count towards the limit
+	r1, _ := ledger.Reserve("tz1...", spend("tz2...", 60), limits)
+	_, err := ledger.Reserve("tz1...", spend("tz2...", 60), limits)
+	assert(t, err == ErrLimitExceeded, "Concurrent reservations should not both fit")
+
+	// Released reservations don't consume the budget
+	ledger.Release(r1)
+	r2, err := ledger.Reserve("tz1...", spend("tz2...", 100), limits)
+	assert(t, err == nil, "Released reservation should free the budget")
+	assert(t, ledger.Commit(r1) != nil, "Released reservation should not commit")
+	assert(t, ledger.Commit(r2) == nil, "Reservation should commit")
+	assert(t, ledger.Commit(r2) != nil, "Reservation should not commit twice")
+}
+
+func TestParseWindow(t *testing.T) {
+	for window, expected := range map[string]time.Duration{
+		"1h":  time.Hour,
+		"90m": 90 * time.Minute,
+		"7d":  7 * 24 * time.Hour,
+	} {
+		duration, err := ParseWindow(window)
+		assert(t, err == nil && duration == expected, "Unexpected duration for "+window)
+	}
+	for _, window := range []string{"", "d", "0h", "-1d", "1w"} {
+		_, err := ParseWindow(window)
+		assert(t, err != nil, "Expected an error parsing "+window)
+	}
+}
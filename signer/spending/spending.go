@@ -0,0 +1,88 @@
+package spending
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ledger records the amounts each key has spent and enforces limits over
+// rolling windows.  Spends are reserved before signing and only count once
+// committed, so operations that are rejected or fail to sign don't consume the
+// budget.
+type Ledger interface {
+	// Reserve the spends if, together with committed spends and outstanding
+	// reservations, they fit within every limit
+	Reserve(keyHash string, spends []Spend, limits []Limit) (*Reservation, error)
+	// Commit a reservation once its operation has been signed
+	Commit(reservation *Reservation) error
+	// Release a reservation whose operation was not signed
+	Release(reservation *Reservation)
+	// Used returns the amount committed and reserved by a key towards a limit
+	Used(keyHash string, limit Limit) *big.Int
+}
+
+// A Spend of mutez by a key.  Destination is empty for amounts that are not
+// transferred to an address, such as fees and burns.
+type Spend struct {
+	Destination string
+	Amount      *big.Int
+}
+
+// A Limit on the mutez a key may spend over a rolling window.  If Destination
+// is set, only transfers to that address count towards the limit.
+type Limit struct {
+	Window      time.Duration
+	Max         *big.Int
+	Destination string
+}
+
+// A Reservation holds spends until they are committed or released
+type Reservation struct {
+	keyHash string
+	spends  []Spend
+}
+
+// ErrLimitExceeded is returned when a spend would exceed one of its limits
+var ErrLimitExceeded = errors.New("spend limit exceeded")
+
+// ParseWindow parses a window such as "90m", "24h" or "7d".  In addition to
+// time.ParseDuration units, a "d" suffix counts whole days.
+func ParseWindow(window string) (time.Duration, error) {
+	var duration time.Duration
+	if strings.HasSuffix(window, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %v", window)
+		}
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(window); err != nil {
+			return 0, err
+		}
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("window %v must be positive", window)
+	}
+	return duration, nil
+}
+
+// applies returns true if this spend counts towards the limit
+func (limit *Limit) applies(spend Spend) bool {
+	return len(limit.Destination) == 0 || limit.Destination == spend.Destination
+}
+
+// total of the spends that count towards the limit
+func (limit *Limit) total(spends []Spend) *big.Int {
+	total := new(big.Int)
+	for _, spend := range spends {
+		if limit.applies(spend) {
+			total.Add(total, spend.Amount)
+		}
+	}
+	return total
+}
@@ -5,12 +5,14 @@ type testOperation struct {
 	HsmResponse    string
 	SignerResponse string
 	PublicKeyHash  string
+	PublicKey      string
 	OpMagicByte    uint8
 	Level          string
+	Round          string
 	ChainID        string
 }
 
-// Test Transactions
+// Test Transactions captured before Babylon, with the legacy transaction tag 0x08
 var (
 	testSecp256k1Tx = testOperation{
 		// tezos-client transfer 1 from remote-secp256k1 to remote-secp256k1
@@ -32,6 +34,32 @@ var (
 	}
 )
 
+// Test Transactions
+var (
+	testSecp256k1Transfer = testOperation{
+		// testSecp256k1Tx re-encoded with the Babylon transaction tag 0x6c,
+		// signed by testSecp256k1PrivateKey
+		OpMagicByte:    opMagicByteGeneric,
+		Operation:      "\"0380270c97773c117d71d95e96f3a5292f7949f571a31cbc80994f5fea61b154666c0154f5d8f71ce18f9f05bb885a4120e64c667bc1b4fb09b9b037d84f00c0843d000154f5d8f71ce18f9f05bb885a4120e64c667bc1b400\"",
+		HsmResponse:    "dfdb97088210db045e9216f9562652a535a0668463daa9f285e685b1d24850f129c532ae6a754129c08a0af74bcc35db5cd2c00f3acde1cad1318de05cab9409",
+		SignerResponse: "{\"signature\":\"spsig1b6ckh3vk1YSAvyrJk5N31dg7DN58BVmMwTDCSK5JdCR9GGCU3Hn6idUVAa2d1c99CxVTa6WuSHCZheJQBUcGuhTvpDjxg\"}",
+		PublicKeyHash:  "tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",
+		PublicKey:      "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S",
+		ChainID:        "NetXeSG6ShTTieu",
+	}
+	testP256Transfer = testOperation{
+		// testP256Tx re-encoded with the Babylon transaction tag 0x6c,
+		// signed by testP256PrivateKey
+		OpMagicByte:    opMagicByteGeneric,
+		Operation:      "\"0307456de90f901440e17e76d95a79b74827cc5663ca36994d8603992bea6d66376c02d0ea30de52fb4806d075ab8d312d19be7d0c23e9fb09be8e35d84f00c0843d0002d0ea30de52fb4806d075ab8d312d19be7d0c23e900\"",
+		HsmResponse:    "383fea89260908283e5f945a59a0481400ac38aa64d83c1147da62d13766c17f76010092e904dcda91e79529826819cd8af2cdb0a27fce9bc4f6ede5ba3e30d6",
+		SignerResponse: "{\"signature\":\"p2sigUfLn1k7g9HsMSmozvamz9pbs9ijPFSXkey15vfQ1RqGgnLtMtmeVH3Td6AU6McaCqAk3EsWcCW6hvVbpzVap8MfKb8J1V\"}",
+		PublicKeyHash:  "tz3PUkjqtsAg1uV3aQTWTMs6SBDYbY9BkUp6",
+		PublicKey:      "p2pk65Dd82G3JpWBNWmRdUJ7XJhkTbX1Q7jQDFkJKK5TJyhZLGqSG1N",
+		ChainID:        "NetXJDZUe2asiD2",
+	}
+)
+
 // Test Endorsements
 var (
 	testEndorse = testOperation{
@@ -41,6 +69,7 @@ var (
 		HsmResponse:    "f41956681a9a17e4d48ee8e62ccd179f9d12a29155858b5993b013fcb570b10951d25c52ed0b84f0a548a6bf7968e0e77bbc2d190f2a14c2bbfe3a97512c1311",
 		SignerResponse: "{\"signature\":\"spsig1dkD3k1tKoyiwno2cLJB9tgTgFJzW9tAXzDn5NbvDaamKggVRSnCRsCfBu8j7K5xoZmEmijstVhit1Z9A4mpggpemq2zBs\"}",
 		PublicKeyHash:  "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		PublicKey:      "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD",
 		Level:          "256877",
 		ChainID:        "NetXdQprcVkpaWU",
 	}
@@ -52,6 +81,7 @@ var (
 		HsmResponse:    "2f63016c1c9638e2630dc0056f3f625903efbcac26d5978aa3752d6050319068f6641148fda3d0a591c9a4913c863b5c90ecb029ee737e28aeed19795d62eeb8",
 		SignerResponse: "{\"signature\":\"spsig1C1YcyDsYwiV2F1YimwQUDPuz1AuCj5UVb6rfZ2Dm1iCj7k1aKY31Nxnikx13W3NGjf9BbbWaPpZWJx3qq8MNLp2YX3bvU\"}",
 		PublicKeyHash:  "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		PublicKey:      "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD",
 		Level:          "259938",
 		ChainID:        "NetXdQprcVkpaWU",
 	}
@@ -63,6 +93,7 @@ var (
 		HsmResponse:    "715daf2be170b827df8e71352939f5fda7e920aaa1f21332d3ee2dd9ea46cf1b3b4ee3e86834857acfd0779ad7988c339d76d24016d26603dd0a057f7be285a9",
 		SignerResponse: "{\"signature\":\"spsig1LeCXtYt7Ru24o3EyEuHcnxSfDbVDrUtkf9RXwJ23DwXZBrpspdG3S9TP842Bopb6jSEKNViMGSDLGeX6ejrdHyNcsjb1Z\"}",
 		PublicKeyHash:  "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		PublicKey:      "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD",
 		Level:          "259939",
 		ChainID:        "NetXdQprcVkpaWU",
 	}
@@ -77,7 +108,47 @@ var (
 		HsmResponse:    "428fa4f31d7e6c4ec1a100618abd4ac0c8f100d67fb754226c185c0bf93f60562c60592f5189a0797b23d519d67babd2ad379055a1f639fdad8af1daaf0ba333",
 		SignerResponse: "{\"signature\":\"spsig1EX3PsUAHsQQUYpztfrV5w1GEPsDwJmLBhE2JSUCinH9hBgbL2fwbG73ZYfSB4pJ6aW98gTGh1VMBBU7YcGPQiBmX2o7kM\"}",
 		PublicKeyHash:  "tz2G4TwEbsdFrJmApAxJ1vdQGmADnBp95n9m",
+		PublicKey:      "sppk7abytDwTuGrWHaemi8EDhz5PTZ2DL3G7XdRzDWocWKoiiDmvPpD",
 		Level:          "146930",
 		ChainID:        "NetXgtSLGNJvNye",
 	}
 )
+
+// Test Tenderbake Operations, signed by testSecp256k1PrivateKey
+var (
+	testTenderbakeBlock = testOperation{
+		OpMagicByte:    opMagicByteTenderbakeBlock,
+		Operation:      "\"117a06a7700032dcd201a426dfbaa8dd42e211238cb4d58a9ae95fb1644520949eba53f56fa399adc6ac0000000065a1b2c304a92c36e66a25ee99ff862faa8e87987be6c7cd13c3ee661c400a45b0f1e3b132000000210000000102000000040032dcd20000000000000004ffffffff0000000400000002239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e500000000a1b2c3d4e5f607080002\"",
+		HsmResponse:    "1e20510fafaf570278ac36aa7e4d8490d97df6264f007a14f8587a83d5abad427d9a9f44d3af88c37360051a6191faeab2160bcc17b02eb779e74783860161b7",
+		SignerResponse: "{\"signature\":\"spsig19ka9pdNKX3CwRHSkiMoadf8TEdpMuN5CG3p7CetqsQZj9ptmMsimKpNivgBfnzE4Lr8a8sGrejNoV5EbpqVUtXeinDar7\"}",
+		PublicKeyHash:  "tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",
+		PublicKey:      "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S",
+		Level:          "3333330",
+		Round:          "2",
+		ChainID:        "NetXdQprcVkpaWU",
+	}
+
+	testPreattestation = testOperation{
+		OpMagicByte:    opMagicBytePreattestation,
+		Operation:      "\"127a06a770f38c764c8aa00b6578f4254a4dc6d9b50f88fa926e270ea7859bd1b707cd86621400050032dcd200000000239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5\"",
+		HsmResponse:    "48795fb2a98424566285e75348b1abd3f6fa87b4544994517474436d889b67a061bb714f1d5c85421ead03a4e77ad4fa4e9068fbdb378d47ad34800915728ba1",
+		SignerResponse: "{\"signature\":\"spsig1FHukU68fk4KgH9EbCyF2X3vkimh1zD2uZJf6UPnow65638qmDNzNkNuJCMiDTh7Jfc5d1tvomkWx7gAnhit9tckELgDw9\"}",
+		PublicKeyHash:  "tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",
+		PublicKey:      "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S",
+		Level:          "3333330",
+		Round:          "0",
+		ChainID:        "NetXdQprcVkpaWU",
+	}
+
+	testAttestation = testOperation{
+		OpMagicByte:    opMagicByteAttestation,
+		Operation:      "\"137a06a770f38c764c8aa00b6578f4254a4dc6d9b50f88fa926e270ea7859bd1b707cd86621500050032dcd200000001239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5\"",
+		HsmResponse:    "44fffebfbf641c5d24a07d90d259061adc52b6c3ca2c32ad6e122e60f3941c3a7a7d6afcc0d20795ae1d69ddee5b507272726ff0ddd47628607447c614acd138",
+		SignerResponse: "{\"signature\":\"spsig1EqYkyKWom15BCrna6yyXQaLLY8H1HN31ypfVzsjYrmccRJhdseDEfazgPxgEv8owu1s4MpLhQMehdgSuLd6Tucwnu8kz6\"}",
+		PublicKeyHash:  "tz2JdR1f2ssXHBELKBWFCsXGyB4ZgzZZQ2Pg",
+		PublicKey:      "sppk7bTVxYg1ZXwPumgFcid8rBBW443MCb5DHw6y3aq7dLcAKUMTa8S",
+		Level:          "3333330",
+		Round:          "1",
+		ChainID:        "NetXdQprcVkpaWU",
+	}
+)
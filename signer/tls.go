@@ -0,0 +1,120 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// TLSConfig locates the certificates used to serve the signer over TLS
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// Require clients to present a certificate signed by this CA, if set
+	ClientCAFile string
+}
+
+// certReloader serves the most recently loaded certificates so that they can be
+// rotated without restarting the signer
+type certReloader struct {
+	config    TLSConfig
+	mux       sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// newCertReloader loads the configured certificates
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	if len(config.CertFile) == 0 || len(config.KeyFile) == 0 {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+	reloader := &certReloader{config: config}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload the certificates from disk.  The current certificates are kept if any
+// of the new ones fail to load.
+func (reloader *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if len(reloader.config.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(reloader.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA file: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %v", reloader.config.ClientCAFile)
+		}
+	}
+
+	reloader.mux.Lock()
+	defer reloader.mux.Unlock()
+	reloader.cert = &cert
+	reloader.clientCAs = clientCAs
+	log.Println("Loaded TLS certificate:", reloader.config.CertFile)
+	return nil
+}
+
+// getCertificate returns the current server certificate
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mux.RLock()
+	defer reloader.mux.RUnlock()
+	return reloader.cert, nil
+}
+
+// getConfigForClient returns a config with the current client CAs for each handshake
+func (reloader *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.mux.RLock()
+	defer reloader.mux.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if reloader.clientCAs != nil {
+		config.ClientCAs = reloader.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// tlsConfig for the http server
+func (reloader *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     reloader.getCertificate,
+		GetConfigForClient: reloader.getConfigForClient,
+	}
+}
+
+// isClientAllowed checks the verified client certificate against the key's
+// allowed subjects.  A subject matches either the certificate's common name or
+// its full distinguished name, e.g. "CN=baker,O=Example".  Any client is
+// allowed if the key doesn't restrict subjects.
+func isClientAllowed(key *Key, state *tls.ConnectionState) bool {
+	if len(key.AllowedClientSubjects) == 0 {
+		return true
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false
+	}
+	subject := state.VerifiedChains[0][0].Subject
+	for _, allowed := range key.AllowedClientSubjects {
+		if allowed == subject.CommonName || allowed == subject.String() {
+			return true
+		}
+	}
+	return false
+}
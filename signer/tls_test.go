@@ -0,0 +1,189 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and key signed by a test CA
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCertificate) write(t *testing.T, certFile string, keyFile string) {
+	if err := ioutil.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	cert, _ := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	return cert
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := TLSConfig{CertFile: path.Join(dir, "cert.pem"), KeyFile: path.Join(dir, "key.pem")}
+
+	ca := newTestCertificate(t, "ca", nil)
+	first := newTestCertificate(t, "first", ca)
+	first.write(t, config.CertFile, config.KeyFile)
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated certificates are served after a reload
+	second := newTestCertificate(t, "second", ca)
+	second.write(t, config.CertFile, config.KeyFile)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := reloader.getCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], second.cert.Raw) {
+		log.Println("Expected the rotated certificate after reloading")
+		t.Fail()
+	}
+
+	// A failed reload keeps the current certificate
+	ioutil.WriteFile(config.KeyFile, []byte("invalid"), 0600)
+	if reloader.reload() == nil {
+		log.Println("Expected an error reloading an invalid key")
+		t.Fail()
+	}
+	cert, _ = reloader.getCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], second.cert.Raw) {
+		log.Println("Expected the current certificate after a failed reload")
+		t.Fail()
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "ca", nil)
+	serverCert := newTestCertificate(t, "signer", ca)
+	config := TLSConfig{
+		CertFile:     path.Join(dir, "cert.pem"),
+		KeyFile:      path.Join(dir, "key.pem"),
+		ClientCAFile: path.Join(dir, "ca.pem"),
+	}
+	serverCert.write(t, config.CertFile, config.KeyFile)
+	ioutil.WriteFile(config.ClientCAFile, ca.certPEM, 0600)
+
+	// Only the baker's certificate may use the key
+	server := getTestServer("tz123")
+	signedBytes, _ := hex.DecodeString(testEndorse.HsmResponse)
+	server.signer = &testSigner{SignedBytes: signedBytes}
+	server.keys[0].PublicKeyHash = testEndorse.PublicKeyHash
+	server.keys[0].PublicKey = testEndorse.PublicKey
+	server.keys[0].AllowedClientSubjects = []string{"baker"}
+	if err := server.SetTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewUnstartedServer(Middleware(server.RouteKeys))
+	httpServer.TLS = server.tls.tlsConfig()
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	post := func(clientCerts ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCerts},
+		}}
+		return client.Post(httpServer.URL+"/keys/"+testEndorse.PublicKeyHash, "application/json", bytes.NewReader([]byte(testEndorse.Operation)))
+	}
+
+	// Clients without a certificate can't connect
+	if _, err := post(); err == nil {
+		log.Println("Expected clients without a certificate to be refused")
+		t.Fail()
+	}
+
+	// Clients with a certificate from another CA can't connect
+	otherCA := newTestCertificate(t, "other-ca", nil)
+	if _, err := post(newTestCertificate(t, "baker", otherCA).tlsCertificate()); err == nil {
+		log.Println("Expected clients with an untrusted certificate to be refused")
+		t.Fail()
+	}
+
+	// Trusted clients must also match the key's allowed subjects
+	resp, err := post(newTestCertificate(t, "other", ca).tlsCertificate())
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Printf("Expected a disallowed subject to be unauthorized: %v\n", err)
+		t.Fail()
+	}
+	resp, err = post(newTestCertificate(t, "baker", ca).tlsCertificate())
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Expected an allowed subject to be signed: %v\n", err)
+		t.Fail()
+	}
+}
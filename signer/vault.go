@@ -0,0 +1,277 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultSigner signs with keys held by a HashiCorp Vault transit secrets engine.
+// Each key's Name is the name of its transit key, which must be an ecdsa-p256
+// (tz3) or ed25519 (tz1) key.  Vault has no secp256k1 keys.
+//
+// The signer authenticates with a token, or logs in with AppRole if a role id
+// is set, and renews its token when half of its lease has passed.
+type VaultSigner struct {
+	// Address of the Vault server, such as https://vault:8200
+	Address string `yaml:"Address"`
+	// Mount path of the transit secrets engine.  Defaults to transit
+	TransitMount string `yaml:"TransitMount"`
+	// Token used when no AppRole is configured
+	Token string `yaml:"Token"`
+	// AppRole credentials, and the mount path of the AppRole auth method.
+	// Defaults to approle
+	RoleID       string `yaml:"RoleID"`
+	SecretID     string `yaml:"SecretID"`
+	AppRoleMount string `yaml:"AppRoleMount"`
+	// Client used for requests.  Defaults to http.DefaultClient
+	Client *http.Client `yaml:"-"`
+
+	mux       sync.Mutex
+	token     string
+	renewable bool
+	renewAt   time.Time
+	now       func() time.Time
+}
+
+var _ Signer = &VaultSigner{}
+
+// vaultResponse holds the fields we use of Vault's responses
+type vaultResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+		TTL       int    `json:"ttl"`
+		Renewable bool   `json:"renewable"`
+	} `json:"data"`
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultError is returned when Vault responds with an error status
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (err *vaultError) Error() string {
+	return fmt.Sprintf("vault returned %v: %v", err.status, strings.Join(err.errors, ", "))
+}
+
+// Sign the digest with the transit key named by the key
+func (v *VaultSigner) Sign(ctx context.Context, message []byte, key *Key) ([]byte, error) {
+	request := map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(message),
+	}
+	switch key.Curve() {
+	case curveEd25519:
+		// Ed25519 signs the digest as the message, as tezos expects
+	case curveNistP256:
+		request["prehashed"] = true
+		request["hash_algorithm"] = "sha2-256"
+		request["marshaling_algorithm"] = "asn1"
+	default:
+		return nil, fmt.Errorf("Vault does not support the curve of %v", key.PublicKeyHash)
+	}
+	path := fmt.Sprintf("/v1/%v/sign/%v", v.mount(v.TransitMount, "transit"), key.Name)
+
+	// Log in again once if our token has been revoked
+	var response vaultResponse
+	for attempt := 0; ; attempt++ {
+		token, err := v.getToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = v.request(ctx, path, token, request, &response)
+		if isVaultPermissionDenied(err) && attempt == 0 && len(v.RoleID) > 0 {
+			log.Println("Vault denied the sign request, logging in again:", err)
+			v.resetToken(token)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("vault sign request failed: %v", err)
+		}
+		break
+	}
+
+	sig, err := decodeVaultSignature(response.Data.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve() == curveEd25519 {
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("unexpected signature length: %d bytes, expected %d bytes", len(sig), 64)
+		}
+		return sig, nil
+	}
+	return parseDERSignature(sig, key)
+}
+
+// decodeVaultSignature strips the vault:v<version>: prefix from a signature
+func decodeVaultSignature(signature string) ([]byte, error) {
+	parts := strings.SplitN(signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return nil, fmt.Errorf("unexpected vault signature format: %v", signature)
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// getToken returns a token to make requests with, logging in on first use and
+// renewing the token when half of its lease has passed
+func (v *VaultSigner) getToken(ctx context.Context) (string, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if len(v.token) == 0 {
+		if err := v.login(ctx); err != nil {
+			return "", err
+		}
+	} else if v.renewable && !v.renewAt.IsZero() && !v.time().Before(v.renewAt) {
+		var response vaultResponse
+		err := v.request(ctx, "/v1/auth/token/renew-self", v.token, map[string]interface{}{}, &response)
+		if err == nil && response.Auth != nil {
+			debugln("Renewed vault token")
+			v.setLease(response.Auth.LeaseDuration, response.Auth.Renewable)
+		} else if len(v.RoleID) > 0 {
+			log.Println("Unable to renew vault token, logging in again:", err)
+			if err = v.login(ctx); err != nil {
+				return "", err
+			}
+		} else {
+			// Keep using the token until it expires
+			log.Println("Unable to renew vault token:", err)
+			v.renewable = false
+		}
+	}
+	return v.token, nil
+}
+
+// login with AppRole, or look up the lease of the configured token.  Must hold
+// v.mux.
+func (v *VaultSigner) login(ctx context.Context) error {
+	var response vaultResponse
+	if len(v.RoleID) == 0 {
+		if len(v.Token) == 0 {
+			return errors.New("vault requires a token or an AppRole role id")
+		}
+		if err := v.request(ctx, "/v1/auth/token/lookup-self", v.Token, nil, &response); err != nil {
+			return fmt.Errorf("unable to look up vault token: %v", err)
+		}
+		v.token = v.Token
+		v.setLease(response.Data.TTL, response.Data.Renewable)
+		return nil
+	}
+
+	path := fmt.Sprintf("/v1/auth/%v/login", v.mount(v.AppRoleMount, "approle"))
+	err := v.request(ctx, path, "", map[string]interface{}{
+		"role_id":   v.RoleID,
+		"secret_id": v.SecretID,
+	}, &response)
+	if err != nil {
+		return fmt.Errorf("unable to log in to vault with AppRole: %v", err)
+	}
+	if response.Auth == nil || len(response.Auth.ClientToken) == 0 {
+		return errors.New("vault AppRole login returned no token")
+	}
+	debugln("Logged in to vault with AppRole")
+	v.token = response.Auth.ClientToken
+	v.setLease(response.Auth.LeaseDuration, response.Auth.Renewable)
+	return nil
+}
+
+// setLease schedules renewal halfway through the lease.  Tokens without a
+// lease never expire.  Must hold v.mux.
+func (v *VaultSigner) setLease(seconds int, renewable bool) {
+	v.renewable = renewable
+	v.renewAt = time.Time{}
+	if seconds > 0 {
+		v.renewAt = v.time().Add(time.Duration(seconds) * time.Second / 2)
+	}
+}
+
+// resetToken forgets a token that has been revoked, unless it was already
+// replaced by another request
+func (v *VaultSigner) resetToken(token string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.token == token {
+		v.token = ""
+	}
+}
+
+// request POSTs the body to Vault, or GETs if it is nil, and decodes the response
+func (v *VaultSigner) request(ctx context.Context, path string, token string, body interface{}, result *vaultResponse) error {
+	method, encoded := http.MethodGet, []byte{}
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.Address, "/")+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	*result = vaultResponse{}
+	if len(contents) > 0 {
+		if err = json.Unmarshal(contents, result); err != nil {
+			return fmt.Errorf("unable to parse vault response: %v", err)
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &vaultError{status: resp.StatusCode, errors: result.Errors}
+	}
+	return nil
+}
+
+func isVaultPermissionDenied(err error) bool {
+	var vaultErr *vaultError
+	return errors.As(err, &vaultErr) && vaultErr.status == http.StatusForbidden
+}
+
+func (v *VaultSigner) mount(mount string, defaultMount string) string {
+	if len(mount) == 0 {
+		return defaultMount
+	}
+	return strings.Trim(mount, "/")
+}
+
+func (v *VaultSigner) time() time.Time {
+	if v.now == nil {
+		return time.Now()
+	}
+	return v.now()
+}
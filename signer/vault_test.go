@@ -0,0 +1,205 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// fakeVault serves the transit sign, token and AppRole APIs, signing with the
+// test keys by transit key name
+type fakeVault struct {
+	mux      sync.Mutex
+	tokens   map[string]bool
+	lease    int
+	logins   int
+	renewals int
+	requests []map[string]interface{}
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{tokens: map[string]bool{"root": true}, lease: 60}
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	body := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&body)
+	token := r.Header.Get("X-Vault-Token")
+
+	respond := func(status int, response interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+	auth := func(token string) map[string]interface{} {
+		return map[string]interface{}{"auth": map[string]interface{}{"client_token": token, "lease_duration": f.lease, "renewable": true}}
+	}
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			respond(http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role or secret id"}})
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("approle-%v", f.logins)
+		f.tokens[token] = true
+		respond(http.StatusOK, auth(token))
+		return
+	}
+	if !f.tokens[token] {
+		respond(http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/auth/token/lookup-self":
+		respond(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": f.lease, "renewable": true}})
+	case r.URL.Path == "/v1/auth/token/renew-self":
+		f.renewals++
+		respond(http.StatusOK, auth(token))
+	case strings.HasPrefix(r.URL.Path, "/v1/transit/sign/"):
+		f.requests = append(f.requests, body)
+		input, _ := base64.StdEncoding.DecodeString(body["input"].(string))
+		var sig []byte
+		switch strings.TrimPrefix(r.URL.Path, "/v1/transit/sign/") {
+		case "ed25519":
+			privateKey, _ := getTestAuthorizedKey(1)
+			sig = ed25519.Sign(privateKey, input)
+		case "p256":
+			r, s, _ := ecdsa.Sign(rand.Reader, testP256PrivateKey, input)
+			sig, _ = asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		default:
+			respond(http.StatusBadRequest, map[string]interface{}{"errors": []string{"encryption key not found"}})
+			return
+		}
+		signature := "vault:v1:" + base64.StdEncoding.EncodeToString(sig)
+		respond(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"signature": signature}})
+	default:
+		respond(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func getTestVaultKeys() []*Key {
+	_, client := getTestAuthorizedKey(1)
+	return []*Key{
+		{Name: "p256", PublicKeyHash: testP256Transfer.PublicKeyHash, PublicKey: testP256Transfer.PublicKey},
+		{Name: "ed25519", PublicKeyHash: client.PublicKeyHash(), PublicKey: client.PublicKey},
+	}
+}
+
+func TestVaultSigner(t *testing.T) {
+	fake := newFakeVault()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	vault := &VaultSigner{Address: server.URL, Token: "root"}
+
+	op, _ := ParseOperation([]byte(testAttestation.Operation))
+	for _, key := range getTestVaultKeys() {
+		if _, err := op.TzSign(context.Background(), vault, key); err != nil {
+			log.Printf("Unable to sign with %v: %v\n", key.Name, err)
+			t.Fail()
+		}
+	}
+	if len(fake.requests) != 2 || fake.requests[0]["prehashed"] != true || fake.requests[1]["prehashed"] != nil {
+		log.Printf("Expected only ecdsa requests to be prehashed: %v\n", fake.requests)
+		t.Fail()
+	}
+
+	// Vault has no secp256k1 keys
+	key := &Key{Name: "secp256k1", PublicKeyHash: testSecp256k1Transfer.PublicKeyHash}
+	if _, err := vault.Sign(context.Background(), op.Digest(), key); err == nil {
+		log.Println("Expected an error signing with a tz2 key")
+		t.Fail()
+	}
+
+	// Revoked tokens fail without AppRole to log in with
+	fake.tokens["root"] = false
+	if _, err := vault.Sign(context.Background(), op.Digest(), getTestVaultKeys()[0]); err == nil {
+		log.Println("Expected an error signing with a revoked token")
+		t.Fail()
+	}
+}
+
+func TestVaultAppRole(t *testing.T) {
+	fake := newFakeVault()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	clock := time.Unix(0, 0)
+	vault := &VaultSigner{Address: server.URL, RoleID: "role", SecretID: "secret", now: func() time.Time { return clock }}
+	key := getTestVaultKeys()[0]
+	op, _ := ParseOperation([]byte(testAttestation.Operation))
+
+	sign := func(name string) {
+		if _, err := op.TzSign(context.Background(), vault, key); err != nil {
+			log.Printf("%v: Unable to sign: %v\n", name, err)
+			t.Fail()
+		}
+	}
+
+	sign("Login")
+	sign("Reuse")
+	if fake.logins != 1 || fake.renewals != 0 {
+		log.Printf("Expected a single login, got %v logins and %v renewals\n", fake.logins, fake.renewals)
+		t.Fail()
+	}
+
+	// Tokens are renewed halfway through their lease
+	clock = clock.Add(30 * time.Second)
+	sign("Renew")
+	if fake.logins != 1 || fake.renewals != 1 {
+		log.Printf("Expected a renewal, got %v logins and %v renewals\n", fake.logins, fake.renewals)
+		t.Fail()
+	}
+
+	// Revoked tokens log in again
+	fake.tokens["approle-1"] = false
+	sign("Revoked")
+	if fake.logins != 2 {
+		log.Printf("Expected to log in again, got %v logins\n", fake.logins)
+		t.Fail()
+	}
+
+	// As do tokens that fail to renew
+	fake.tokens["approle-2"] = false
+	clock = clock.Add(time.Minute)
+	sign("Renewal failed")
+	if fake.logins != 3 {
+		log.Printf("Expected to log in after a failed renewal, got %v logins\n", fake.logins)
+		t.Fail()
+	}
+
+	// Bad credentials fail
+	vault = &VaultSigner{Address: server.URL, RoleID: "role", SecretID: "wrong"}
+	if _, err := vault.Sign(context.Background(), op.Digest(), key); err == nil {
+		log.Println("Expected an error logging in with the wrong secret id")
+		t.Fail()
+	}
+}
+
+func TestDecodeVaultSignature(t *testing.T) {
+	if sig, err := decodeVaultSignature("vault:v12:AQID"); err != nil || len(sig) != 3 {
+		log.Printf("Unable to decode a vault signature: %v %v\n", sig, err)
+		t.Fail()
+	}
+	for _, invalid := range []string{"AQID", "vault:AQID", "other:v1:AQID", "vault:v1:!"} {
+		if _, err := decodeVaultSignature(invalid); err == nil {
+			log.Printf("Expected an error decoding %v\n", invalid)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/ed25519"
+)
+
+// verifySignature checks a raw 64 byte signature of the provided digest against
+// an edpk, sppk or p2pk encoded public key
+func verifySignature(publicKey string, digest []byte, sig []byte) error {
+	curve, raw, err := decodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if len(sig) != 64 {
+		return errors.New("signature must be 64 bytes")
+	}
+
+	switch curve {
+	case curveEd25519:
+		if !ed25519.Verify(ed25519.PublicKey(raw), digest, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+	case curveSecp256k1:
+		pub, err := btcec.ParsePubKey(raw, btcec.S256())
+		if err != nil {
+			return err
+		}
+		signature := btcec.Signature{
+			R: new(big.Int).SetBytes(sig[:32]),
+			S: new(big.Int).SetBytes(sig[32:]),
+		}
+		if !signature.Verify(digest, pub) {
+			return errors.New("invalid secp256k1 signature")
+		}
+	case curveNistP256:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), raw)
+		if x == nil {
+			return errors.New("invalid p256 public key")
+		}
+		pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !ecdsa.Verify(&pub, digest, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return errors.New("invalid p256 signature")
+		}
+	}
+	return nil
+}
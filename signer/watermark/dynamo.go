@@ -1,6 +1,7 @@
 package watermark
 
 import (
+	"encoding/hex"
 	"fmt"
 	"log"
 	"math/big"
@@ -9,12 +10,13 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
 // DynamoWatermark stores the last-signed level in memory
 type DynamoWatermark struct {
 	table    string
-	dynamodb *dynamodb.DynamoDB
+	dynamodb dynamodbiface.DynamoDBAPI
 }
 
 // GetDynamoWatermark returns a new dynamo watermark manager
@@ -37,8 +39,18 @@ func getDynamoKey(keyHash string, chainID string, opMagicByte uint8) string {
 	return fmt.Sprintf("%v-%v-%v", keyHash, chainID, opMagicByte)
 }
 
-// getCurrentLevel watermarked in Dynamo
-func (mw *DynamoWatermark) getCurrentLevel(keyHash string, chainID string, opMagicByte uint8) (*big.Int, error) {
+// dynamoEntry is the watermark currently stored in Dynamo
+type dynamoEntry struct {
+	level *big.Int
+	round *big.Int
+	// Hex encoded hash of the last signed payload, if known
+	payloadHash string
+	// Rows written before rounds were tracked have no Round attribute
+	hasRound bool
+}
+
+// getCurrentEntry watermarked in Dynamo
+func (mw *DynamoWatermark) getCurrentEntry(keyHash string, chainID string, opMagicByte uint8) (*dynamoEntry, error) {
 	// Get Item
 	result, err := mw.dynamodb.GetItem(&dynamodb.GetItemInput{
 		TableName: aws.String(mw.table),
@@ -55,25 +67,56 @@ func (mw *DynamoWatermark) getCurrentLevel(keyHash string, chainID string, opMag
 		// The key does not exist in dynamo
 		return nil, nil
 	}
-	newInt, _ := new(big.Int).SetString(*result.Item["Level"].S, 10)
-	return newInt, nil
+	round := ""
+	if result.Item["Round"] != nil {
+		round = *result.Item["Round"].S
+	}
+	level, iRound, ok := parseLevelRound(*result.Item["Level"].S, round)
+	if !ok {
+		return nil, fmt.Errorf("unable to parse watermark level %v round %v", *result.Item["Level"].S, round)
+	}
+	payloadHash := ""
+	if result.Item["PayloadHash"] != nil {
+		payloadHash = *result.Item["PayloadHash"].S
+	}
+	return &dynamoEntry{
+		level:       level,
+		round:       iRound,
+		payloadHash: payloadHash,
+		hasRound:    result.Item["Round"] != nil,
+	}, nil
 }
 
 // putItem for the first time into Dynamo
-func (mw *DynamoWatermark) putItem(keyHash string, chainID string, opMagicByte uint8, level *big.Int) error {
+func (mw *DynamoWatermark) putItem(keyHash string, chainID string, opMagicByte uint8, level *big.Int, round *big.Int, payloadHash []byte) error {
 	_, err := mw.dynamodb.PutItem(&dynamodb.PutItemInput{
 		TableName: aws.String(mw.table),
 		Item: map[string]*dynamodb.AttributeValue{
-			"KeyChainOp": {S: aws.String(getDynamoKey(keyHash, chainID, opMagicByte))},
-			"Level":      {S: aws.String(level.String())},
+			"KeyChainOp":  {S: aws.String(getDynamoKey(keyHash, chainID, opMagicByte))},
+			"Level":       {S: aws.String(level.String())},
+			"Round":       {S: aws.String(round.String())},
+			"PayloadHash": {S: aws.String(hex.EncodeToString(payloadHash))},
 		},
 		ConditionExpression: aws.String("attribute_not_exists(KeyChainOp)"),
 	})
 	return err
 }
 
-// updateItem with a new level in dynamo
-func (mw *DynamoWatermark) updateItem(keyHash string, chainID string, opMagicByte uint8, currentLevel *big.Int, newLevel *big.Int) error {
+// updateItem with a new (level, round) in dynamo
+func (mw *DynamoWatermark) updateItem(keyHash string, chainID string, opMagicByte uint8, current *dynamoEntry, newLevel *big.Int, newRound *big.Int, payloadHash []byte) error {
+	values := map[string]*dynamodb.AttributeValue{
+		":newval":   &dynamodb.AttributeValue{S: aws.String(newLevel.String())},
+		":newround": &dynamodb.AttributeValue{S: aws.String(newRound.String())},
+		":currval":  &dynamodb.AttributeValue{S: aws.String(current.level.String())},
+		":newhash":  &dynamodb.AttributeValue{S: aws.String(hex.EncodeToString(payloadHash))},
+	}
+	// Migrate rows without a round by requiring that they still have none
+	condition := "#Level = :currval AND attribute_not_exists(#Round)"
+	if current.hasRound {
+		values[":currround"] = &dynamodb.AttributeValue{S: aws.String(current.round.String())}
+		condition = "#Level = :currval AND #Round = :currround"
+	}
+
 	// Update Item
 	_, err := mw.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
 		TableName: aws.String(mw.table),
@@ -82,42 +125,48 @@ func (mw *DynamoWatermark) updateItem(keyHash string, chainID string, opMagicByt
 		},
 		ExpressionAttributeNames: map[string]*string{
 			"#Level": aws.String("Level"),
+			"#Round": aws.String("Round"),
+			"#Hash":  aws.String("PayloadHash"),
 		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":newval":  &dynamodb.AttributeValue{S: aws.String(newLevel.String())},
-			":currval": &dynamodb.AttributeValue{S: aws.String(currentLevel.String())},
-		},
-		UpdateExpression:    aws.String("SET #Level = :newval"),
-		ConditionExpression: aws.String("#Level = :currval"),
+		ExpressionAttributeValues: values,
+		UpdateExpression:          aws.String("SET #Level = :newval, #Round = :newround, #Hash = :newhash"),
+		ConditionExpression:       aws.String(condition),
 	})
 	return err
 }
 
 // IsSafeToSign returns true if the provided (key, chainID, opMagicByte) tuple has
-// not yet been signed at this or greater levels
-func (mw *DynamoWatermark) IsSafeToSign(keyHash string, chainID string, opMagicByte uint8, level *big.Int) bool {
+// not yet been signed at this or greater (level, round), or if this is a retry
+// of the last signed payload
+func (mw *DynamoWatermark) IsSafeToSign(keyHash string, chainID string, opMagicByte uint8, level *big.Int, round *big.Int, payloadHash []byte) bool {
 
-	currentLevel, err := mw.getCurrentLevel(keyHash, chainID, opMagicByte)
+	current, err := mw.getCurrentEntry(keyHash, chainID, opMagicByte)
 	if err != nil {
 		log.Println("Error: Unable to get current level", err)
 		return false
 	}
 
 	// Create a new item if none currently exists
-	if currentLevel == nil {
-		err := mw.putItem(keyHash, chainID, opMagicByte, level)
+	if current == nil {
+		err := mw.putItem(keyHash, chainID, opMagicByte, level, round, payloadHash)
 		if err != nil {
 			return false
 		}
 		return true
 	}
 
+	// Allow retries of the exact payload we last signed
+	if isRetry(level, round, payloadHash, current.level, current.round, current.payloadHash) {
+		log.Println("Re-signing the last signed payload at this level")
+		return true
+	}
+
 	// Update existing items
-	if level.Cmp(currentLevel) != 1 {
+	if !isAbove(level, round, current.level, current.round) {
 		log.Println("Warning: Attempted to sign at an unsafe level. Will not allow.")
 		return false
 	} else {
-		err := mw.updateItem(keyHash, chainID, opMagicByte, currentLevel, level)
+		err := mw.updateItem(keyHash, chainID, opMagicByte, current, level, round, payloadHash)
 		if err != nil {
 			return false
 		}
@@ -0,0 +1,173 @@
+package watermark
+
+import (
+	"errors"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// stubDynamo is an in-memory table that evaluates the subset of expressions
+// used by DynamoWatermark, rejecting undefined placeholders as Dynamo would
+type stubDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+var errConditionFailed = errors.New("ConditionalCheckFailedException")
+
+func newStubDynamo() *stubDynamo {
+	return &stubDynamo{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func (s *stubDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: s.items[*input.Key["KeyChainOp"].S]}, nil
+}
+
+func (s *stubDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	key := *input.Item["KeyChainOp"].S
+	ok, err := s.condition(s.items[key], aws.StringValue(input.ConditionExpression), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errConditionFailed
+	}
+	s.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (s *stubDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	key := *input.Key["KeyChainOp"].S
+	names, values := input.ExpressionAttributeNames, input.ExpressionAttributeValues
+	if err := checkPlaceholders(aws.StringValue(input.UpdateExpression)+" "+aws.StringValue(input.ConditionExpression), names, values); err != nil {
+		return nil, err
+	}
+	item := s.items[key]
+	ok, err := s.condition(item, aws.StringValue(input.ConditionExpression), names, values)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errConditionFailed
+	}
+
+	updated := map[string]*dynamodb.AttributeValue{}
+	for name, value := range item {
+		updated[name] = value
+	}
+	updated["KeyChainOp"] = input.Key["KeyChainOp"]
+	for _, assignment := range strings.Split(strings.TrimPrefix(aws.StringValue(input.UpdateExpression), "SET "), ",") {
+		parts := strings.Split(assignment, "=")
+		updated[resolveName(strings.TrimSpace(parts[0]), names)] = values[strings.TrimSpace(parts[1])]
+	}
+	s.items[key] = updated
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// checkPlaceholders fails when an expression uses an undefined name or value
+func checkPlaceholders(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	for _, name := range regexp.MustCompile(`#\w+`).FindAllString(expression, -1) {
+		if names[name] == nil {
+			return errors.New("ValidationException: undefined attribute name " + name)
+		}
+	}
+	for _, value := range regexp.MustCompile(`:\w+`).FindAllString(expression, -1) {
+		if values[value] == nil {
+			return errors.New("ValidationException: undefined attribute value " + value)
+		}
+	}
+	return nil
+}
+
+func resolveName(name string, names map[string]*string) string {
+	if strings.HasPrefix(name, "#") {
+		return *names[name]
+	}
+	return name
+}
+
+// condition evaluates clauses of `A = :b` and `attribute_not_exists(A)` joined
+// by AND
+func (s *stubDynamo) condition(item map[string]*dynamodb.AttributeValue, expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, error) {
+	if len(expression) == 0 {
+		return true, nil
+	}
+	for _, clause := range strings.Split(expression, " AND ") {
+		clause = strings.TrimSpace(clause)
+		if strings.HasPrefix(clause, "attribute_not_exists(") {
+			name := resolveName(strings.TrimSuffix(strings.TrimPrefix(clause, "attribute_not_exists("), ")"), names)
+			if item != nil && item[name] != nil {
+				return false, nil
+			}
+			continue
+		}
+		parts := strings.Split(clause, " = ")
+		if len(parts) != 2 {
+			return false, errors.New("ValidationException: unsupported condition " + clause)
+		}
+		attribute := item[resolveName(parts[0], names)]
+		if attribute == nil || *attribute.S != *values[parts[1]].S {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func TestDynamoWatermark(t *testing.T) {
+	stub := newStubDynamo()
+	wm := &DynamoWatermark{table: "watermarks", dynamodb: stub}
+
+	keyHash := "tz2..."
+	chainID := "NetXdQprcVkpaWU"
+	opTypeBlock := uint8(0x11)
+	hash1 := []byte{0x01}
+	hash2 := []byte{0x02}
+	round0 := big.NewInt(0)
+	round1 := big.NewInt(1)
+	stored := func() map[string]*dynamodb.AttributeValue {
+		return stub.items[getDynamoKey(keyHash, chainID, opTypeBlock)]
+	}
+
+	// The first operation puts a new item
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(1), round0, hash1), "Block:1 should be safe to sign")
+	assert(t, *stored()["Level"].S == "1" && *stored()["Round"].S == "0" && *stored()["PayloadHash"].S == "01", "Block:1 should be stored")
+
+	// Higher levels and rounds update the item
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(2), round0, hash2), "Block:2 should be safe to sign")
+	assert(t, *stored()["Level"].S == "2" && *stored()["PayloadHash"].S == "02", "Block:2 should be stored")
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(2), round1, hash1), "Block:2:1 should be safe to sign")
+	assert(t, *stored()["Round"].S == "1" && *stored()["PayloadHash"].S == "01", "Block:2:1 should be stored")
+
+	// Retrying the same payload is idempotent, but a different payload is not
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(2), round1, hash1), "Retry of Block:2:1 should be safe to sign")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(2), round1, hash2), "Another payload at Block:2:1 should not be safe to sign")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(1), round0, hash1), "Block:1 should no longer be safe to sign")
+	assert(t, *stored()["Level"].S == "2" && *stored()["Round"].S == "1", "Refused operations should not be stored")
+}
+
+func TestDynamoWatermarkMigration(t *testing.T) {
+	stub := newStubDynamo()
+	wm := &DynamoWatermark{table: "watermarks", dynamodb: stub}
+
+	keyHash := "tz2..."
+	chainID := "NetXdQprcVkpaWU"
+	opTypeBlock := uint8(0x11)
+	key := getDynamoKey(keyHash, chainID, opTypeBlock)
+	// A row written before rounds and payload hashes were tracked
+	stub.items[key] = map[string]*dynamodb.AttributeValue{
+		"KeyChainOp": {S: aws.String(key)},
+		"Level":      {S: aws.String("5")},
+	}
+
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(5), big.NewInt(0), []byte{0x01}), "Block:5 should not be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, big.NewInt(6), big.NewInt(0), []byte{0x01}), "Block:6 should be safe to sign")
+	item := stub.items[key]
+	assert(t, *item["Level"].S == "6" && item["Round"] != nil && *item["Round"].S == "0", "Block:6 should be stored with a round")
+	assert(t, *item["PayloadHash"].S == "01", "Block:6 should be stored with its payload hash")
+}
@@ -83,13 +83,14 @@ func (wm *FileWatermark) saveToDisk() error {
 }
 
 // IsSafeToSign returns true if the provided (key, chainID, opType) tuple has
-// not yet been signed at this or greater levels
-func (wm *FileWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int) bool {
+// not yet been signed at this or greater (level, round), or if this is a retry
+// of the last signed payload
+func (wm *FileWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int, round *big.Int, payloadHash []byte) bool {
 	wm.mux.Lock()
 	defer wm.mux.Unlock()
 
 	// Verify logic is safe
-	isSessionSafe := wm.session.IsSafeToSign(keyHash, chainID, opType, level)
+	isSessionSafe := wm.session.IsSafeToSign(keyHash, chainID, opType, level, round, payloadHash)
 
 	// Update File
 	err := wm.saveToDisk()
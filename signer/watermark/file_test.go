@@ -0,0 +1,32 @@
+package watermark
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFileMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Watermark files written before rounds were tracked have no Round
+	file := path.Join(dir, "watermarks")
+	legacy := "- Key: tz2...\n  ChainID: NetXdQprcVkpaWU\n  OpType: \"2\"\n  Level: \"10\"\n"
+	if err := ioutil.WriteFile(file, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wm := GetFileWatermark(file)
+	assert(t, !wm.IsSafeToSign("tz2...", "NetXdQprcVkpaWU", 0x02, big.NewInt(10), big.NewInt(0), nil), "Legacy level should be treated as round 0")
+	assert(t, wm.IsSafeToSign("tz2...", "NetXdQprcVkpaWU", 0x02, big.NewInt(10), big.NewInt(1), nil), "Higher round at the legacy level should be safe")
+
+	contents, _ := ioutil.ReadFile(file)
+	assert(t, strings.Contains(string(contents), "Round: \"1\""), "Migrated entries should be saved with a round")
+}
@@ -13,6 +13,6 @@ func GetIgnoreWatermark() Watermark {
 }
 
 // IsSafeToSign is always true when we're ignoring the watermark
-func (mw *IgnoreWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int) bool {
+func (mw *IgnoreWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int, round *big.Int, payloadHash []byte) bool {
 	return true
 }
@@ -1,6 +1,7 @@
 package watermark
 
 import (
+	"encoding/hex"
 	"math/big"
 	"strconv"
 	"sync"
@@ -22,8 +23,9 @@ func GetSessionWatermark() *SessionWatermark {
 }
 
 // IsSafeToSign returns true if the provided (key, chainID, opType) tuple has
-// not yet been signed at this or greater levels
-func (mw *SessionWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int) bool {
+// not yet been signed at this or greater (level, round), or if this is a retry
+// of the last signed payload
+func (mw *SessionWatermark) IsSafeToSign(keyHash string, chainID string, opType uint8, level *big.Int, round *big.Int, payloadHash []byte) bool {
 	mw.mux.Lock()
 	defer mw.mux.Unlock()
 
@@ -31,23 +33,28 @@ func (mw *SessionWatermark) IsSafeToSign(keyHash string, chainID string, opType
 
 	for _, entry := range mw.watermarkEntries {
 		if entry.KeyHash == keyHash && entry.ChainID == chainID && entry.OpType == sOpType {
-			iLevel, ok := new(big.Int).SetString(entry.Level, 10)
+			iLevel, iRound, ok := parseLevelRound(entry.Level, entry.Round)
 			if !ok {
 				return false
 			}
-			// If the new level is > last level, update level and return true
-			if level.Cmp(iLevel) == 1 {
+			// If the new (level, round) is > last (level, round), update and return true
+			if isAbove(level, round, iLevel, iRound) {
 				entry.Level = level.String()
+				entry.Round = round.String()
+				entry.PayloadHash = hex.EncodeToString(payloadHash)
 				return true
 			}
-			return false
+			// Allow retries of the exact payload we last signed
+			return isRetry(level, round, payloadHash, iLevel, iRound, entry.PayloadHash)
 		}
 	}
 	mw.watermarkEntries = append(mw.watermarkEntries, &watermarkEntry{
-		KeyHash: keyHash,
-		ChainID: chainID,
-		OpType:  strconv.Itoa(int(opType)),
-		Level:   level.String(),
+		KeyHash:     keyHash,
+		ChainID:     chainID,
+		OpType:      strconv.Itoa(int(opType)),
+		Level:       level.String(),
+		Round:       round.String(),
+		PayloadHash: hex.EncodeToString(payloadHash),
 	})
 	return true
 }
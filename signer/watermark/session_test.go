@@ -26,28 +26,74 @@ func TestSameLevel(t *testing.T) {
 	// Levels
 	lvl1 := big.NewInt(1)
 	lvl2 := big.NewInt(2)
+	// Rounds
+	round0 := big.NewInt(0)
 
 	// Initial operation should be considered safe
-	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl1), "Mainnent:Block:1 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl1), "Mainnent:Endorsement:1 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl1), "Testnet:Block:1 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl1), "Testnet:Endorsement:1 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl1, round0, nil), "Mainnent:Block:1 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl1, round0, nil), "Mainnent:Endorsement:1 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl1, round0, nil), "Testnet:Block:1 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl1, round0, nil), "Testnet:Endorsement:1 Should be safe to sign")
 
 	// Subsequent levels should be considered safe
-	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl2), "Mainnent:Block:2 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl2), "Mainnent:Endorsement:2 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl2), "Testnet:Block:2 Should be safe to sign")
-	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl2), "Testnet:Endorsement:2 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl2, round0, nil), "Mainnent:Block:2 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl2, round0, nil), "Mainnent:Endorsement:2 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl2, round0, nil), "Testnet:Block:2 Should be safe to sign")
+	assert(t, wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl2, round0, nil), "Testnet:Endorsement:2 Should be safe to sign")
 
 	// The same level should fail
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl2), "Mainnent:Block:2 at the same level should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl2), "Mainnent:Endorsement:2 at the same level should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl2), "Testnet:Block:2 at the same level should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl2), "Testnet:Endorsement:2 at the same level should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl2, round0, nil), "Mainnent:Block:2 at the same level should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl2, round0, nil), "Mainnent:Endorsement:2 at the same level should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl2, round0, nil), "Testnet:Block:2 at the same level should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl2, round0, nil), "Testnet:Endorsement:2 at the same level should fail")
 
 	// Lower levels should fail
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl1), "Mainnent:Block:1 at lower levels should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl1), "Mainnent:Endorsement:1 at lower levels should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl1), "Testnet:Block:1 at lower levels should fail")
-	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl1), "Testnet:Endorsement:1 at lower levels should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeBlock, lvl1, round0, nil), "Mainnent:Block:1 at lower levels should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDMainnet, opTypeEndorsement, lvl1, round0, nil), "Mainnent:Endorsement:1 at lower levels should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeBlock, lvl1, round0, nil), "Testnet:Block:1 at lower levels should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainIDAlphanet, opTypeEndorsement, lvl1, round0, nil), "Testnet:Endorsement:1 at lower levels should fail")
+}
+
+func TestRounds(t *testing.T) {
+	wm := GetSessionWatermark()
+
+	keyHash := "tz2..."
+	chainID := "NetXdQprcVkpaWU"
+	opTypeAttestation := uint8(0x13)
+	lvl1 := big.NewInt(1)
+	lvl2 := big.NewInt(2)
+	round0 := big.NewInt(0)
+	round1 := big.NewInt(1)
+
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl1, round1, nil), "1:1 Should be safe to sign")
+	// Higher rounds at the same level are safe
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl1, round1, nil), "1:1 at the same round should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl1, round0, nil), "1:0 at a lower round should fail")
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl1, big.NewInt(2), nil), "1:2 at a higher round should be safe")
+	// Higher levels reset the round
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl2, round0, nil), "2:0 at a higher level should be safe")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeAttestation, lvl1, big.NewInt(5), nil), "1:5 at a lower level should fail")
+}
+
+func TestRetry(t *testing.T) {
+	wm := GetSessionWatermark()
+
+	keyHash := "tz2..."
+	chainID := "NetXdQprcVkpaWU"
+	opTypeBlock := uint8(0x11)
+	lvl1 := big.NewInt(1)
+	lvl2 := big.NewInt(2)
+	round0 := big.NewInt(0)
+	payload := []byte{0x01, 0x02}
+	otherPayload := []byte{0x03, 0x04}
+
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl1, round0, payload), "Initial payload should be safe to sign")
+	// Identical payloads at the same (level, round) may be re-signed
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl1, round0, payload), "Retried payload should be safe to sign")
+	// Anything else at the same (level, round) is refused
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl1, round0, otherPayload), "Different payload at the same level should fail")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl1, round0, nil), "Missing payload at the same level should fail")
+	// Once we've moved on, the old payload can't be re-signed
+	assert(t, wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl2, round0, otherPayload), "Higher level should be safe to sign")
+	assert(t, !wm.IsSafeToSign(keyHash, chainID, opTypeBlock, lvl1, round0, payload), "Retried payload at a lower level should fail")
 }
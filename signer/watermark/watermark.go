@@ -1,21 +1,65 @@
 package watermark
 
 import (
+	"encoding/hex"
 	"math/big"
 )
 
-// Watermark stores the last (key, level, chainID) tuple that has been signed
-// and fails if you attempt to sign the same or lesser level for that tuple
+// Watermark stores the last (key, chainID, opType, level, round) tuple that has
+// been signed and fails if you attempt to sign the same or lesser (level, round)
+// for that (key, chainID, opType).  Re-signing the exact payload that was last
+// signed is allowed so that clients can safely retry.
 type Watermark interface {
 	// IsSafeToSign returns true if the provided (key, chainID, opType) tuple has
-	// not yet been signed at this or greater levels
-	IsSafeToSign(keyHash string, chainID string, opMagicByte uint8, level *big.Int) bool
+	// not yet been signed at this or greater (level, round), or if payloadHash
+	// matches the payload last signed at this (level, round)
+	IsSafeToSign(keyHash string, chainID string, opMagicByte uint8, level *big.Int, round *big.Int, payloadHash []byte) bool
 }
 
-// watermarkEntry stores our locks
+// watermarkEntry stores our locks.  Entries written before rounds were tracked
+// have no Round and are treated as round 0.
 type watermarkEntry struct {
 	KeyHash string `yaml:"Key"`
 	ChainID string `yaml:"ChainID"`
 	OpType  string `yaml:"OpType"`
 	Level   string `yaml:"Level"`
+	Round   string `yaml:"Round"`
+	// Hex encoded hash of the last payload signed at this (level, round)
+	PayloadHash string `yaml:"PayloadHash"`
+}
+
+// parseLevelRound parses a stored (level, round) pair, defaulting a missing round to 0
+func parseLevelRound(level string, round string) (*big.Int, *big.Int, bool) {
+	iLevel, ok := new(big.Int).SetString(level, 10)
+	if !ok {
+		return nil, nil, false
+	}
+	if len(round) == 0 {
+		return iLevel, new(big.Int), true
+	}
+	iRound, ok := new(big.Int).SetString(round, 10)
+	if !ok {
+		return nil, nil, false
+	}
+	return iLevel, iRound, true
+}
+
+// isAbove returns true if (level, round) is strictly greater than (currentLevel, currentRound)
+func isAbove(level *big.Int, round *big.Int, currentLevel *big.Int, currentRound *big.Int) bool {
+	switch level.Cmp(currentLevel) {
+	case 1:
+		return true
+	case 0:
+		return round.Cmp(currentRound) == 1
+	}
+	return false
+}
+
+// isRetry returns true if (level, round, payloadHash) is exactly the last signed operation
+func isRetry(level *big.Int, round *big.Int, payloadHash []byte, currentLevel *big.Int, currentRound *big.Int, currentPayloadHash string) bool {
+	if len(payloadHash) == 0 || len(currentPayloadHash) == 0 {
+		return false
+	}
+	return level.Cmp(currentLevel) == 0 && round.Cmp(currentRound) == 0 &&
+		hex.EncodeToString(payloadHash) == currentPayloadHash
 }